@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"container/ring"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// bufferManager owns the in-memory health buffers of all resources, keyed by their UIDs. It outlives individual
+// events, and is the single source of truth for both the trackers and the query server.
+type bufferManager struct {
+
+	// mu guards all fields below.
+	mu sync.RWMutex
+
+	// buffers maps each resource UID to its buffer.
+	buffers map[types.UID]*recordBuffer
+
+	// uids maps each resource key to its UID, so buffers can be looked up by name.
+	uids map[string]types.UID
+}
+
+// recordBuffer is the circular buffer of a single resource.
+type recordBuffer struct {
+
+	// key is the namespace/name key of the resource.
+	key string
+
+	// ring holds the last `bufferSize` records of the resource.
+	ring *ring.Ring
+}
+
+// newBufferManager creates a new bufferManager.
+func newBufferManager() *bufferManager {
+	return &bufferManager{
+		buffers: make(map[types.UID]*recordBuffer),
+		uids:    make(map[string]types.UID),
+	}
+}
+
+// Ensure makes sure the resource has a buffer of the size set in its spec. A missing buffer is restored from the
+// resource's status, so history survives controller restarts, and an existing one is resized in place.
+func (m *bufferManager) Ensure(resource *v1alpha1.MetricsAnomalyDetectorResource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ensureLocked(resource)
+}
+
+// ensureLocked is Ensure, for callers that hold the lock.
+func (m *bufferManager) ensureLocked(resource *v1alpha1.MetricsAnomalyDetectorResource) *recordBuffer {
+	key, _ := cache.MetaNamespaceKeyFunc(resource)
+	bufferSize := resource.Spec.BufferSize
+
+	// Drop the buffer of a previous resource with the same name.
+	if uid, ok := m.uids[key]; ok && uid != resource.GetUID() {
+		delete(m.buffers, uid)
+	}
+	m.uids[key] = resource.GetUID()
+
+	// Restore the buffer from the status, if there is none in-memory.
+	buffer, ok := m.buffers[resource.GetUID()]
+	if !ok {
+		buffer = &recordBuffer{key: key, ring: newRecordRing(bufferSize)}
+		buffer.fill(statusBuffer(resource))
+		m.buffers[resource.GetUID()] = buffer
+
+		return buffer
+	}
+
+	// Resize the buffer, keeping the most recent records.
+	if buffer.ring.Len() != bufferSize {
+		records := buffer.records()
+		buffer.ring = newRecordRing(bufferSize)
+		buffer.fill(records)
+	}
+
+	return buffer
+}
+
+// Append appends the record to the resource's buffer, and returns the buffer's records. Buffers are only created
+// through Ensure, so records of resources that were released since, e.g., as probes were in flight, are dropped, and
+// false is returned.
+func (m *bufferManager) Append(resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) ([]v1alpha1.HealthcheckRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.buffers[resource.GetUID()]; !ok {
+		return nil, false
+	}
+	buffer := m.ensureLocked(resource)
+	buffer.ring = ringAppend(buffer.ring, record)
+
+	return buffer.records(), true
+}
+
+// Records returns the records of the resource with the given UID, oldest first.
+func (m *bufferManager) Records(uid types.UID) ([]v1alpha1.HealthcheckRecord, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	buffer, ok := m.buffers[uid]
+	if !ok {
+		return nil, false
+	}
+
+	return buffer.records(), true
+}
+
+// RecordsFor returns the records of the resource with the given namespace and name, oldest first.
+func (m *bufferManager) RecordsFor(namespace, name string) ([]v1alpha1.HealthcheckRecord, bool) {
+	m.mu.RLock()
+	uid, ok := m.uids[namespace+"/"+name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	return m.Records(uid)
+}
+
+// Release drops the buffer of the resource with the given key.
+func (m *bufferManager) Release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if uid, ok := m.uids[key]; ok {
+		delete(m.buffers, uid)
+		delete(m.uids, key)
+	}
+}
+
+// fill appends the records to the buffer, oldest first, keeping the most recent ones.
+func (b *recordBuffer) fill(records []v1alpha1.HealthcheckRecord) {
+	records = sortedRecords(records)
+	if len(records) > b.ring.Len() {
+		records = records[len(records)-b.ring.Len():]
+	}
+	for _, record := range records {
+		b.ring = ringAppend(b.ring, record)
+	}
+}
+
+// records returns a copy of the buffer's records, oldest first.
+func (b *recordBuffer) records() []v1alpha1.HealthcheckRecord {
+	return sortedRecords(flushRing(b.ring))
+}
+
+// statusBuffer returns the records of the resource's status, in either encoding. Buffers that fail to decode are
+// treated as empty.
+func statusBuffer(resource *v1alpha1.MetricsAnomalyDetectorResource) []v1alpha1.HealthcheckRecord {
+	records, err := resource.Status.Buffer()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error decoding buffer of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err))
+		return nil
+	}
+
+	return records
+}
+
+// setStatusBuffer writes the records to the resource's status, in the encoding set in its spec, and bumps the
+// buffer's modification time if that changed it.
+func setStatusBuffer(resource *v1alpha1.MetricsAnomalyDetectorResource, records []v1alpha1.HealthcheckRecord) {
+	previous := &v1alpha1.MetricsAnomalyDetectorResourceStatus{
+		LastBuffer:    resource.Status.LastBuffer,
+		CompactBuffer: resource.Status.CompactBuffer,
+	}
+	if resource.Spec.BufferEncoding == v1alpha1.BufferEncodingCompact {
+		resource.Status.LastBuffer = nil
+		resource.Status.CompactBuffer = v1alpha1.NewCompactHealthcheckBuffer(records)
+	} else {
+		resource.Status.LastBuffer = records
+		resource.Status.CompactBuffer = nil
+	}
+	if !statusEqual(previous, &v1alpha1.MetricsAnomalyDetectorResourceStatus{
+		LastBuffer:    resource.Status.LastBuffer,
+		CompactBuffer: resource.Status.CompactBuffer,
+	}) {
+		resource.Status.LastBufferModificationTime = metav1.Now()
+	}
+}
+
+// sortedRecords returns the valid records, sorted oldest first.
+func sortedRecords(records []v1alpha1.HealthcheckRecord) []v1alpha1.HealthcheckRecord {
+	sorted := make([]v1alpha1.HealthcheckRecord, 0, len(records))
+	for _, record := range records {
+		if record.Healthy != nil && record.Timestamp != nil {
+			sorted = append(sorted, record)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	return sorted
+}
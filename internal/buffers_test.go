@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestBufferManager(t *testing.T) {
+	m := newBufferManager()
+	start := time.Now()
+	recordAt := func(i int) v1alpha1.HealthcheckRecord {
+		return v1alpha1.HealthcheckRecord{Healthy: ptr.To(i%2 == 0), Timestamp: ptr.To(metav1.NewTime(start.Add(time.Duration(i) * time.Second)))}
+	}
+
+	// A missing buffer should be restored from the status, keeping the most recent records.
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "1"},
+		Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{BufferSize: 3},
+		Status: v1alpha1.MetricsAnomalyDetectorResourceStatus{
+			LastBuffer: []v1alpha1.HealthcheckRecord{recordAt(3), recordAt(0), recordAt(1), recordAt(2)},
+		},
+	}
+	m.Ensure(resource)
+	assertRecords(t, m, recordAt, resource, 1, 2, 3)
+
+	// Subsequent events should not reset the buffer from the status.
+	m.Append(resource, recordAt(4))
+	m.Ensure(resource)
+	assertRecords(t, m, recordAt, resource, 2, 3, 4)
+
+	// Growing the buffer should keep all records.
+	resource.Spec.BufferSize = 5
+	m.Append(resource, recordAt(5))
+	assertRecords(t, m, recordAt, resource, 2, 3, 4, 5)
+
+	// Shrinking the buffer should keep the most recent records.
+	resource.Spec.BufferSize = 2
+	m.Ensure(resource)
+	assertRecords(t, m, recordAt, resource, 4, 5)
+
+	// The buffer should be readable by name as well.
+	if records, ok := m.RecordsFor("default", "foo"); !ok || len(records) != 2 {
+		t.Errorf("Expected 2 records for default/foo, got %d", len(records))
+	}
+
+	// A recreated resource should not inherit the buffer of its predecessor.
+	recreated := resource.DeepCopy()
+	recreated.UID = "2"
+	recreated.Status.LastBuffer = nil
+	m.Ensure(recreated)
+	if _, ok := m.Records(resource.GetUID()); ok {
+		t.Errorf("Expected the buffer of the previous resource to be dropped")
+	}
+	assertRecords(t, m, recordAt, recreated)
+
+	// Released buffers should not be readable.
+	m.Release("default/foo")
+	if _, ok := m.RecordsFor("default", "foo"); ok {
+		t.Errorf("Expected the buffer to be released")
+	}
+
+	// Records of released resources, e.g., of probes in flight, should not recreate their buffers.
+	if _, ok := m.Append(recreated, recordAt(6)); ok {
+		t.Errorf("Expected the record of a released resource to be dropped")
+	}
+	if _, ok := m.RecordsFor("default", "foo"); ok {
+		t.Errorf("Expected the buffer to stay released")
+	}
+}
+
+// assertRecords checks that the buffer of the resource holds the records at the given offsets, in order.
+func assertRecords(t *testing.T, m *bufferManager, recordAt func(int) v1alpha1.HealthcheckRecord, resource *v1alpha1.MetricsAnomalyDetectorResource, offsets ...int) {
+	t.Helper()
+	records, ok := m.Records(resource.GetUID())
+	if !ok {
+		t.Fatalf("Expected a buffer for %s", resource.GetUID())
+	}
+	if len(records) != len(offsets) {
+		t.Fatalf("Expected %d records, got %d", len(offsets), len(records))
+	}
+	for i, record := range records {
+		if *record.Healthy != (offsets[i]%2 == 0) || !record.Timestamp.Equal(recordAt(offsets[i]).Timestamp) {
+			t.Errorf("Expected record %d to be at offset %d, got %v", i, offsets[i], record)
+		}
+	}
+}
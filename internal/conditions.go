@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rexagod/mad/internal/server"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// anomalyHealthScoreThreshold is the health score of the buffer below which an anomaly is detected.
+const anomalyHealthScoreThreshold = 0.5
+
+// Condition reasons.
+const (
+	reasonValidationFailed    = "ValidationFailed"
+	reasonValidationSucceeded = "ValidationSucceeded"
+	reasonInvalidSpec         = "InvalidSpec"
+	reasonEndpointsScheduled  = "EndpointsScheduled"
+	reasonAwaitingProbes      = "AwaitingProbes"
+	reasonEndpointsUnhealthy  = "EndpointsUnhealthy"
+	reasonEndpointsHealthy    = "EndpointsHealthy"
+	reasonNoRecords           = "NoRecords"
+	reasonHealthScoreLow      = "HealthScoreBelowThreshold"
+	reasonHealthScoreNormal   = "HealthScoreWithinThreshold"
+)
+
+// validateSpec returns the problems with the spec that the CRD schema does not catch.
+func validateSpec(spec *v1alpha1.MetricsAnomalyDetectorResourceSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	// Validate the endpoints.
+	endpointsPath := specPath.Child("healthcheckEndpoints")
+	if len(spec.HealthcheckEndpoints) == 0 {
+		errs = append(errs, field.Required(endpointsPath, "at least one endpoint is required"))
+	}
+	endpoints := sets.New[string]()
+	for i, endpoint := range spec.HealthcheckEndpoints {
+		if endpoints.Has(endpoint) {
+			errs = append(errs, field.Duplicate(endpointsPath.Index(i), endpoint))
+			continue
+		}
+		endpoints.Insert(endpoint)
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			errs = append(errs, field.Invalid(endpointsPath.Index(i), endpoint, err.Error()))
+			continue
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, field.Invalid(endpointsPath.Index(i), endpoint, "must be an absolute http(s) URL"))
+		}
+	}
+
+	// Validate the endpoint configurations.
+	configured := sets.New[string]()
+	for i, config := range spec.HealthcheckEndpointsConfig {
+		configPath := specPath.Child("healthcheckEndpointsConfig").Index(i)
+		if configured.Has(config.Endpoint) {
+			errs = append(errs, field.Duplicate(configPath.Child("endpoint"), config.Endpoint))
+		}
+		configured.Insert(config.Endpoint)
+		if !endpoints.Has(config.Endpoint) {
+			errs = append(errs, field.Invalid(configPath.Child("endpoint"), config.Endpoint, "must be listed in spec.healthcheckEndpoints"))
+		}
+		if config.Auth != nil {
+			authPath := configPath.Child("auth")
+			switch {
+			case config.Auth.Type == v1alpha1.HealthcheckEndpointAuthTypeBearerToken && config.Auth.BearerToken == nil:
+				errs = append(errs, field.Required(authPath.Child("bearerToken"), "required for the BearerToken type"))
+			case config.Auth.Type == v1alpha1.HealthcheckEndpointAuthTypeBasicAuth && config.Auth.BasicAuth == nil:
+				errs = append(errs, field.Required(authPath.Child("basicAuth"), "required for the BasicAuth type"))
+			}
+		}
+		if config.TLS != nil && (config.TLS.Cert == nil) != (config.TLS.Key == nil) {
+			errs = append(errs, field.Invalid(configPath.Child("tls"), "", "cert and key must be set together"))
+		}
+		for _, duration := range []struct {
+			name  string
+			value *metav1.Duration
+		}{
+			{"timeout", config.Timeout},
+			{"connectTimeout", config.ConnectTimeout},
+			{"retryBackoff", config.RetryBackoff},
+		} {
+			if duration.value != nil && duration.value.Duration <= 0 {
+				errs = append(errs, field.Invalid(configPath.Child(duration.name), duration.value.Duration.String(), "must be positive"))
+			}
+		}
+	}
+
+	return errs
+}
+
+// updateConditions sets the conditions of the resource from its spec, the last probe of each of its endpoints, and
+// its buffer.
+func updateConditions(resource *v1alpha1.MetricsAnomalyDetectorResource, records []v1alpha1.HealthcheckRecord) {
+	conditions := &resource.Status.Conditions
+	set := func(conditionType string, status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(conditions, metav1.Condition{
+			Type:               conditionType,
+			Status:             status,
+			ObservedGeneration: resource.GetGeneration(),
+			Reason:             reason,
+			Message:            message,
+		})
+	}
+
+	// Invalid specs are not probed, so only the anomaly detection, which is based on past records, still applies.
+	if errs := validateSpec(&resource.Spec); len(errs) > 0 {
+		message := errs.ToAggregate().Error()
+		set(v1alpha1.ConditionTypeInvalidSpec, metav1.ConditionTrue, reasonValidationFailed, message)
+		set(v1alpha1.ConditionTypeProbing, metav1.ConditionFalse, reasonInvalidSpec, "The spec is invalid")
+		set(v1alpha1.ConditionTypeDegraded, metav1.ConditionUnknown, reasonInvalidSpec, "The spec is invalid")
+		set(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonInvalidSpec, message)
+	} else {
+		set(v1alpha1.ConditionTypeInvalidSpec, metav1.ConditionFalse, reasonValidationSucceeded, "The spec is valid")
+		set(v1alpha1.ConditionTypeProbing, metav1.ConditionTrue, reasonEndpointsScheduled,
+			fmt.Sprintf("Probing %d endpoint(s) every %ds", len(resource.Spec.HealthcheckEndpoints), resource.Spec.QueryInterval))
+
+		// Collect the endpoints that were found unhealthy, or were not probed yet.
+		var unhealthy, pending []string
+		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
+			healthy, ok := resource.Status.HealthcheckEndpointsHealthy[endpoint]
+			switch {
+			case !ok:
+				pending = append(pending, endpoint)
+			case !healthy:
+				unhealthy = append(unhealthy, endpoint)
+			}
+		}
+		switch {
+		case len(unhealthy) > 0:
+			message := fmt.Sprintf("Unhealthy endpoints: %s", strings.Join(unhealthy, ", "))
+			set(v1alpha1.ConditionTypeDegraded, metav1.ConditionTrue, reasonEndpointsUnhealthy, message)
+			set(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonEndpointsUnhealthy, message)
+		case len(pending) > 0:
+			message := fmt.Sprintf("Awaiting the first probe of: %s", strings.Join(pending, ", "))
+			set(v1alpha1.ConditionTypeDegraded, metav1.ConditionFalse, reasonAwaitingProbes, message)
+			set(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonAwaitingProbes, message)
+		default:
+			set(v1alpha1.ConditionTypeDegraded, metav1.ConditionFalse, reasonEndpointsHealthy, "All endpoints are healthy")
+			set(v1alpha1.ConditionTypeReady, metav1.ConditionTrue, reasonEndpointsHealthy, "All endpoints are healthy")
+		}
+	}
+
+	// Detect anomalies in the buffer.
+	if len(records) == 0 {
+		set(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionUnknown, reasonNoRecords, "The buffer holds no records")
+		return
+	}
+	_, healthScore := server.EvaluateHealth(records)
+	if healthScore < anomalyHealthScoreThreshold {
+		set(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionTrue, reasonHealthScoreLow,
+			fmt.Sprintf("The health score of the buffer is %.2f, below %.2f", healthScore, anomalyHealthScoreThreshold))
+	} else {
+		set(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionFalse, reasonHealthScoreNormal,
+			fmt.Sprintf("The health score of the buffer is %.2f", healthScore))
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestUpdateConditions(t *testing.T) {
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Generation: 2},
+		Spec: v1alpha1.MetricsAnomalyDetectorResourceSpec{
+			BufferSize:           3,
+			QueryInterval:        10,
+			HealthcheckEndpoints: []string{"https://foo", "https://bar"},
+		},
+	}
+	expect := func(conditionType string, status metav1.ConditionStatus, reason string) {
+		t.Helper()
+		condition := meta.FindStatusCondition(resource.Status.Conditions, conditionType)
+		if condition == nil {
+			t.Errorf("Expected the %s condition to be set", conditionType)
+			return
+		}
+		if condition.Status != status || condition.Reason != reason || condition.ObservedGeneration != resource.GetGeneration() {
+			t.Errorf("Expected %s to be %s (%s) at generation %d, got %s (%s) at generation %d",
+				conditionType, status, reason, resource.GetGeneration(), condition.Status, condition.Reason, condition.ObservedGeneration)
+		}
+	}
+
+	// A resource that was never probed should not be ready.
+	updateConditions(resource, nil)
+	expect(v1alpha1.ConditionTypeInvalidSpec, metav1.ConditionFalse, reasonValidationSucceeded)
+	expect(v1alpha1.ConditionTypeProbing, metav1.ConditionTrue, reasonEndpointsScheduled)
+	expect(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonAwaitingProbes)
+	expect(v1alpha1.ConditionTypeDegraded, metav1.ConditionFalse, reasonAwaitingProbes)
+	expect(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionUnknown, reasonNoRecords)
+
+	// A resource with all endpoints healthy should be ready.
+	resource.Status.HealthcheckEndpointsHealthy = map[string]bool{"https://foo": true, "https://bar": true}
+	records := []v1alpha1.HealthcheckRecord{
+		{Healthy: ptr.To(true), Timestamp: ptr.To(metav1.Now())},
+		{Healthy: ptr.To(true), Timestamp: ptr.To(metav1.Now())},
+	}
+	updateConditions(resource, records)
+	expect(v1alpha1.ConditionTypeReady, metav1.ConditionTrue, reasonEndpointsHealthy)
+	expect(v1alpha1.ConditionTypeDegraded, metav1.ConditionFalse, reasonEndpointsHealthy)
+	expect(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionFalse, reasonHealthScoreNormal)
+
+	// A resource with an unhealthy endpoint, and a mostly unhealthy buffer, should be degraded and anomalous.
+	resource.Status.HealthcheckEndpointsHealthy["https://bar"] = false
+	records = append(records,
+		v1alpha1.HealthcheckRecord{Healthy: ptr.To(false), Timestamp: ptr.To(metav1.Now())},
+		v1alpha1.HealthcheckRecord{Healthy: ptr.To(false), Timestamp: ptr.To(metav1.Now())},
+		v1alpha1.HealthcheckRecord{Healthy: ptr.To(false), Timestamp: ptr.To(metav1.Now())},
+	)
+	updateConditions(resource, records)
+	expect(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonEndpointsUnhealthy)
+	expect(v1alpha1.ConditionTypeDegraded, metav1.ConditionTrue, reasonEndpointsUnhealthy)
+	expect(v1alpha1.ConditionTypeAnomalyDetected, metav1.ConditionTrue, reasonHealthScoreLow)
+
+	// An invalid spec should stop probing.
+	resource.Generation++
+	resource.Spec.HealthcheckEndpoints = append(resource.Spec.HealthcheckEndpoints, "foo")
+	resource.Spec.HealthcheckEndpointsConfig = []v1alpha1.HealthcheckEndpointConfig{{
+		Endpoint: "https://baz",
+		Auth:     &v1alpha1.HealthcheckEndpointAuth{Type: v1alpha1.HealthcheckEndpointAuthTypeBearerToken},
+	}}
+	if errs := validateSpec(&resource.Spec); len(errs) != 3 {
+		t.Errorf("Expected 3 validation errors, got %d: %v", len(errs), errs)
+	}
+	updateConditions(resource, records)
+	expect(v1alpha1.ConditionTypeInvalidSpec, metav1.ConditionTrue, reasonValidationFailed)
+	expect(v1alpha1.ConditionTypeProbing, metav1.ConditionFalse, reasonInvalidSpec)
+	expect(v1alpha1.ConditionTypeReady, metav1.ConditionFalse, reasonInvalidSpec)
+	expect(v1alpha1.ConditionTypeDegraded, metav1.ConditionUnknown, reasonInvalidSpec)
+}
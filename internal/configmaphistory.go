@@ -0,0 +1,532 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+
+	// historyOwnerLabel labels the history ConfigMaps with the UID of the resource they belong to.
+	historyOwnerLabel = "mad.instrumentation.k8s-sigs.io/history-of"
+
+	// historySeriesLabel labels the history ConfigMaps with the series they hold.
+	historySeriesLabel = "mad.instrumentation.k8s-sigs.io/history-series"
+
+	// historyFromAnnotation annotates the history ConfigMaps with the timestamp of their oldest entry.
+	historyFromAnnotation = "mad.instrumentation.k8s-sigs.io/history-from"
+
+	// historyToAnnotation annotates the history ConfigMaps with the timestamp of their newest entry.
+	historyToAnnotation = "mad.instrumentation.k8s-sigs.io/history-to"
+
+	// historyRecordsKey is the key of the entries in the history ConfigMaps, one JSON-encoded entry per line.
+	historyRecordsKey = "records"
+
+	// historyChunkPrefix prefixes the names of the history ConfigMaps, which are followed by the resource's UID, the
+	// series, and the chunk's sequence number.
+	historyChunkPrefix = "mad-history-"
+)
+
+// configMapHistoryBackend persists the history of resources to ConfigMaps in their namespaces, each holding a chunk of
+// up to chunkSize entries of a single series. Entries are batched in memory, and flushed every flushInterval, so the
+// apiserver only sees a write per resource, series, and interval. The chunks of each series are kept track of as they
+// are written, so neither queries, nor flushes list them, unless they were not written for a flushInterval, e.g., by
+// other replicas. ConfigMaps are owned by their resources, so they are garbage collected along with them.
+type configMapHistoryBackend struct {
+
+	// clientset is the clientset used to manage the ConfigMaps.
+	clientset kubernetes.Interface
+
+	// chunkSize is the maximum number of entries per ConfigMap.
+	chunkSize int
+
+	// flushInterval is the interval at which batched entries are flushed.
+	flushInterval time.Duration
+
+	// retentions are the retentions of all series.
+	retentions historyRetentions
+
+	// mu guards pending.
+	mu sync.Mutex
+
+	// pending holds the entries that are yet to be flushed, by resource and series.
+	pending map[historySeriesKey]*pendingHistory
+
+	// indexMu guards index.
+	indexMu sync.Mutex
+
+	// index holds the chunks of the series listed, or written within the last flushInterval, by resource and series.
+	// Series are listed again once their chunks fail to be written, e.g., as they were written elsewhere in between.
+	index map[historySeriesKey]*indexedHistoryChunks
+}
+
+// indexedHistoryChunks are the chunks of a series, as of the time they were last listed, or written.
+type indexedHistoryChunks struct {
+
+	// key is the key of the resource the series belongs to.
+	key string
+
+	// chunks are the chunks, ordered by their sequence numbers.
+	chunks []historyChunk
+
+	// synced is the time the chunks were last listed, or written.
+	synced time.Time
+}
+
+// historySeriesKey identifies a series of a resource.
+type historySeriesKey struct {
+
+	// uid is the UID of the resource.
+	uid types.UID
+
+	// series is the series.
+	series string
+}
+
+// pendingHistory holds the entries of a series that are yet to be flushed.
+type pendingHistory struct {
+
+	// resource is the resource the entries belong to.
+	resource *v1alpha1.MetricsAnomalyDetectorResource
+
+	// entries are the batched entries.
+	entries []historyEntry
+}
+
+// historyEntry is an encoded record, or bucket, along with its timestamp.
+type historyEntry struct {
+
+	// timestamp is the timestamp of the record, or the start of the bucket.
+	timestamp time.Time
+
+	// line is the encoded record, or bucket.
+	line []byte
+}
+
+// historyChunk is a history ConfigMap, along with its lines.
+type historyChunk struct {
+
+	// configMap is the ConfigMap holding the chunk.
+	configMap *corev1.ConfigMap
+
+	// sequence is the sequence number of the chunk.
+	sequence int
+
+	// lines are the encoded entries held by the chunk.
+	lines [][]byte
+}
+
+// newConfigMapHistoryBackend creates a new configMapHistoryBackend.
+func newConfigMapHistoryBackend(clientset kubernetes.Interface, chunkSize int, flushInterval time.Duration, retentions historyRetentions) *configMapHistoryBackend {
+	return &configMapHistoryBackend{
+		clientset:     clientset,
+		chunkSize:     chunkSize,
+		flushInterval: flushInterval,
+		retentions:    retentions,
+		pending:       map[historySeriesKey]*pendingHistory{},
+		index:         map[historySeriesKey]*indexedHistoryChunks{},
+	}
+}
+
+// Append batches the record, to be flushed later on.
+func (b *configMapHistoryBackend) Append(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) error {
+	if record.Timestamp == nil {
+		return nil
+	}
+	line, err := encodeHistoryEntry(record)
+	if err != nil {
+		return err
+	}
+	b.batch(resource, rawHistorySeries, historyEntry{timestamp: record.Timestamp.Time, line: line})
+
+	return nil
+}
+
+// AppendBucket batches the bucket, to be flushed later on.
+func (b *configMapHistoryBackend) AppendBucket(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, bucket v1alpha1.HealthcheckBucket) error {
+	if bucket.Timestamp == nil {
+		return nil
+	}
+	line, err := encodeHistoryEntry(bucket)
+	if err != nil {
+		return err
+	}
+	b.batch(resource, bucketHistorySeries(bucket.Width.Duration), historyEntry{timestamp: bucket.Timestamp.Time, line: line})
+
+	return nil
+}
+
+// Records returns the flushed, and the pending records of the resource within [from, to), oldest first.
+func (b *configMapHistoryBackend) Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	lines, err := b.lines(ctx, resource, rawHistorySeries, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordsWithin(sortedRecords(decodeHistoryEntries[v1alpha1.HealthcheckRecord](lines)), from, to), nil
+}
+
+// Buckets returns the flushed, and the pending buckets of the given width of the resource overlapping [from, to),
+// oldest first.
+func (b *configMapHistoryBackend) Buckets(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, width time.Duration, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	lines, err := b.lines(ctx, resource, bucketHistorySeries(width), from.Add(-width), to)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucketsWithin(sortedBuckets(decodeHistoryEntries[v1alpha1.HealthcheckBucket](lines)), from, to), nil
+}
+
+// Delete drops the pending entries, and the ConfigMaps of the resource.
+func (b *configMapHistoryBackend) Delete(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error {
+	b.mu.Lock()
+	for key := range b.pending {
+		if key.uid == resource.GetUID() {
+			delete(b.pending, key)
+		}
+	}
+	b.mu.Unlock()
+	b.indexMu.Lock()
+	for key := range b.index {
+		if key.uid == resource.GetUID() {
+			delete(b.index, key)
+		}
+	}
+	b.indexMu.Unlock()
+	configMaps := b.clientset.CoreV1().ConfigMaps(resource.GetNamespace())
+	list, err := configMaps.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{historyOwnerLabel: string(resource.GetUID())}).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing history of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+	for _, configMap := range list.Items {
+		if err = configMaps.Delete(ctx, configMap.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error deleting history chunk %s: %w", configMap.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// Release drops the chunks kept track of for the resource, as it may be written elsewhere from now on. Its pending
+// entries are still flushed.
+func (b *configMapHistoryBackend) Release(key string) {
+	b.indexMu.Lock()
+	defer b.indexMu.Unlock()
+	for seriesKey, indexed := range b.index {
+		if indexed.key == key {
+			delete(b.index, seriesKey)
+		}
+	}
+}
+
+// Run flushes the batched entries every flushInterval, and once more when the context is cancelled.
+func (b *configMapHistoryBackend) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, b.Flush, b.flushInterval)
+
+	// Flush the last batch, even though the context is cancelled.
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b.Flush(flushCtx)
+}
+
+// Flush writes the batched entries of all series to their ConfigMaps, and expires the entries past their series'
+// retention. Entries that fail to be flushed are kept for the next flush.
+func (b *configMapHistoryBackend) Flush(ctx context.Context) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "component", "history")
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = map[historySeriesKey]*pendingHistory{}
+	b.mu.Unlock()
+
+	// Drop the chunks that would be listed again anyway, so the ones of resources that are no longer read are not kept.
+	b.indexMu.Lock()
+	for key, indexed := range b.index {
+		if time.Since(indexed.synced) >= b.flushInterval {
+			delete(b.index, key)
+		}
+	}
+	b.indexMu.Unlock()
+	for key, p := range pending {
+		if err := b.flush(ctx, key.series, p); err != nil {
+			logger.Error(err, "failed to flush history", "resource", klog.KObj(p.resource), "series", key.series)
+
+			// Put the unwritten entries back in front of the ones batched since.
+			b.mu.Lock()
+			if latest, ok := b.pending[key]; ok {
+				p.resource = latest.resource
+				p.entries = append(p.entries, latest.entries...)
+			}
+			b.pending[key] = p
+			b.mu.Unlock()
+		}
+	}
+}
+
+// batch adds the entry to the pending entries of the series.
+func (b *configMapHistoryBackend) batch(resource *v1alpha1.MetricsAnomalyDetectorResource, series string, entry historyEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := historySeriesKey{uid: resource.GetUID(), series: series}
+	pending, ok := b.pending[key]
+	if !ok {
+		pending = &pendingHistory{}
+		b.pending[key] = pending
+	}
+	pending.resource = resource
+	pending.entries = append(pending.entries, entry)
+}
+
+// lines returns the flushed, and the pending lines of the series overlapping [from, to).
+func (b *configMapHistoryBackend) lines(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, series string, from, to time.Time) ([][]byte, error) {
+	chunks, err := b.chunks(ctx, resource, series, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for _, chunk := range chunks {
+		lines = append(lines, chunk.lines...)
+	}
+	b.mu.Lock()
+	if pending, ok := b.pending[historySeriesKey{uid: resource.GetUID(), series: series}]; ok {
+		for _, entry := range pending.entries {
+			lines = append(lines, entry.line)
+		}
+	}
+	b.mu.Unlock()
+
+	return lines, nil
+}
+
+// flush writes the pending entries of a series to its ConfigMaps, filling up its latest chunk first. Only the entries
+// that are yet to be written are left pending, should this fail halfway through.
+func (b *configMapHistoryBackend) flush(ctx context.Context, series string, pending *pendingHistory) (err error) {
+	resource := pending.resource
+	key := historySeriesKey{uid: resource.GetUID(), series: series}
+	configMaps := b.clientset.CoreV1().ConfigMaps(resource.GetNamespace())
+	chunks, err := b.chunks(ctx, resource, series, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	// Keep track of the written chunks, or list them again if any of them failed to be written.
+	defer func() {
+		b.indexMu.Lock()
+		defer b.indexMu.Unlock()
+		if err != nil {
+			delete(b.index, key)
+			return
+		}
+		b.index[key] = &indexedHistoryChunks{key: resource.GetNamespace() + "/" + resource.GetName(), chunks: chunks, synced: time.Now()}
+	}()
+
+	// Expire the chunks past the retention.
+	cutoff := time.Now().Add(-b.retentions.retention(series))
+	sequence := 0
+	var live []historyChunk
+	for _, chunk := range chunks {
+		sequence = max(sequence, chunk.sequence)
+		if len(chunk.lines) == 0 || !historyChunkBound(chunk.configMap, historyToAnnotation).Before(cutoff) {
+			live = append(live, chunk)
+			continue
+		}
+		if err = configMaps.Delete(ctx, chunk.configMap.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error expiring history chunk %s: %w", chunk.configMap.GetName(), err)
+		}
+	}
+	chunks = live
+
+	// Fill up the latest chunk.
+	sort.SliceStable(pending.entries, func(i, j int) bool {
+		return pending.entries[i].timestamp.Before(pending.entries[j].timestamp)
+	})
+	entries := pending.entries
+	if len(live) > 0 {
+		latest := live[len(live)-1]
+		if n := min(b.chunkSize-len(latest.lines), len(entries)); n > 0 {
+			configMap := latest.configMap.DeepCopy()
+			encodeHistoryChunk(configMap, latest.lines, entries[:n])
+			if configMap, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("error updating history chunk %s: %w", latest.configMap.GetName(), err)
+			}
+			chunks[len(chunks)-1] = historyChunk{configMap: configMap, sequence: latest.sequence, lines: decodeHistoryChunk(configMap)}
+			entries = entries[n:]
+			pending.entries = entries
+		}
+	}
+
+	// Create new chunks for the rest.
+	for len(entries) > 0 {
+		n := min(b.chunkSize, len(entries))
+		sequence++
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      historyChunkPrefix + string(resource.GetUID()) + "-" + series + "-" + strconv.Itoa(sequence),
+				Namespace: resource.GetNamespace(),
+				Labels: map[string]string{
+					historyOwnerLabel:  string(resource.GetUID()),
+					historySeriesLabel: series,
+				},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: v1alpha1.SchemeGroupVersion.String(),
+					Kind:       "MetricsAnomalyDetectorResource",
+					Name:       resource.GetName(),
+					UID:        resource.GetUID(),
+				}},
+			},
+		}
+		encodeHistoryChunk(configMap, nil, entries[:n])
+		name := configMap.GetName()
+		if configMap, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("error creating history chunk %s: %w", name, err)
+		}
+		chunks = append(chunks, historyChunk{configMap: configMap, sequence: sequence, lines: decodeHistoryChunk(configMap)})
+		entries = entries[n:]
+		pending.entries = entries
+	}
+
+	return nil
+}
+
+// chunks returns the chunks of the series overlapping [from, to), ordered by their sequence numbers. Zero times leave
+// the range open. The chunks are only listed if they were not listed, or written within the last flushInterval, and
+// are shared, so they must not be modified.
+func (b *configMapHistoryBackend) chunks(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, series string, from, to time.Time) ([]historyChunk, error) {
+	key := historySeriesKey{uid: resource.GetUID(), series: series}
+	b.indexMu.Lock()
+	indexed, ok := b.index[key]
+	b.indexMu.Unlock()
+	if !ok || time.Since(indexed.synced) >= b.flushInterval {
+		listed := time.Now()
+		chunks, err := b.listChunks(ctx, resource, series)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep the chunks written in the meantime, if any, as these are more recent than the listed ones.
+		b.indexMu.Lock()
+		if written, ok := b.index[key]; ok && written.synced.After(listed) {
+			indexed = written
+		} else {
+			indexed = &indexedHistoryChunks{key: resource.GetNamespace() + "/" + resource.GetName(), chunks: chunks, synced: listed}
+			b.index[key] = indexed
+		}
+		b.indexMu.Unlock()
+	}
+	all := indexed.chunks
+
+	// Skip the chunks outside the range.
+	chunks := make([]historyChunk, 0, len(all))
+	for _, chunk := range all {
+		if !to.IsZero() && !historyChunkBound(chunk.configMap, historyFromAnnotation).Before(to) {
+			continue
+		}
+		if !from.IsZero() && historyChunkBound(chunk.configMap, historyToAnnotation).Before(from) {
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
+
+// listChunks lists the chunks of the series, ordered by their sequence numbers.
+func (b *configMapHistoryBackend) listChunks(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, series string) ([]historyChunk, error) {
+	list, err := b.clientset.CoreV1().ConfigMaps(resource.GetNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			historyOwnerLabel:  string(resource.GetUID()),
+			historySeriesLabel: series,
+		}).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing history of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+	chunks := make([]historyChunk, 0, len(list.Items))
+	for i := range list.Items {
+		configMap := &list.Items[i]
+		sequence, err := strconv.Atoi(strings.TrimPrefix(configMap.GetName(), historyChunkPrefix+string(resource.GetUID())+"-"+series+"-"))
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, historyChunk{configMap: configMap, sequence: sequence, lines: decodeHistoryChunk(configMap)})
+	}
+	slices.SortFunc(chunks, func(a, b historyChunk) int {
+		return a.sequence - b.sequence
+	})
+
+	return chunks, nil
+}
+
+// historyChunkBound returns the time of the chunk's bound annotation. Chunks with missing, or invalid bounds are
+// treated as spanning all time, so they are never skipped.
+func historyChunkBound(configMap *corev1.ConfigMap, annotation string) time.Time {
+	bound, err := time.Parse(time.RFC3339, configMap.GetAnnotations()[annotation])
+	if err != nil {
+		if annotation == historyFromAnnotation {
+			return time.Time{}
+		}
+		return time.Unix(1<<62, 0)
+	}
+
+	return bound
+}
+
+// encodeHistoryChunk writes the chunk's existing lines, followed by the entries to the ConfigMap, one per line, and
+// widens its bound annotations to cover the entries.
+func encodeHistoryChunk(configMap *corev1.ConfigMap, lines [][]byte, entries []historyEntry) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	for _, entry := range entries {
+		buf.Write(entry.line)
+		buf.WriteByte('\n')
+	}
+	configMap.Data = map[string]string{historyRecordsKey: buf.String()}
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	from, to := entries[0].timestamp, entries[len(entries)-1].timestamp
+	if len(lines) > 0 {
+		if bound := historyChunkBound(configMap, historyFromAnnotation); bound.Before(from) {
+			from = bound
+		}
+		if bound := historyChunkBound(configMap, historyToAnnotation); bound.After(to) {
+			to = bound
+		}
+	}
+	configMap.Annotations[historyFromAnnotation] = from.UTC().Format(time.RFC3339Nano)
+	configMap.Annotations[historyToAnnotation] = to.UTC().Format(time.RFC3339Nano)
+}
+
+// decodeHistoryChunk splits the ConfigMap into its lines.
+func decodeHistoryChunk(configMap *corev1.ConfigMap) [][]byte {
+	data := configMap.Data[historyRecordsKey]
+	lines := make([][]byte, 0, strings.Count(data, "\n"))
+	for _, line := range strings.Split(data, "\n") {
+		if line != "" {
+			lines = append(lines, []byte(line))
+		}
+	}
+
+	return lines
+}
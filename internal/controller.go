@@ -17,20 +17,23 @@ limitations under the License.
 package internal
 
 import (
-	"container/ring"
 	"context"
 	"fmt"
-	"os"
+	"net/http"
+	"slices"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/time/rate"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/rexagod/mad/internal/server"
 	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
 	clientset "github.com/rexagod/mad/pkg/generated/clientset/versioned"
 	madscheme "github.com/rexagod/mad/pkg/generated/clientset/versioned/scheme"
-	informers "github.com/rexagod/mad/pkg/generated/informers/externalversions"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -39,6 +42,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -48,6 +52,9 @@ import (
 // controllerName is the event source for the recorder.
 const controllerName = "mad-controller"
 
+// leakDetectionInterval is the interval at which leaked subscriptions are looked for.
+const leakDetectionInterval = time.Minute
+
 const (
 	AddEvent = iota
 	UpdateEvent
@@ -57,24 +64,39 @@ const (
 // Controller is the controller implementation for MetricsAnomalyDetectorResource resources.
 type Controller struct {
 
-	// namespace is the namespace in which the controller will operate.
-	namespace string
-
 	// kubeclientset is a standard kubernetes clientset, required for native operations.
 	kubeclientset kubernetes.Interface
 
 	// madClientset is a clientset for our own API group.
 	madClientset clientset.Interface
 
-	// madInformerFactory is a shared informer factory for mad resources.
-	madInformerFactory informers.SharedInformerFactory
+	// informers runs the informers for mad resources in all watched namespaces.
+	informers *informerSet
+
+	// lister lists the mad resources across all watched namespaces.
+	lister listers.MetricsAnomalyDetectorResourceLister
 
 	// Querier is the querier used to query the endpoints for healthchecks.
 	madQuerier *Querier
 
-	// healthcheckEndpointStore is the store of healthcheck endpoints that are currently in-memory.
-	// All event handlers must use this store to ensure consistency.
-	healthcheckEndpointStore map[string]*endpointTracker
+	// scheduler schedules the healthcheck probes across all endpoints.
+	scheduler *probeScheduler
+
+	// registry is the registry of healthcheck endpoints that are currently in-memory, and their subscribers.
+	// All event handlers must use this registry to ensure consistency.
+	registry *endpointRegistry
+
+	// buffers holds the in-memory health buffers of all resources, and outlives individual events.
+	buffers *bufferManager
+
+	// history persists the history of all resources beyond their buffers.
+	history HistoryStore
+
+	// status coalesces the status updates of all resources.
+	status *statusWriter
+
+	// watch fans the events of all resources out to their watchers.
+	watch *watchHub
 
 	// workqueue is a rate limited work queue. This is used to queue work to be processed instead of performing it as
 	// soon as a change happens. This means we can ensure we only process a fixed amount of resources at a time, and
@@ -83,10 +105,49 @@ type Controller struct {
 
 	// recorder is an event recorder for recording Event resources to the Kubernetes API.
 	recorder record.EventRecorder
+
+	// shards tracks the replicas the resources are spread across, and is nil unless sharding is enabled.
+	shards *shardMembership
+
+	// leaderAddress is the address of the leader's query server, or empty if this replica is the leader, the leader
+	// does not advertise one, or no leader was observed yet, in which case it is nil.
+	leaderAddress atomic.Pointer[string]
+
+	// metrics is the registry of the controller's metrics.
+	metrics *prometheus.Registry
+}
+
+// ControllerOptions holds the configurable settings of the controller.
+type ControllerOptions struct {
+
+	// QuerierCredentials is the source of the credentials sent to endpoints that do not configure their own.
+	QuerierCredentials QuerierCredentials
+
+	// ProbeConcurrency is the maximum number of endpoints queried at once, across all resources.
+	ProbeConcurrency int
+
+	// Sharding configures the sharding of resources across replicas.
+	Sharding ShardingOptions
+
+	// WatchNamespaces selects the namespaces the controller watches.
+	WatchNamespaces WatchNamespaces
+
+	// History configures the store the history of resources is persisted to.
+	History HistoryOptions
+
+	// StatusMinInterval is the window status updates of a resource are coalesced over, and the minimum interval
+	// between two status writes for a resource.
+	StatusMinInterval time.Duration
 }
 
 // NewController returns a new sample controller.
-func NewController(ctx context.Context, kubeClientset kubernetes.Interface, madClientset clientset.Interface) *Controller {
+func NewController(
+	ctx context.Context,
+	kubeClientset kubernetes.Interface,
+	madClientset clientset.Interface,
+	restConfig *rest.Config,
+	options ControllerOptions,
+) (*Controller, error) {
 
 	// Add native resources to the default Kubernetes Scheme so Events can be logged for them.
 	utilruntime.Must(madscheme.AddToScheme(scheme.Scheme))
@@ -94,7 +155,7 @@ func NewController(ctx context.Context, kubeClientset kubernetes.Interface, madC
 	// Initialize the controller.
 	logger := klog.FromContext(ctx)
 	logger.V(4).Info("Creating event broadcaster")
-	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(eventCorrelatorOptions))
 	eventBroadcaster.StartStructuredLogging(0)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
@@ -110,43 +171,162 @@ func NewController(ctx context.Context, kubeClientset kubernetes.Interface, madC
 		rate.NewLimiter(rate.Limit(50), 300)},
 	)
 
-	// Get the namespace from the environment. Pods are required to have a namespace, so this is a safe assumption.
-	namespace, found := os.LookupEnv("NAMESPACE")
-	if !found {
-		panic("NAMESPACE environment variable not set")
-	}
 	controller := &Controller{
-		namespace:                namespace,
-		kubeclientset:            kubeClientset,
-		madClientset:             madClientset,
-		madInformerFactory:       informers.NewSharedInformerFactory(madClientset, time.Second*30),
-		madQuerier:               NewQuerier(),
-		healthcheckEndpointStore: make(map[string]*endpointTracker),
-		workqueue:                workqueue.NewRateLimitingQueue(ratelimiter),
-		recorder:                 recorder,
+		kubeclientset: kubeClientset,
+		madClientset:  madClientset,
+		registry:      newEndpointRegistry(),
+		buffers:       newBufferManager(),
+		watch:         newWatchHub(),
+		workqueue: workqueue.NewRateLimitingQueueWithConfig(ratelimiter, workqueue.RateLimitingQueueConfig{
+			Name: "resources",
+		}),
+		recorder: recorder,
+	}
+	if options.Sharding.Enabled {
+		controller.shards = newShardMembership(kubeClientset, options.Sharding)
 	}
 
-	// Set up event handlers for MetricsAnomalyDetectorResource resources.
-	logger.Info("Setting up event handlers")
-	_, err := controller.madInformerFactory.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			controller.enqueueMetricsAnomalyDetectorResource(obj, AddEvent)
+	// Set up the informers for the watched namespaces, along with event handlers for MetricsAnomalyDetectorResource
+	// resources. The resources of namespaces that stop being watched are released as if they were deleted.
+	logger.Info("Setting up event handlers", "watchNamespaces", options.WatchNamespaces.String())
+	informerSet, err := newInformerSet(madClientset, kubeClientset, options.WatchNamespaces, time.Second*30,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				controller.enqueueMetricsAnomalyDetectorResource(obj, AddEvent)
+			},
+			UpdateFunc: func(old, new interface{}) {
+				if old.(*v1alpha1.MetricsAnomalyDetectorResource).ResourceVersion == new.(*v1alpha1.MetricsAnomalyDetectorResource).ResourceVersion {
+					return
+				}
+				controller.enqueueMetricsAnomalyDetectorResource(new, UpdateEvent)
+			},
+			DeleteFunc: func(obj interface{}) {
+				controller.enqueueMetricsAnomalyDetectorResource(obj, DeleteEvent)
+			},
 		},
-		UpdateFunc: func(old, new interface{}) {
-			if old.(*v1alpha1.MetricsAnomalyDetectorResource).ResourceVersion == new.(*v1alpha1.MetricsAnomalyDetectorResource).ResourceVersion {
-				return
+		func(resources []*v1alpha1.MetricsAnomalyDetectorResource) {
+			for _, resource := range resources {
+				controller.enqueueMetricsAnomalyDetectorResource(resource, DeleteEvent)
 			}
-			controller.enqueueMetricsAnomalyDetectorResource(new, UpdateEvent)
-		},
-		DeleteFunc: func(obj interface{}) {
-			controller.enqueueMetricsAnomalyDetectorResource(obj, DeleteEvent)
+			go controller.releaseFinalizers(ctx, resources)
 		},
-	})
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating informers: %w", err)
+	}
+	controller.informers = informerSet
+	controller.lister = informerSet.Lister()
+
+	// Set up the querier, and the probe scheduler.
+	querier, err := NewQuerier(restConfig, options.QuerierCredentials, kubeClientset)
+	if err != nil {
+		return nil, fmt.Errorf("error creating querier: %w", err)
+	}
+	controller.madQuerier = querier
+	controller.scheduler = newProbeScheduler(instrumentQuery(querier.DoMADQuery), options.ProbeConcurrency)
+
+	// Set up the status writer.
+	controller.status = newStatusWriter(madClientset, controller.lister, recorder, controller.watch, options.StatusMinInterval)
+
+	// Set up the history store.
+	controller.history, err = newHistoryStore(options.History, kubeClientset, controller.buffers)
 	if err != nil {
-		klog.Fatal(err)
+		return nil, fmt.Errorf("error creating history store: %w", err)
 	}
 
-	return controller
+	// Set up the metrics.
+	controller.metrics = newMetricsRegistry(controller.lister, controller.buffers, controller.scheduler)
+
+	return controller, nil
+}
+
+// RegistryHandler exposes the contents of the endpoint registry, for debugging.
+func (c *Controller) RegistryHandler() http.Handler {
+	return c.registry
+}
+
+// MetricsHandler serves the metrics of the controller, in the Prometheus exposition format.
+func (c *Controller) MetricsHandler() http.Handler {
+	return metricsHandler(c.metrics)
+}
+
+// Lister returns the lister of the resources watched by the controller, backed by its informer cache.
+func (c *Controller) Lister() listers.MetricsAnomalyDetectorResourceLister {
+	return c.lister
+}
+
+// History returns the history of the resource overlapping [from, to), oldest first, at the finest resolution that is
+// still retained for the whole range. Records that are yet to be written to the status are read from the in-memory
+// buffers.
+func (c *Controller) History(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	return c.history.Buckets(ctx, resource, from, to)
+}
+
+// Records returns the raw records of the resource within [from, to), oldest first. Records that are yet to be written
+// to the status are read from the in-memory buffers.
+func (c *Controller) Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	return c.history.Records(ctx, resource, from, to)
+}
+
+// Watch streams the records of the resource as they are probed, and the anomalies detected, or cleared in its buffer
+// as their status is written, to the server's watchers.
+func (c *Controller) Watch(namespace, name string) (<-chan server.WatchEvent, []server.WatchEvent, func()) {
+	return c.watch.Watch(namespace, name)
+}
+
+// release drops the buffer, pending status updates, and subscriptions of the resource, as its event handler does,
+// and returns the endpoints it subscribed to.
+func (c *Controller) release(key string) []string {
+	namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+
+	return c.eventHandler(namespace).release(key)
+}
+
+// eventHandler returns the event handler of the resources in the namespace.
+func (c *Controller) eventHandler(namespace string) *madEventHandler {
+	return &madEventHandler{
+		namespace: namespace,
+		clientset: c.madClientset,
+		lister:    c.lister,
+		registry:  c.registry,
+		recorder:  c.recorder,
+		scheduler: c.scheduler,
+		buffers:   c.buffers,
+		history:   c.history,
+		status:    c.status,
+		watch:     c.watch,
+		owns:      c.owns,
+	}
+}
+
+// releaseLeakedSubscriptions releases the subscriptions of resources that no longer exist, and the scheduler
+// subscriptions that are not backed by the registry. Neither should happen, so these are logged as errors.
+func (c *Controller) releaseLeakedSubscriptions(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	for _, key := range c.registry.Resources() {
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			continue
+		}
+		if _, err = c.lister.MetricsAnomalyDetectorResources(namespace).Get(name); !errors.IsNotFound(err) {
+			continue
+		}
+		endpoints := c.release(key)
+		logger.Error(fmt.Errorf("leaked subscriptions"), "Released subscriptions of deleted resource", "resourceName", key, "endpoints", endpoints)
+	}
+
+	// Endpoints are registered before they are subscribed to, so list the subscriptions first.
+	subscriptions := c.scheduler.Subscriptions()
+	registered := c.registry.Snapshot().Resources
+	for subscriber, endpoints := range subscriptions {
+		for _, endpoint := range endpoints {
+			if slices.Contains(registered[subscriber], endpoint) {
+				continue
+			}
+			c.scheduler.Unsubscribe(subscriber, endpoint)
+			logger.Error(fmt.Errorf("leaked subscription"), "Released unregistered subscription", "resourceName", subscriber, "endpoint", endpoint)
+		}
+	}
 }
 
 // enqueueMetricsAnomalyDetectorResource takes a MetricsAnomalyDetectorResource resource and converts it into a namespace/name key.
@@ -160,6 +340,21 @@ func (c *Controller) enqueueMetricsAnomalyDetectorResource(obj interface{}, even
 	c.workqueue.Add([2]string{key, strconv.Itoa(event)})
 }
 
+// WarmUp starts the informers, and waits for their caches to sync. The informers keep running until the context is
+// cancelled, and calling this again is a no-op once they are synced.
+func (c *Controller) WarmUp(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	logger.Info("Waiting for informer caches to sync")
+
+	// Start the informers to begin populating the informer caches.
+	c.informers.Start(ctx)
+	if ok := c.informers.WaitForCacheSync(ctx); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	return nil
+}
+
 // Run starts the controller.
 func (c *Controller) Run(ctx context.Context, workers int) error {
 	defer utilruntime.HandleCrash()
@@ -167,14 +362,18 @@ func (c *Controller) Run(ctx context.Context, workers int) error {
 
 	logger := klog.FromContext(ctx)
 	logger.Info("Starting MetricsAnomalyDetectorResource controller")
-	logger.Info("Waiting for informer caches to sync")
-
-	// Start the informer factories to begin populating the informer caches.
-	c.madInformerFactory.Start(ctx.Done())
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.madInformerFactory.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().HasSynced); !ok {
-		return fmt.Errorf("failed to wait for caches to sync")
+	if err := c.WarmUp(ctx); err != nil {
+		return err
 	}
 
+	// Start the probe scheduler, the history store, and the status writer.
+	go c.scheduler.Run(ctx)
+	go c.history.Run(ctx)
+	go c.status.Run(ctx, workers)
+
+	// Periodically release subscriptions that outlived their resources.
+	go wait.UntilWithContext(ctx, c.releaseLeakedSubscriptions, leakDetectionInterval)
+
 	// Launch `workers` amount of goroutines to process the work queue.
 	logger.Info("Starting workers", "count", workers)
 	for i := 0; i < workers; i++ {
@@ -247,11 +446,20 @@ func (c *Controller) syncHandler(ctx context.Context, key string, event int) err
 		return nil
 	}
 
+	// Release resources owned by other replicas, which may have been handled here before a rebalance.
+	if !c.owns(key) {
+		c.release(key)
+		return nil
+	}
+
 	// Get the MetricsAnomalyDetectorResource resource with this namespace and name.
-	madResource, err := c.madInformerFactory.Mad().V1alpha1().MetricsAnomalyDetectorResources().Lister().MetricsAnomalyDetectorResources(namespace).Get(name)
+	madResource, err := c.lister.MetricsAnomalyDetectorResources(namespace).Get(name)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			utilruntime.HandleError(fmt.Errorf("metricsAnomalyDetectorResource '%s' in work queue no longer exists", key))
+
+			// Release any in-memory resources associated with the deleted resource.
+			c.release(key)
 			return nil
 		}
 
@@ -299,14 +507,7 @@ func (c *Controller) handleObject(ctx context.Context, obj interface{}, event in
 	logger.V(4).Info("Processing object", "object", klog.KObj(object))
 	switch o := object.(type) {
 	case *v1alpha1.MetricsAnomalyDetectorResource:
-		handler := &madEventHandler{
-			namespace:            object.GetNamespace(),
-			clientset:            c.madClientset,
-			endpointsGlobalStore: &c.healthcheckEndpointStore,
-			querier:              c.madQuerier,
-			rings:                make(map[string]*ring.Ring),
-		}
-		return handler.HandleEvent(ctx, o, event)
+		return c.eventHandler(object.GetNamespace()).HandleEvent(ctx, o, event)
 	default:
 		utilruntime.HandleError(fmt.Errorf("unknown object type: %T, full schema below:\n%s", o, spew.Sdump(obj)))
 	}
@@ -1,17 +1,16 @@
 package internal
 
 import (
-	"container/ring"
 	"context"
 	"fmt"
 
 	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
 	clientset "github.com/rexagod/mad/pkg/generated/clientset/versioned"
-	"k8s.io/apimachinery/pkg/api/errors"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -34,14 +33,32 @@ type madEventHandler struct {
 	// clientset is the clientset used to update the status of the mad resource.
 	clientset clientset.Interface
 
-	// endpointsGlobalStore is the global store of endpoints that are currently being tracked.
-	endpointsGlobalStore *map[string]*endpointTracker
+	// lister is the lister used to get the mad resource from the informer cache.
+	lister listers.MetricsAnomalyDetectorResourceLister
 
-	// querier is the querier used to query the healthcheck endpoints.
-	querier *Querier
+	// registry is the global registry of endpoints that are currently being tracked, and their subscribers.
+	registry *endpointRegistry
 
-	// rings is the map of object keys to their respective circular buffers that holds the last `bufferSize` events (by querying the endpoints of all associated components).
-	rings map[string]*ring.Ring
+	// recorder is the event recorder used to record events on the mad resource.
+	recorder record.EventRecorder
+
+	// scheduler is the scheduler used to probe the healthcheck endpoints.
+	scheduler *probeScheduler
+
+	// buffers holds the circular buffers of all resources, each of which holds the last `bufferSize` events (by querying the endpoints of all associated components).
+	buffers *bufferManager
+
+	// history persists the history of the mad resource beyond its buffer.
+	history HistoryStore
+
+	// status coalesces the status updates of the mad resource.
+	status *statusWriter
+
+	// watch fans the events of the mad resource out to its watchers.
+	watch *watchHub
+
+	// owns reports whether this replica handles the resource, or is nil if it handles all resources.
+	owns func(key string) bool
 }
 
 // HandleEvent handles events received from the informer.
@@ -66,107 +83,52 @@ func (h *madEventHandler) HandleEvent(ctx context.Context, o metav1.Object, even
 	// Add and update events are handled the same way.
 	case AddEvent, UpdateEvent:
 
-		// Try to retrieve the ring from the map, even if this is an add event, as this signals a situation where the delete event was not registered.
-		// This logic also considers the case where the controller was restarted, but one (or more) CRs persisted,
-		resourceRingPtr, ok := h.rings[key]
-
-		// We do not have an in-memory buffer for this resource.
-		if !ok {
-			bufferSize := resource.Spec.BufferSize
-			h.rings[key] = newRecordRing(bufferSize)
-
-			// TODO: Verify if this backup logic works in case of a stray MAD CR that pre-dates the controller.
-			observedBuffer := resource.Status.LastBuffer
-			if len(observedBuffer) > bufferSize {
-
-				// Keep the last bufferSize events.
-				observedBuffer = observedBuffer[len(observedBuffer)-bufferSize:]
-			}
-			for i := 0; i < len(observedBuffer); i++ {
-				h.rings[key] = ringAppend(h.rings[key], observedBuffer[i])
-			}
-			resourceRingPtr = h.rings[key]
-		} else {
-
-			// Check if the bufferSize was updated between restarts.
-			if resourceRingPtr.Len() != resource.Spec.BufferSize {
-				oldRingPtr := resourceRingPtr
-				newRingPtr := newRecordRing(resource.Spec.BufferSize)
-
-				// Copy the old ring into the new one.
-				newRingPtrCopy := newRingPtr
-				oldRingPtr.Do(func(p interface{}) {
-					if p != nil {
-						newRingPtr.Value = p
-						newRingPtr = newRingPtr.Next()
-					}
-				})
-
-				// Reset the ring pointer.
-				resourceRingPtr = newRingPtrCopy
-			}
+		// Tear down resources that are being deleted.
+		if resource.GetDeletionTimestamp() != nil {
+			return h.finalize(ctx, resource, key)
 		}
 
-		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			resource, err = h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(resource.Namespace).Get(ctx, resource.Name, metav1.GetOptions{})
-			if err != nil {
-				if errors.IsNotFound(err) {
-
-					// The object has been deleted, stop the update process, don't requeue.
-					return nil
-				}
-				return fmt.Errorf("failed to get %s/%s (%s): %w", resource.GetNamespace(), resource.GetName(), resource.GetObjectKind().GroupVersionKind(), err)
-			}
+		// Make sure the resource is not deleted before it is torn down.
+		if err = h.ensureFinalizer(ctx, resource); err != nil {
+			return err
+		}
 
-			// Modify the resource status.
-			resource.Status.CurrentBufferSize = resourceRingPtr.Len()
-			resource.Status.LastBufferModificationTime = metav1.Now()
-			resource.Status.LastBuffer = make([]v1alpha1.HealthcheckRecord, resourceRingPtr.Len())
-			resourceRingPtr.Do(func(p interface{}) {
-				if p == nil {
-					return
-				}
-				pTyped, ok := p.(v1alpha1.HealthcheckRecord)
-				if !ok {
-					logger.Error(fmt.Errorf("failed to cast object (%T) to %v", p, pTyped), "failed to cast object")
-					return
-				}
-				if pTyped.Healthy != nil && pTyped.Timestamp != nil {
-					resource.Status.LastBuffer = append(resource.Status.LastBuffer, pTyped)
-				}
-			})
-
-			// Update the status.
-			_, err := h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(h.namespace).UpdateStatus(ctx, resource, metav1.UpdateOptions{})
-			if err != nil {
-				if errors.IsConflict(err) {
-					logger.V(4).Info("resource was modified, retrying")
-					return err
-				}
-				logger.Error(err, "failed to update status")
-
-				// Don't requeue.
-				return nil
+		// Make sure the resource has an in-memory buffer of the right size. This restores the buffer from the status
+		// if it is missing, which also covers the case where the controller was restarted, but one (or more) CRs persisted.
+		h.buffers.Ensure(resource)
+		uid := resource.GetUID()
+
+		// Reflect the spec in the status. The buffer is read once the update is written, as trackers may have
+		// appended to it since. Updates that change nothing are not written, so they do not trigger further events.
+		h.status.Update(key, func(resource *v1alpha1.MetricsAnomalyDetectorResource) {
+			records, ok := h.buffers.Records(uid)
+			if !ok {
+				return
 			}
-			return nil
+			resource.Status.CurrentBufferSize = resource.Spec.BufferSize
+			setStatusBuffer(resource, records)
+			resource.Status.ObservedGeneration = resource.GetGeneration()
+			updateConditions(resource, records)
 		})
 
-		// Start tracking the endpoints.
-		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
+		// Stop tracking all endpoints of invalid specs, as surfaced by the InvalidSpec condition.
+		if errs := validateSpec(&resource.Spec); len(errs) > 0 {
+			logger.V(2).Info("Invalid spec", "err", errs.ToAggregate())
+			h.unsubscribe(key)
+			return nil
+		}
 
-			// Check if the endpoint is already being tracked in the global registry. If not, add and start tracking it.
-			store := h.endpointsGlobalStore
-			if _, ok := (*h.endpointsGlobalStore)[endpoint]; !ok {
-				(*store)[endpoint] = newEndpointTracker()
+		// Stop tracking the endpoints that were dropped from the spec.
+		for _, endpoint := range h.registry.Sync(key, resource.Spec.HealthcheckEndpoints) {
+			h.scheduler.Unsubscribe(key, endpoint)
+		}
 
-				// We assume that every endpoint maps to a single behavior, but this may be scaled to support multiple behaviors per endpoint, if need be.
-				(*store)[endpoint].fn = h.querier.DoMADQuery
-			}
-			(*store)[endpoint].trackMAD(
+		// Start tracking the endpoints. Endpoints that are already being tracked have their subscription updated.
+		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
+			h.trackMAD(
 				ctx,      // Cancel on context cancellation.
-				h,        // Update rings and resource status.
 				resource, // Get resource spec details without querying everytime.
-				key,      // Narrow down the ring to the current resource.
+				key,      // Narrow down the buffer to the current resource.
 				endpoint, // Endpoint to query.
 			)
 		}
@@ -174,18 +136,8 @@ func (h *madEventHandler) HandleEvent(ctx context.Context, o metav1.Object, even
 	// Release any in-memory resources associated with the current mad resource.
 	case DeleteEvent:
 
-		// Release associated object ring.
-		delete(h.rings, key)
-
-		// Release associated endpoint trackers.
-		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
-			store := h.endpointsGlobalStore
-			(*store)[endpoint].associatedHandlerCount -= 1
-			if (*store)[endpoint].associatedHandlerCount == 0 {
-				(*store)[endpoint].stopChannel <- struct{}{}
-				delete(*store, endpoint)
-			}
-		}
+		// Release associated object buffer and endpoint trackers.
+		h.release(key)
 	default:
 
 		// This should never happen.
@@ -194,3 +146,24 @@ func (h *madEventHandler) HandleEvent(ctx context.Context, o metav1.Object, even
 
 	return nil
 }
+
+// release stops tracking all endpoints of the resource, drops its buffer, the in-memory state of its history, and its
+// pending status updates, and returns the endpoints it subscribed to.
+func (h *madEventHandler) release(key string) []string {
+	h.buffers.Release(key)
+	h.history.Release(key)
+	h.status.Forget(key)
+	h.watch.Forget(key)
+
+	return h.unsubscribe(key)
+}
+
+// unsubscribe stops tracking all endpoints of the resource, and returns them.
+func (h *madEventHandler) unsubscribe(key string) []string {
+	endpoints := h.registry.Release(key)
+	for _, endpoint := range endpoints {
+		h.scheduler.Unsubscribe(key, endpoint)
+	}
+
+	return endpoints
+}
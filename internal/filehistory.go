@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// historySegmentExtension is the extension of the log segments, which are named after the Unix time they start at.
+const historySegmentExtension = ".log"
+
+// fileHistoryBackend persists the history of resources to append-only logs on disk, one directory per resource (by
+// UID) and series, split into segments of JSON-encoded entries, one per line. Segments past the series' retention are
+// deleted as a whole. The directory should be backed by a PersistentVolume, so the history outlives the controller's
+// pods.
+type fileHistoryBackend struct {
+
+	// dir is the directory the logs are written to.
+	dir string
+
+	// retentions are the retentions of all series.
+	retentions historyRetentions
+
+	// mu serializes writes, so entries are never interleaved.
+	mu sync.Mutex
+}
+
+// newFileHistoryBackend creates a new fileHistoryBackend.
+func newFileHistoryBackend(dir string, retentions historyRetentions) *fileHistoryBackend {
+	return &fileHistoryBackend{
+		dir:        dir,
+		retentions: retentions,
+	}
+}
+
+// Append appends the record to the raw series.
+func (b *fileHistoryBackend) Append(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) error {
+	if record.Timestamp == nil {
+		return nil
+	}
+	line, err := encodeHistoryEntry(record)
+	if err != nil {
+		return err
+	}
+
+	return b.appendLine(resource, rawHistorySeries, record.Timestamp.Time, line)
+}
+
+// AppendBucket appends the bucket to the series of its width.
+func (b *fileHistoryBackend) AppendBucket(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, bucket v1alpha1.HealthcheckBucket) error {
+	if bucket.Timestamp == nil {
+		return nil
+	}
+	line, err := encodeHistoryEntry(bucket)
+	if err != nil {
+		return err
+	}
+
+	return b.appendLine(resource, bucketHistorySeries(bucket.Width.Duration), bucket.Timestamp.Time, line)
+}
+
+// Records reads the records of the resource within [from, to) from the segments covering the range, oldest first.
+func (b *fileHistoryBackend) Records(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	lines, err := b.readLines(resource, rawHistorySeries, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return recordsWithin(sortedRecords(decodeHistoryEntries[v1alpha1.HealthcheckRecord](lines)), from, to), nil
+}
+
+// Buckets reads the buckets of the given width overlapping [from, to) from the segments covering the range, oldest
+// first.
+func (b *fileHistoryBackend) Buckets(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, width time.Duration, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	lines, err := b.readLines(resource, bucketHistorySeries(width), from.Add(-width), to)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucketsWithin(sortedBuckets(decodeHistoryEntries[v1alpha1.HealthcheckBucket](lines)), from, to), nil
+}
+
+// Delete drops the logs of the resource.
+func (b *fileHistoryBackend) Delete(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.RemoveAll(filepath.Join(b.dir, string(resource.GetUID()))); err != nil {
+		return fmt.Errorf("error deleting history of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+
+	return nil
+}
+
+// Release is a no-op, as nothing is kept in memory.
+func (*fileHistoryBackend) Release(string) {}
+
+// Run expires the segments past their retention, every quarter of a raw segment.
+func (b *fileHistoryBackend) Run(ctx context.Context) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "dir", b.dir, "component", "history")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := b.Expire(time.Now()); err != nil {
+			logger.Error(err, "failed to expire history")
+		}
+	}, b.retentions.segment(rawHistorySeries)/4)
+}
+
+// Expire deletes the segments that only hold entries past their series' retention, along with the directories left
+// empty.
+func (b *fileHistoryBackend) Expire(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	resources, err := os.ReadDir(b.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading history directory: %w", err)
+	}
+	for _, resource := range resources {
+		if !resource.IsDir() {
+			continue
+		}
+		resourceDir := filepath.Join(b.dir, resource.Name())
+		series, err := os.ReadDir(resourceDir)
+		if err != nil {
+			return fmt.Errorf("error reading history directory: %w", err)
+		}
+		for _, entry := range series {
+			if !entry.IsDir() {
+				continue
+			}
+			if err = b.expireSeries(filepath.Join(resourceDir, entry.Name()), entry.Name(), now); err != nil {
+				return err
+			}
+		}
+
+		// Remove the directories left empty, on a best-effort basis, as they may hold files other than segments.
+		_ = os.Remove(resourceDir)
+	}
+
+	return nil
+}
+
+// expireSeries deletes the segments of the series past its retention, and the series' directory, if left empty.
+func (b *fileHistoryBackend) expireSeries(dir, series string, now time.Time) error {
+	segment := b.retentions.segment(series)
+	cutoff := now.Add(-b.retentions.retention(series))
+	segments, err := b.segments(dir)
+	if err != nil {
+		return err
+	}
+	for start, path := range segments {
+		if start.Add(segment).After(cutoff) {
+			continue
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error expiring history segment: %w", err)
+		}
+	}
+	_ = os.Remove(dir)
+
+	return nil
+}
+
+// appendLine appends the line to the segment of the series covering the timestamp.
+func (b *fileHistoryBackend) appendLine(resource *v1alpha1.MetricsAnomalyDetectorResource, series string, timestamp time.Time, line []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dir := filepath.Join(b.dir, string(resource.GetUID()), series)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("error creating history directory: %w", err)
+	}
+	start := timestamp.Truncate(b.retentions.segment(series)).Unix()
+	f, err := os.OpenFile(filepath.Join(dir, strconv.FormatInt(start, 10)+historySegmentExtension), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening history segment: %w", err)
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing history segment: %w", err)
+	}
+
+	return f.Close()
+}
+
+// readLines reads the lines of the series' segments overlapping [from, to).
+func (b *fileHistoryBackend) readLines(resource *v1alpha1.MetricsAnomalyDetectorResource, series string, from, to time.Time) ([][]byte, error) {
+	segment := b.retentions.segment(series)
+	segments, err := b.segments(filepath.Join(b.dir, string(resource.GetUID()), series))
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for start, path := range segments {
+		if !overlapsRange(start, segment, from, to) {
+			continue
+		}
+		segmentLines, err := readHistorySegment(path)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, segmentLines...)
+	}
+
+	return lines, nil
+}
+
+// segments returns the paths of the segments in the directory, by their start times.
+func (b *fileHistoryBackend) segments(dir string) (map[time.Time]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading history directory: %w", err)
+	}
+	segments := make(map[time.Time]string, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), historySegmentExtension) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), historySegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments[time.Unix(start, 0)] = filepath.Join(dir, entry.Name())
+	}
+
+	return segments, nil
+}
+
+// readHistorySegment reads the lines of the segment.
+func readHistorySegment(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error opening history segment: %w", err)
+	}
+	defer f.Close()
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history segment: %w", err)
+	}
+
+	return lines, nil
+}
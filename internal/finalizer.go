@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	clientset "github.com/rexagod/mad/pkg/generated/clientset/versioned"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// finalizerName is the finalizer that holds off the deletion of resources until their trackers are torn down.
+const finalizerName = "mad.instrumentation.k8s-sigs.io/finalizer"
+
+// reasonDeleted is the reason of the event emitted once a resource has been torn down.
+const reasonDeleted = "Deleted"
+
+// ensureFinalizer adds the finalizer to the resource, if it is missing.
+func (h *madEventHandler) ensureFinalizer(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error {
+	if slices.Contains(resource.GetFinalizers(), finalizerName) {
+		return nil
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).Get(ctx, resource.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if slices.Contains(latest.GetFinalizers(), finalizerName) || latest.GetDeletionTimestamp() != nil {
+			return nil
+		}
+		latest.SetFinalizers(append(latest.GetFinalizers(), finalizerName))
+		_, err = h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to add finalizer to %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+
+	return nil
+}
+
+// finalize tears down the resource before it is deleted. The trackers are stopped first, so no probes land after the
+// final history is flushed to the status, then the history persisted elsewhere is dropped, a deletion event is emitted,
+// and the finalizer is removed.
+func (h *madEventHandler) finalize(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, key string) error {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "name", resource.GetName(), "namespace", resource.GetNamespace(), "component", "finalizer")
+	if !slices.Contains(resource.GetFinalizers(), finalizerName) {
+		h.release(key)
+		return nil
+	}
+
+	// Stop the trackers, and take over the final history. The buffer is kept until it is flushed, in case this fails.
+	h.unsubscribe(key)
+	records, ok := h.buffers.Records(resource.GetUID())
+
+	// Flush the final history.
+	if ok {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			latest, err := h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).Get(ctx, resource.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			setStatusBuffer(latest, records)
+			_, err = h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+
+			// Requeue, so the flush is retried.
+			return fmt.Errorf("failed to flush history of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+		}
+		logger.V(4).Info("Flushed final history", "records", len(records))
+	}
+	h.buffers.Release(key)
+	h.status.Forget(key)
+	h.watch.Forget(key)
+
+	// Drop the history persisted beyond the status.
+	if err := h.history.Delete(ctx, resource); err != nil {
+		return err
+	}
+
+	// Emit a deletion event.
+	h.recorder.Event(resource, corev1.EventTypeNormal, reasonDeleted, "Stopped tracking all endpoints, and flushed the final history")
+
+	// Remove the finalizer.
+	if err := removeFinalizer(ctx, h.clientset, resource); err != nil {
+		return err
+	}
+	logger.V(4).Info("Removed finalizer")
+
+	return nil
+}
+
+// removeFinalizer removes the finalizer from the resource, if it is still there.
+func removeFinalizer(ctx context.Context, client clientset.Interface, resource *v1alpha1.MetricsAnomalyDetectorResource) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := client.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).Get(ctx, resource.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(latest.GetFinalizers(), finalizerName) {
+			return nil
+		}
+		latest.SetFinalizers(slices.DeleteFunc(latest.GetFinalizers(), func(finalizer string) bool {
+			return finalizer == finalizerName
+		}))
+		_, err = client.MadV1alpha1().MetricsAnomalyDetectorResources(resource.GetNamespace()).Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to remove finalizer from %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+
+	return nil
+}
+
+// releaseFinalizers removes the finalizer from the resources of namespaces that stopped being watched, as no replica
+// finalizes them anymore, so their deletion is not held off forever. This is best effort, from the cached resources,
+// as they may no longer be accessible, in which case the finalizer is left to be removed by hand.
+func (c *Controller) releaseFinalizers(ctx context.Context, resources []*v1alpha1.MetricsAnomalyDetectorResource) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "component", "finalizer")
+	for _, resource := range resources {
+		if !slices.Contains(resource.GetFinalizers(), finalizerName) {
+			continue
+		}
+		if err := removeFinalizer(ctx, c.madClientset, resource); err != nil {
+			logger.Error(err, "Error removing finalizer from resource that is no longer watched", "resource", klog.KObj(resource))
+			continue
+		}
+		logger.V(4).Info("Removed finalizer from resource that is no longer watched", "resource", klog.KObj(resource))
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"github.com/rexagod/mad/pkg/generated/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func TestFinalizer(t *testing.T) {
+	ctx := context.Background()
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "1"},
+		Spec: v1alpha1.MetricsAnomalyDetectorResourceSpec{
+			BufferSize:           3,
+			HealthcheckEndpoints: []string{"https://foo"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(resource)
+	recorder := record.NewFakeRecorder(1)
+	h := &madEventHandler{
+		namespace: resource.GetNamespace(),
+		clientset: clientset,
+		registry:  newEndpointRegistry(),
+		recorder:  recorder,
+		scheduler: newProbeScheduler(nil, 1),
+		buffers:   newBufferManager(),
+		history:   newRollupHistoryStore(newFileHistoryBackend(t.TempDir(), historyRetentions{raw: time.Hour}), historyRetentions{raw: time.Hour}),
+		status:    newStatusWriter(clientset, nil, recorder, newWatchHub(), time.Second),
+		watch:     newWatchHub(),
+	}
+	key := "default/foo"
+
+	// The finalizer should be added to live resources.
+	if err := h.ensureFinalizer(ctx, resource); err != nil {
+		t.Fatal(err)
+	}
+	resource, err := clientset.MadV1alpha1().MetricsAnomalyDetectorResources("default").Get(ctx, "foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(resource.GetFinalizers(), finalizerName) {
+		t.Fatalf("Expected the finalizer to be added, got %v", resource.GetFinalizers())
+	}
+
+	// Track the resource, and record some history.
+	h.registry.Sync(key, resource.Spec.HealthcheckEndpoints)
+	h.trackMAD(ctx, resource, key, "https://foo")
+	record := v1alpha1.HealthcheckRecord{Healthy: ptr.To(true), Timestamp: ptr.To(metav1.Now())}
+	h.buffers.Ensure(resource)
+	h.buffers.Append(resource, record)
+	if err = h.history.Append(ctx, resource, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tearing down the resource should stop its trackers, flush its history, drop its persisted history, emit an event,
+	// and remove the finalizer.
+	resource.SetDeletionTimestamp(ptr.To(metav1.NewTime(time.Now())))
+	if err = h.finalize(ctx, resource, key); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions := h.scheduler.Subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("Expected the trackers to be stopped, got %v", subscriptions)
+	}
+	if _, ok := h.buffers.Records(resource.GetUID()); ok {
+		t.Errorf("Expected the buffer to be released")
+	}
+	resource, err = clientset.MadV1alpha1().MetricsAnomalyDetectorResources("default").Get(ctx, "foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resource.Status.LastBuffer) != 1 {
+		t.Errorf("Expected the history to be flushed, got %d records", len(resource.Status.LastBuffer))
+	}
+	if records, err := h.history.Records(ctx, resource, time.Time{}, time.Now().Add(time.Hour)); err != nil || len(records) != 0 {
+		t.Errorf("Expected the persisted history to be dropped, got %d records (%v)", len(records), err)
+	}
+	if slices.Contains(resource.GetFinalizers(), finalizerName) {
+		t.Errorf("Expected the finalizer to be removed, got %v", resource.GetFinalizers())
+	}
+	select {
+	case event := <-recorder.Events:
+		if event != "Normal Deleted Stopped tracking all endpoints, and flushed the final history" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+	default:
+		t.Errorf("Expected a deletion event")
+	}
+}
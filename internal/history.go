@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HistoryStoreKind is the kind of store the history of resources is persisted to.
+type HistoryStoreKind string
+
+const (
+
+	// HistoryStoreStatus keeps the history in the status of resources, capped at their buffer size.
+	HistoryStoreStatus HistoryStoreKind = "status"
+
+	// HistoryStoreConfigMap persists the history to chunked ConfigMaps, next to resources.
+	HistoryStoreConfigMap HistoryStoreKind = "configmap"
+
+	// HistoryStoreFile persists the history to append-only logs on disk, e.g., on a PersistentVolume.
+	HistoryStoreFile HistoryStoreKind = "file"
+)
+
+// HistoryOptions configures the store the history of resources is persisted to.
+type HistoryOptions struct {
+
+	// Store is the kind of store the history is persisted to.
+	Store HistoryStoreKind
+
+	// Retention is the duration for which raw records are kept. Only applies to the configmap, and file stores.
+	Retention time.Duration
+
+	// Rollups are the tiers raw records are downsampled to, for long-term history. Only apply to the configmap, and
+	// file stores.
+	Rollups []RollupTier
+
+	// FlushInterval is the interval at which records are flushed to ConfigMaps, in batches.
+	FlushInterval time.Duration
+
+	// ChunkSize is the maximum number of records per ConfigMap.
+	ChunkSize int
+
+	// Dir is the directory the append-only logs are written to.
+	Dir string
+}
+
+// HistoryStore persists the health records of resources beyond their in-memory buffers.
+type HistoryStore interface {
+
+	// Append persists the record of the resource. Stores may batch records, and persist them later on.
+	Append(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) error
+
+	// Records returns the raw records of the resource within [from, to), oldest first.
+	Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error)
+
+	// Buckets returns the history of the resource overlapping [from, to), oldest first, at the finest resolution that
+	// is still retained for the whole range. Raw records are returned as buckets of their own.
+	Buckets(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error)
+
+	// Delete drops the history of the resource.
+	Delete(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error
+
+	// Release drops the in-memory state of the resource, by its key, once it is released, e.g., handed over to another
+	// replica. Its persisted history is kept.
+	Release(key string)
+
+	// Run flushes batched records, and enforces the retention, until the context is cancelled.
+	Run(ctx context.Context)
+}
+
+// historyBackend persists the raw records, and the rollup buckets of resources, each in a series of their own.
+type historyBackend interface {
+
+	// Append persists the raw record of the resource.
+	Append(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) error
+
+	// AppendBucket persists the closed bucket of the resource, in the series of its width, replacing the one persisted
+	// with the same start, if any.
+	AppendBucket(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, bucket v1alpha1.HealthcheckBucket) error
+
+	// Records returns the raw records of the resource within [from, to), oldest first.
+	Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error)
+
+	// Buckets returns the buckets of the given width of the resource overlapping [from, to), oldest first.
+	Buckets(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, width time.Duration, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error)
+
+	// Delete drops all series of the resource.
+	Delete(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error
+
+	// Release drops the in-memory state of the resource, by its key, keeping its series.
+	Release(key string)
+
+	// Run flushes batched entries, and expires the ones past their series' retention, until the context is cancelled.
+	Run(ctx context.Context)
+}
+
+// rawHistorySeries is the series holding the raw records.
+const rawHistorySeries = "raw"
+
+// bucketHistorySeries returns the series holding the buckets of the given width, e.g., "60s".
+func bucketHistorySeries(width time.Duration) string {
+	return strconv.FormatInt(int64(width/time.Second), 10) + "s"
+}
+
+// historyRetentions holds the retentions of the raw series, and of the rollup tiers.
+type historyRetentions struct {
+
+	// raw is the retention of the raw series.
+	raw time.Duration
+
+	// tiers are the rollup tiers, finest first.
+	tiers []RollupTier
+}
+
+// retention returns the retention of the series. Series of tiers that are no longer configured fall back to the raw
+// retention, so they are expired eventually.
+func (r historyRetentions) retention(series string) time.Duration {
+	for _, tier := range r.tiers {
+		if bucketHistorySeries(tier.Width) == series {
+			return tier.Retention
+		}
+	}
+
+	return r.raw
+}
+
+// segment returns the span of time covered by each segment, or chunk of the series. Raw segments span an hour, and
+// bucket segments sixty buckets.
+func (r historyRetentions) segment(series string) time.Duration {
+	for _, tier := range r.tiers {
+		if bucketHistorySeries(tier.Width) == series {
+			return 60 * tier.Width
+		}
+	}
+
+	return time.Hour
+}
+
+// newHistoryStore creates the history store configured by the options.
+func newHistoryStore(options HistoryOptions, kubeClientset kubernetes.Interface, buffers *bufferManager) (HistoryStore, error) {
+	switch options.Store {
+	case HistoryStoreStatus, "":
+		return &statusHistoryStore{buffers: buffers}, nil
+	case HistoryStoreConfigMap:
+		if options.ChunkSize <= 0 || options.FlushInterval <= 0 || options.Retention <= 0 {
+			return nil, fmt.Errorf("configmap history store requires a positive chunk size, flush interval, and retention")
+		}
+		retentions, err := newHistoryRetentions(options.Retention, options.Rollups)
+		if err != nil {
+			return nil, err
+		}
+		return newRollupHistoryStore(newConfigMapHistoryBackend(kubeClientset, options.ChunkSize, options.FlushInterval, retentions), retentions), nil
+	case HistoryStoreFile:
+		if options.Dir == "" || options.Retention <= 0 {
+			return nil, fmt.Errorf("file history store requires a directory, and a positive retention")
+		}
+		retentions, err := newHistoryRetentions(options.Retention, options.Rollups)
+		if err != nil {
+			return nil, err
+		}
+		return newRollupHistoryStore(newFileHistoryBackend(options.Dir, retentions), retentions), nil
+	default:
+		return nil, fmt.Errorf("unknown history store %q", options.Store)
+	}
+}
+
+// statusHistoryStore keeps the history in the in-memory buffers of resources, which are flushed to their status.
+type statusHistoryStore struct {
+
+	// buffers holds the in-memory health buffers of all resources.
+	buffers *bufferManager
+}
+
+// Append is a no-op, as records are appended to the buffers, and flushed to the status, by the trackers.
+func (*statusHistoryStore) Append(context.Context, *v1alpha1.MetricsAnomalyDetectorResource, v1alpha1.HealthcheckRecord) error {
+	return nil
+}
+
+// Records returns the records of the resource's buffer, or of its status, if it has no buffer.
+func (s *statusHistoryStore) Records(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	records, ok := s.buffers.Records(resource.GetUID())
+	if !ok {
+		records = sortedRecords(statusBuffer(resource))
+	}
+
+	return recordsWithin(records, from, to), nil
+}
+
+// Buckets returns the records of the resource's buffer, or of its status, as buckets of their own, since the status
+// is not rolled up.
+func (s *statusHistoryStore) Buckets(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	records, err := s.Records(ctx, resource, from, to)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]v1alpha1.HealthcheckBucket, 0, len(records))
+	for _, record := range records {
+		buckets = append(buckets, record.Bucket())
+	}
+
+	return buckets, nil
+}
+
+// Delete is a no-op, as the status goes along with the resource.
+func (*statusHistoryStore) Delete(context.Context, *v1alpha1.MetricsAnomalyDetectorResource) error {
+	return nil
+}
+
+// Release is a no-op, as the buffers are released along with the resource.
+func (*statusHistoryStore) Release(string) {}
+
+// Run is a no-op, as there is nothing to flush, or expire.
+func (*statusHistoryStore) Run(context.Context) {}
+
+// withinRange returns whether the time is within [from, to). Zero times leave the range open.
+func withinRange(t, from, to time.Time) bool {
+	return !t.Before(from) && (to.IsZero() || t.Before(to))
+}
+
+// overlapsRange returns whether the window of the given width starting at the given time overlaps [from, to). Zero
+// times leave the range open.
+func overlapsRange(start time.Time, width time.Duration, from, to time.Time) bool {
+	return start.Add(width).After(from) && (to.IsZero() || start.Before(to))
+}
+
+// recordsWithin returns the records within [from, to), in their original order.
+func recordsWithin(records []v1alpha1.HealthcheckRecord, from, to time.Time) []v1alpha1.HealthcheckRecord {
+	within := make([]v1alpha1.HealthcheckRecord, 0, len(records))
+	for _, record := range records {
+		if record.Timestamp == nil || !withinRange(record.Timestamp.Time, from, to) {
+			continue
+		}
+		within = append(within, record)
+	}
+
+	return within
+}
+
+// bucketsWithin returns the buckets overlapping [from, to), in their original order. Buckets without a width are
+// treated as instants, like records.
+func bucketsWithin(buckets []v1alpha1.HealthcheckBucket, from, to time.Time) []v1alpha1.HealthcheckBucket {
+	within := make([]v1alpha1.HealthcheckBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.Timestamp == nil {
+			continue
+		}
+		if width := bucket.Width.Duration; width == 0 {
+			if !withinRange(bucket.Timestamp.Time, from, to) {
+				continue
+			}
+		} else if !overlapsRange(bucket.Timestamp.Time, width, from, to) {
+			continue
+		}
+		within = append(within, bucket)
+	}
+
+	return within
+}
+
+// sortedBuckets returns the timestamped buckets, oldest first. Buckets are upserted by appending them again, so only the
+// last one of the buckets sharing a start, and width is kept.
+func sortedBuckets(buckets []v1alpha1.HealthcheckBucket) []v1alpha1.HealthcheckBucket {
+	sorted := make([]v1alpha1.HealthcheckBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		if bucket.Timestamp != nil {
+			sorted = append(sorted, bucket)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+	upserted := sorted[:0]
+	for _, bucket := range sorted {
+		if n := len(upserted); n > 0 && bucket.Width.Duration > 0 && upserted[n-1].Width == bucket.Width && upserted[n-1].Timestamp.Equal(bucket.Timestamp) {
+			upserted[n-1] = bucket
+			continue
+		}
+		upserted = append(upserted, bucket)
+	}
+
+	return upserted
+}
+
+// encodeHistoryEntry encodes the record, or bucket as a single line.
+func encodeHistoryEntry(entry any) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding history entry: %w", err)
+	}
+
+	return line, nil
+}
+
+// decodeHistoryEntries decodes the lines into records, or buckets. Lines that fail to decode, e.g., partially written
+// ones, are skipped.
+func decodeHistoryEntries[T v1alpha1.HealthcheckRecord | v1alpha1.HealthcheckBucket](lines [][]byte) []T {
+	entries := make([]T, 0, len(lines))
+	for _, line := range lines {
+		var entry T
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+// historyResource is the resource the history store tests record the history of.
+var historyResource = &v1alpha1.MetricsAnomalyDetectorResource{
+	ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "1"},
+}
+
+// historyRecords returns a record every interval, ending an interval before now, oldest first.
+func historyRecords(now time.Time, interval time.Duration, count int) []v1alpha1.HealthcheckRecord {
+	records := make([]v1alpha1.HealthcheckRecord, count)
+	for i := range records {
+		records[i] = v1alpha1.HealthcheckRecord{
+			Healthy:   ptr.To(i%2 == 0),
+			Timestamp: ptr.To(metav1.NewTime(now.Add(-time.Duration(count-i) * interval))),
+		}
+	}
+
+	return records
+}
+
+// assertHistory asserts that the backend holds the given number of records within [from, to), oldest first.
+func assertHistory(t *testing.T, store historyBackend, from, to time.Time, want int) {
+	t.Helper()
+	records, err := store.Records(context.Background(), historyResource, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != want {
+		t.Errorf("Expected %d records within [%s, %s), got %d", want, from, to, len(records))
+		return
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Timestamp.Before(records[i-1].Timestamp) {
+			t.Errorf("Expected records to be sorted oldest first, got %v", records)
+			return
+		}
+	}
+}
+
+func TestFileHistoryBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := newFileHistoryBackend(dir, historyRetentions{raw: 24 * time.Hour})
+	now := time.Now().Truncate(time.Second)
+
+	// Records should span multiple segments, and be read back across them.
+	for _, record := range historyRecords(now, 10*time.Minute, 6*24*2) {
+		if err := store.Append(ctx, historyResource, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertHistory(t, store, now.Add(-48*time.Hour), now, 6*24*2)
+	assertHistory(t, store, now.Add(-time.Hour), now, 6)
+	assertHistory(t, store, now, now.Add(time.Hour), 0)
+
+	// Ranges should include their start, and exclude their end. Zero times should leave them open.
+	assertHistory(t, store, now.Add(-20*time.Minute), now.Add(-10*time.Minute), 1)
+	assertHistory(t, store, now.Add(-time.Hour), time.Time{}, 6)
+	assertHistory(t, store, time.Time{}, now.Add(-47*time.Hour), 6)
+
+	// Partially written records should be skipped.
+	segments, err := store.segments(filepath.Join(dir, string(historyResource.GetUID()), rawHistorySeries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range segments {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString(`{"healthy":tr`)
+		_ = f.Close()
+	}
+	assertHistory(t, store, now.Add(-time.Hour), now, 6)
+
+	// Segments past the retention should be expired as a whole.
+	if err = store.Expire(now); err != nil {
+		t.Fatal(err)
+	}
+	assertHistory(t, store, now.Add(-23*time.Hour), now, 6*23)
+	assertHistory(t, store, now.Add(-48*time.Hour), now.Add(-26*time.Hour), 0)
+
+	// Deleting the history should drop all records.
+	if err = store.Delete(ctx, historyResource); err != nil {
+		t.Fatal(err)
+	}
+	assertHistory(t, store, now.Add(-48*time.Hour), now, 0)
+}
+
+func TestConfigMapHistoryBackend(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	store := newConfigMapHistoryBackend(clientset, 100, time.Minute, historyRetentions{raw: 24 * time.Hour})
+	now := time.Now().Truncate(time.Second)
+	records := historyRecords(now, time.Minute, 250)
+
+	// Pending records should be read back before they are flushed.
+	for _, record := range records[:150] {
+		if err := store.Append(ctx, historyResource, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertHistory(t, store, now.Add(-time.Hour*24), now, 150)
+
+	// Flushing should fill up the latest chunk first, and only create new ones for the rest.
+	store.Flush(ctx)
+	for _, record := range records[150:] {
+		if err := store.Append(ctx, historyResource, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Flush(ctx)
+	configMaps, err := clientset.CoreV1().ConfigMaps("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configMaps.Items) != 3 {
+		t.Errorf("Expected 3 chunks, got %d", len(configMaps.Items))
+	}
+	for _, configMap := range configMaps.Items {
+		if owners := configMap.GetOwnerReferences(); len(owners) != 1 || owners[0].UID != historyResource.GetUID() {
+			t.Errorf("Expected %s to be owned by the resource, got %v", configMap.GetName(), owners)
+		}
+	}
+	assertHistory(t, store, now.Add(-time.Hour*24), now, 250)
+	assertHistory(t, store, now.Add(-10*time.Minute), now, 10)
+
+	// Chunks should be listed once, and then be kept track of as they are written.
+	lists := 0
+	for _, action := range clientset.Actions() {
+		if list, ok := action.(clienttesting.ListAction); ok && !list.GetListRestrictions().Labels.Empty() {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("Expected the chunks to be listed once, got %d lists", lists)
+	}
+
+	// Chunks past the retention should be expired on the next flush.
+	store.retentions.raw = 30 * time.Minute
+	if err = store.Append(ctx, historyResource, v1alpha1.HealthcheckRecord{Healthy: ptr.To(true), Timestamp: ptr.To(metav1.NewTime(now.Add(time.Minute)))}); err != nil {
+		t.Fatal(err)
+	}
+	store.Flush(ctx)
+	assertHistory(t, store, now.Add(-time.Hour*24), now.Add(2*time.Minute), 51)
+
+	// Deleting the history should drop all chunks.
+	if err = store.Delete(ctx, historyResource); err != nil {
+		t.Fatal(err)
+	}
+	assertHistory(t, store, now.Add(-time.Hour*24), time.Time{}, 0)
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// leaderAddressSeparator separates the address of a replica's query server from the rest of its identity, so standby
+// replicas can forward requests to the leader.
+const leaderAddressSeparator = "@"
+
+// LeaderElectionOptions configures the leader election among controller replicas.
+type LeaderElectionOptions struct {
+
+	// Enabled runs the controller only while holding the lease. Disable this for single replica deployments.
+	Enabled bool
+
+	// Namespace is the namespace of the lease.
+	Namespace string
+
+	// Name is the name of the lease.
+	Name string
+
+	// LeaseDuration is the duration that standby replicas wait before forcing to acquire leadership.
+	LeaseDuration time.Duration
+
+	// RenewDeadline is the duration that the leader retries refreshing leadership before giving it up.
+	RenewDeadline time.Duration
+
+	// RetryPeriod is the duration replicas wait between attempts to acquire or renew leadership.
+	RetryPeriod time.Duration
+
+	// Address is the address at which the other replicas can reach this replica's query server, which is advertised
+	// through the lease, so standby replicas forward requests to the leader. Standby replicas serve requests themselves
+	// if the leader does not advertise one.
+	Address string
+}
+
+// leaderAddressOf returns the address advertised by the replica of the identity, if any.
+func leaderAddressOf(identity string) string {
+	_, address, _ := strings.Cut(identity, leaderAddressSeparator)
+
+	return address
+}
+
+// observeLeader records the leader observed by the replica of the identity, so requests are forwarded to it unless
+// this replica is the leader.
+func (c *Controller) observeLeader(identity, leader string) {
+	address := ""
+	if leader != identity {
+		address = leaderAddressOf(leader)
+	}
+	c.leaderAddress.Store(&address)
+}
+
+// RunWithLeaderElection runs the controller while this replica holds the lease. Standby replicas keep their
+// informer caches warm, so they can take over right away, and forward requests about single resources to the leader,
+// as only the leader has their pending records, and open rollup buckets in memory. The lease is released once the context is cancelled, and
+// losing it otherwise is fatal, as the controller cannot be stopped safely halfway through its work.
+func (c *Controller) RunWithLeaderElection(ctx context.Context, workers int, options LeaderElectionOptions) error {
+	if !options.Enabled {
+		return c.Run(ctx, workers)
+	}
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "lease", klog.KRef(options.Namespace, options.Name), "component", "leaderelection")
+	if options.Namespace == "" {
+		return fmt.Errorf("leader election requires a lease namespace")
+	}
+
+	// Warm up the informer caches before contending for the lease.
+	if err := c.WarmUp(ctx); err != nil {
+		return err
+	}
+
+	// Identify this replica uniquely, even across restarts, along with the address of its query server, if any.
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting hostname: %w", err)
+	}
+	identity := hostname + "_" + string(uuid.NewUUID())
+	if options.Address != "" {
+		identity += leaderAddressSeparator + options.Address
+	}
+
+	// Contend for the lease until the context is cancelled, or the controller fails.
+	electionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	runErrs := make(chan error, 1)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: options.Namespace, Name: options.Name},
+			Client:     c.kubeclientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   options.LeaseDuration,
+		RenewDeadline:   options.RenewDeadline,
+		RetryPeriod:     options.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            options.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Acquired lease", "identity", identity)
+				if err := c.Run(ctx, workers); err != nil {
+					runErrs <- err
+					cancel()
+				}
+			},
+			OnStoppedLeading: func() {
+				logger.Info("Stopped contending for the lease", "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				c.observeLeader(identity, leader)
+				if leader != identity {
+					logger.Info("Standing by", "leader", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating leader elector: %w", err)
+	}
+	elector.Run(electionCtx)
+
+	// Tell a clean shutdown apart from failures.
+	select {
+	case err = <-runErrs:
+		return err
+	default:
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost lease %s/%s", options.Namespace, options.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestLeaderOwnerAddress(t *testing.T) {
+	c := &Controller{}
+
+	// Resources should be handled locally until a leader is observed.
+	if address := c.OwnerAddress("default", "foo"); address != "" {
+		t.Errorf("Expected no owner before a leader is observed, got %q", address)
+	}
+
+	// Standby replicas should forward requests to the leader, at the address it advertises.
+	identity := "standby_1" + leaderAddressSeparator + "10.0.0.1:8080"
+	c.observeLeader(identity, "leader_2"+leaderAddressSeparator+"10.0.0.2:8080")
+	if address := c.OwnerAddress("default", "foo"); address != "10.0.0.2:8080" {
+		t.Errorf("Expected the leader to own the resource, got %q", address)
+	}
+
+	// Leaders that do not advertise an address should leave requests to be handled locally.
+	c.observeLeader(identity, "leader_3")
+	if address := c.OwnerAddress("default", "foo"); address != "" {
+		t.Errorf("Expected no owner for a leader without an address, got %q", address)
+	}
+
+	// The leader should handle requests itself.
+	c.observeLeader(identity, identity)
+	if address := c.OwnerAddress("default", "foo"); address != "" {
+		t.Errorf("Expected the leader to own the resource itself, got %q", address)
+	}
+}
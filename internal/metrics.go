@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rexagod/mad/internal/server"
+	"github.com/rexagod/mad/internal/version"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// metricsNamespace prefixes the names of the controller's own metrics.
+const metricsNamespace = "mad"
+
+// Metrics observed as they happen. These are shared by all controllers in the process, like the workqueues' ones.
+var (
+
+	// probeDuration observes the duration of the last attempt of each probe, by endpoint, without its userinfo, and
+	// query, which may carry credentials.
+	probeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "probe_duration_seconds",
+		Help:      "Duration of the last attempt of each probe, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"endpoint"})
+
+	// statusWriteErrors counts the failed status writes.
+	statusWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "status_write_errors_total",
+		Help:      "Number of status writes that failed, and were retried.",
+	})
+)
+
+// Metrics of the resources, and the scheduler, collected on every scrape.
+var (
+	endpointUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "endpoint_up"),
+		"Whether the last probe of the endpoint of the resource was healthy.",
+		[]string{"namespace", "name", "endpoint"}, nil,
+	)
+	healthScoreDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "health_score"),
+		"Ratio of healthy records to all records in the buffer of the resource.",
+		[]string{"namespace", "name"}, nil,
+	)
+	anomalyDetectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "anomaly_detected"),
+		"Whether an anomaly is detected in the buffer of the resource, i.e., its health score is below the threshold.",
+		[]string{"namespace", "name"}, nil,
+	)
+	probeWorkersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "probe_workers"),
+		"Number of goroutines probing endpoints, by whether they are running a probe.",
+		[]string{"state"}, nil,
+	)
+	probesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "probes"),
+		"Number of scheduled probes, each shared by the resources subscribing to the same endpoint.",
+		nil, nil,
+	)
+	probeSubscriptionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "probe_subscriptions"),
+		"Number of subscriptions of resources to the probes of their endpoints.",
+		nil, nil,
+	)
+)
+
+// Metrics of the workqueues, named after those of the Kubernetes components, so existing dashboards apply.
+var (
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Current depth of the workqueue.",
+	}, []string{"name"})
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Number of adds handled by the workqueue.",
+	}, []string{"name"})
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "Duration items stay in the workqueue before being requested.",
+		Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "Duration items from the workqueue take to be processed.",
+		Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Duration the work in progress has been running for, which grows with stuck workers.",
+	}, []string{"name"})
+	workqueueLongestRunningProcessor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "Duration the longest running processor of the workqueue has been running for.",
+	}, []string{"name"})
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Number of retries handled by the workqueue.",
+	}, []string{"name"})
+)
+
+// Named workqueues report their metrics through the provider, which must be set before any of them is created.
+func init() {
+	workqueue.SetProvider(workqueueMetricsProvider{})
+}
+
+// workqueueMetricsProvider provides the metrics of the workqueues, by their names.
+type workqueueMetricsProvider struct{}
+
+var _ workqueue.MetricsProvider = workqueueMetricsProvider{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
+
+// resourceCollector collects the health of the resources from their in-memory buffers, and the state of the probe
+// scheduler, on every scrape. Only resources with a buffer, i.e., the ones handled by this replica, are reported, so
+// replicas never report the same series.
+type resourceCollector struct {
+
+	// lister lists the resources watched by the controller.
+	lister listers.MetricsAnomalyDetectorResourceLister
+
+	// buffers holds the buffers of the resources.
+	buffers *bufferManager
+
+	// scheduler is the probe scheduler.
+	scheduler *probeScheduler
+}
+
+var _ prometheus.Collector = &resourceCollector{}
+
+// Describe implements prometheus.Collector.
+func (c *resourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- endpointUpDesc
+	ch <- healthScoreDesc
+	ch <- anomalyDetectedDesc
+	ch <- probeWorkersDesc
+	ch <- probesDesc
+	ch <- probeSubscriptionsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *resourceCollector) Collect(ch chan<- prometheus.Metric) {
+
+	// Collect the state of the scheduler.
+	busy, workers, probes, subscriptions := c.scheduler.Stats()
+	ch <- prometheus.MustNewConstMetric(probeWorkersDesc, prometheus.GaugeValue, float64(busy), "busy")
+	ch <- prometheus.MustNewConstMetric(probeWorkersDesc, prometheus.GaugeValue, float64(workers-busy), "idle")
+	ch <- prometheus.MustNewConstMetric(probesDesc, prometheus.GaugeValue, float64(probes))
+	ch <- prometheus.MustNewConstMetric(probeSubscriptionsDesc, prometheus.GaugeValue, float64(subscriptions))
+
+	// Collect the health of the resources.
+	resources, err := c.lister.List(labels.Everything())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(healthScoreDesc, err)
+		return
+	}
+	for _, resource := range resources {
+		records, ok := c.buffers.Records(resource.GetUID())
+		if !ok || len(records) == 0 {
+			continue
+		}
+		namespace, name := resource.GetNamespace(), resource.GetName()
+		_, healthScore := server.EvaluateHealth(records)
+		ch <- prometheus.MustNewConstMetric(healthScoreDesc, prometheus.GaugeValue, healthScore, namespace, name)
+		ch <- prometheus.MustNewConstMetric(anomalyDetectedDesc, prometheus.GaugeValue, boolToFloat(healthScore < anomalyHealthScoreThreshold), namespace, name)
+
+		// Report the endpoints in the spec only, by their latest record, which records of earlier versions lack.
+		latest := make(map[string]v1alpha1.HealthcheckRecord, len(resource.Spec.HealthcheckEndpoints))
+		for _, record := range records {
+			if record.Endpoint != "" && record.Healthy != nil {
+				latest[record.Endpoint] = record
+			}
+		}
+		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
+			if record, ok := latest[endpoint]; ok {
+				ch <- prometheus.MustNewConstMetric(endpointUpDesc, prometheus.GaugeValue, boolToFloat(*record.Healthy), namespace, name, endpoint)
+			}
+		}
+	}
+}
+
+// newMetricsRegistry creates the registry of the controller's metrics, along with those of the Go runtime, the
+// process, and the build.
+func newMetricsRegistry(lister listers.MetricsAnomalyDetectorResourceLister, buffers *bufferManager, scheduler *probeScheduler) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		version.NewCollector(),
+		probeDuration,
+		statusWriteErrors,
+		workqueueDepth,
+		workqueueAdds,
+		workqueueLatency,
+		workqueueWorkDuration,
+		workqueueUnfinishedWork,
+		workqueueLongestRunningProcessor,
+		workqueueRetries,
+		&resourceCollector{lister: lister, buffers: buffers, scheduler: scheduler},
+	)
+
+	return registry
+}
+
+// instrumentQuery observes the duration of the queries, by endpoint.
+func instrumentQuery(query queryFunc) queryFunc {
+	return func(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) QueryResult {
+		result := query(ctx, namespace, endpoint, config)
+		if result.Attempts > 0 {
+			probeDuration.WithLabelValues(probeEndpointLabel(endpoint)).Observe(result.Latency.Seconds())
+		}
+
+		return result
+	}
+}
+
+// forgetProbeDuration drops the durations observed for the endpoint, once it is no longer probed.
+func forgetProbeDuration(endpoint string) {
+	probeDuration.DeleteLabelValues(probeEndpointLabel(endpoint))
+}
+
+// probeEndpointLabel returns the endpoint without its userinfo, query, and fragment, which may carry credentials, to
+// label its metrics with. Endpoints that cannot be parsed are not labelled with at all.
+func probeEndpointLabel(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery, u.ForceQuery = "", false
+	u.Fragment, u.RawFragment = "", ""
+
+	return u.String()
+}
+
+// metricsHandler serves the metrics of the registry, in the Prometheus exposition format.
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// boolToFloat returns 1 for true, and 0 for false.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	clientset "github.com/rexagod/mad/pkg/generated/clientset/versioned"
+	informers "github.com/rexagod/mad/pkg/generated/informers/externalversions"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchNamespacesSelectorPrefix prefixes namespace label selectors in the --watch-namespaces flag.
+const watchNamespacesSelectorPrefix = "selector:"
+
+// WatchNamespaces selects the namespaces the controller watches. All namespaces are watched if neither the namespaces
+// nor the selector are set.
+type WatchNamespaces struct {
+
+	// Namespaces are the names of the watched namespaces.
+	Namespaces []string
+
+	// Selector selects the watched namespaces by their labels. Namespaces start, and stop being watched as their labels
+	// change.
+	Selector labels.Selector
+}
+
+// ParseWatchNamespaces parses the value of the --watch-namespaces flag, which is either empty to watch all namespaces,
+// a comma-separated list of namespaces, or a namespace label selector prefixed with "selector:".
+func ParseWatchNamespaces(value string) (WatchNamespaces, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return WatchNamespaces{}, nil
+	}
+
+	// Parse namespace label selectors.
+	if strings.HasPrefix(value, watchNamespacesSelectorPrefix) {
+		selector, err := labels.Parse(strings.TrimPrefix(value, watchNamespacesSelectorPrefix))
+		if err != nil {
+			return WatchNamespaces{}, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+		if selector.Empty() {
+			return WatchNamespaces{}, fmt.Errorf("invalid namespace selector: must not be empty")
+		}
+		return WatchNamespaces{Selector: selector}, nil
+	}
+
+	// Parse namespace lists.
+	var namespaces []string
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return WatchNamespaces{}, fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+		if !slices.Contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	return WatchNamespaces{Namespaces: namespaces}, nil
+}
+
+// String describes the watched namespaces.
+func (w WatchNamespaces) String() string {
+	switch {
+	case w.Selector != nil:
+		return watchNamespacesSelectorPrefix + w.Selector.String()
+	case len(w.Namespaces) > 0:
+		return strings.Join(w.Namespaces, ",")
+	default:
+		return "all namespaces"
+	}
+}
+
+// namespaceInformers are the informer factories of a single watched namespace, or of all namespaces.
+type namespaceInformers struct {
+
+	// mad is the informer factory for mad resources.
+	mad informers.SharedInformerFactory
+
+	// cancel stops the informers, and is nil until they are started.
+	cancel context.CancelFunc
+}
+
+// informerSet runs the informers of all watched namespaces, and adds or removes them as namespaces start, or stop
+// matching the namespace selector. Only the watched namespaces are listed and watched, so the controller does not need
+// cluster-wide permissions unless it watches all namespaces.
+type informerSet struct {
+
+	// watchNamespaces selects the watched namespaces.
+	watchNamespaces WatchNamespaces
+
+	// madClientset is a clientset for our own API group.
+	madClientset clientset.Interface
+
+	// kubeClientset is a standard kubernetes clientset.
+	kubeClientset kubernetes.Interface
+
+	// resync is the resync period of all informers.
+	resync time.Duration
+
+	// madHandler handles the events of mad resources in all watched namespaces.
+	madHandler cache.ResourceEventHandler
+
+	// onRemove is called with the resources of namespaces that stopped being watched.
+	onRemove func(resources []*v1alpha1.MetricsAnomalyDetectorResource)
+
+	// namespaceInformerFactory is the informer factory for the namespaces matching the selector, and is nil unless
+	// namespaces are selected by their labels.
+	namespaceInformerFactory kubeinformers.SharedInformerFactory
+
+	// namespaceRegistration is the registration of the namespace event handlers, and is nil unless namespaces are
+	// selected by their labels.
+	namespaceRegistration cache.ResourceEventHandlerRegistration
+
+	// mu guards all fields below.
+	mu sync.RWMutex
+
+	// ctx is the context the informers run with, and is nil until they are started.
+	ctx context.Context
+
+	// namespaces maps the watched namespaces to their informers. All namespaces are watched through the empty key.
+	namespaces map[string]*namespaceInformers
+}
+
+// newInformerSet creates a new informerSet for the watched namespaces.
+func newInformerSet(
+	madClientset clientset.Interface,
+	kubeClientset kubernetes.Interface,
+	watchNamespaces WatchNamespaces,
+	resync time.Duration,
+	madHandler cache.ResourceEventHandler,
+	onRemove func(resources []*v1alpha1.MetricsAnomalyDetectorResource),
+) (*informerSet, error) {
+	s := &informerSet{
+		watchNamespaces: watchNamespaces,
+		madClientset:    madClientset,
+		kubeClientset:   kubeClientset,
+		resync:          resync,
+		madHandler:      madHandler,
+		onRemove:        onRemove,
+		namespaces:      map[string]*namespaceInformers{},
+	}
+
+	// Watch all namespaces, or the listed ones, right away.
+	if watchNamespaces.Selector == nil {
+		namespaces := watchNamespaces.Namespaces
+		if len(namespaces) == 0 {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+		for _, namespace := range namespaces {
+			if err := s.add(namespace); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	// Watch the selected namespaces as they come, and go. Namespaces that stop matching the selector are reported as
+	// deleted by the watch.
+	s.namespaceInformerFactory = kubeinformers.NewSharedInformerFactoryWithOptions(kubeClientset, resync,
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = watchNamespaces.Selector.String()
+		}),
+	)
+	registration, err := s.namespaceInformerFactory.Core().V1().Namespaces().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			namespace, ok := obj.(*corev1.Namespace)
+			if !ok {
+				return
+			}
+			if err := s.add(namespace.GetName()); err != nil {
+				utilruntime.HandleError(err)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			namespace, ok := obj.(*corev1.Namespace)
+			if !ok {
+				return
+			}
+			s.remove(namespace.GetName())
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error adding namespace event handler: %w", err)
+	}
+	s.namespaceRegistration = registration
+
+	return s, nil
+}
+
+// add starts watching the namespace, if it is not watched already.
+func (s *informerSet) add(namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namespaces[namespace]; ok {
+		return nil
+	}
+
+	// Create the namespace's informers, and set up their event handlers.
+	i := &namespaceInformers{
+		mad: informers.NewSharedInformerFactoryWithOptions(s.madClientset, s.resync, informers.WithNamespace(namespace)),
+	}
+	if _, err := i.mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().AddEventHandler(s.madHandler); err != nil {
+		return fmt.Errorf("error adding event handler for namespace %q: %w", namespace, err)
+	}
+	s.namespaces[namespace] = i
+
+	// Start the informers right away, if the others are running already.
+	if s.ctx != nil {
+		i.start(s.ctx)
+	}
+
+	return nil
+}
+
+// remove stops watching the namespace, and hands its resources over to onRemove.
+func (s *informerSet) remove(namespace string) {
+	s.mu.Lock()
+	i, ok := s.namespaces[namespace]
+	delete(s.namespaces, namespace)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// Collect the resources before the informers are gone, so they can be released.
+	resources, _ := i.mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Lister().List(labels.Everything())
+	if i.cancel != nil {
+		i.cancel()
+	}
+	i.mad.Shutdown()
+	s.onRemove(resources)
+}
+
+// start starts the informers of the namespace.
+func (i *namespaceInformers) start(ctx context.Context) {
+	ctx, i.cancel = context.WithCancel(ctx)
+	i.mad.Start(ctx.Done())
+}
+
+// Start starts the informers of all watched namespaces, and of the ones that are watched later on. The informers keep
+// running until the context is cancelled, and calling this again is a no-op.
+func (s *informerSet) Start(ctx context.Context) {
+	s.mu.Lock()
+	if s.ctx != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.ctx = ctx
+	for _, i := range s.namespaces {
+		i.start(ctx)
+	}
+	s.mu.Unlock()
+
+	// Start watching the selected namespaces, outside the lock, as their event handlers take it.
+	if s.namespaceInformerFactory != nil {
+		s.namespaceInformerFactory.Start(ctx.Done())
+	}
+}
+
+// WaitForCacheSync waits for the caches of all watched namespaces to sync, and reports whether they did before the
+// context was cancelled.
+func (s *informerSet) WaitForCacheSync(ctx context.Context) bool {
+
+	// Wait for the selected namespaces to be known first.
+	if s.namespaceRegistration != nil && !cache.WaitForCacheSync(ctx.Done(), s.namespaceRegistration.HasSynced) {
+		return false
+	}
+
+	s.mu.RLock()
+	hasSynced := make([]cache.InformerSynced, 0, len(s.namespaces))
+	for _, i := range s.namespaces {
+		hasSynced = append(hasSynced, i.mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().HasSynced)
+	}
+	s.mu.RUnlock()
+
+	return cache.WaitForCacheSync(ctx.Done(), hasSynced...)
+}
+
+// informers returns the informers watching the namespace, or nil if it is not watched.
+func (s *informerSet) informers(namespace string) *namespaceInformers {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if i, ok := s.namespaces[metav1.NamespaceAll]; ok {
+		return i
+	}
+
+	return s.namespaces[namespace]
+}
+
+// all returns the informers of all watched namespaces.
+func (s *informerSet) all() []*namespaceInformers {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make([]*namespaceInformers, 0, len(s.namespaces))
+	for _, i := range s.namespaces {
+		all = append(all, i)
+	}
+
+	return all
+}
+
+// Lister returns a lister for the mad resources across all watched namespaces.
+func (s *informerSet) Lister() listers.MetricsAnomalyDetectorResourceLister {
+	return &informerSetLister{s: s}
+}
+
+// informerSetLister lists the mad resources across all watched namespaces.
+type informerSetLister struct {
+
+	// s is the informerSet to list from.
+	s *informerSet
+}
+
+// List lists all resources in the watched namespaces.
+func (l *informerSetLister) List(selector labels.Selector) ([]*v1alpha1.MetricsAnomalyDetectorResource, error) {
+	var all []*v1alpha1.MetricsAnomalyDetectorResource
+	for _, i := range l.s.all() {
+		resources, err := i.mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Lister().List(selector)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, resources...)
+	}
+
+	return all, nil
+}
+
+// MetricsAnomalyDetectorResources returns a lister for the resources in the namespace. Resources in namespaces that
+// are not watched are not found.
+func (l *informerSetLister) MetricsAnomalyDetectorResources(namespace string) listers.MetricsAnomalyDetectorResourceNamespaceLister {
+	i := l.s.informers(namespace)
+	if i == nil {
+		return unwatchedNamespaceLister{}
+	}
+
+	return i.mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Lister().MetricsAnomalyDetectorResources(namespace)
+}
+
+// unwatchedNamespaceLister lists the resources in namespaces that are not watched, of which there are none.
+type unwatchedNamespaceLister struct{}
+
+// List lists no resources.
+func (unwatchedNamespaceLister) List(labels.Selector) ([]*v1alpha1.MetricsAnomalyDetectorResource, error) {
+	return nil, nil
+}
+
+// Get does not find any resource.
+func (unwatchedNamespaceLister) Get(name string) (*v1alpha1.MetricsAnomalyDetectorResource, error) {
+	return nil, errors.NewNotFound(v1alpha1.Resource("metricsanomalydetectorresources"), name)
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"github.com/rexagod/mad/pkg/generated/clientset/versioned/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseWatchNamespaces(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "all namespaces"},
+		{value: "foo, bar,foo", want: "foo,bar"},
+		{value: "selector:team=foo", want: "selector:team=foo"},
+		{value: "foo,,bar", wantErr: true},
+		{value: "Foo", wantErr: true},
+		{value: "selector:", wantErr: true},
+		{value: "selector:team in (", wantErr: true},
+	} {
+		got, err := ParseWatchNamespaces(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Expected error for %q to be %t, got %v", tc.value, tc.wantErr, err)
+			continue
+		}
+		if err == nil && got.String() != tc.want {
+			t.Errorf("Expected %q to watch %q, got %q", tc.value, tc.want, got.String())
+		}
+	}
+}
+
+func TestInformerSet(t *testing.T) {
+	var removed []*v1alpha1.MetricsAnomalyDetectorResource
+	s, err := newInformerSet(fake.NewSimpleClientset(), nil, WatchNamespaces{Namespaces: []string{"foo", "bar"}}, 0,
+		cache.ResourceEventHandlerFuncs{},
+		func(resources []*v1alpha1.MetricsAnomalyDetectorResource) {
+			removed = append(removed, resources...)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, namespace := range []string{"foo", "bar"} {
+		resource := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "mad", Namespace: namespace}}
+		indexer := s.informers(namespace).mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().GetIndexer()
+		if err = indexer.Add(resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lister := s.Lister()
+
+	// Resources should be listed across all watched namespaces.
+	if resources, err := lister.List(labels.Everything()); err != nil || len(resources) != 2 {
+		t.Errorf("Expected 2 resources, got %d (%v)", len(resources), err)
+	}
+	if _, err = lister.MetricsAnomalyDetectorResources("foo").Get("mad"); err != nil {
+		t.Errorf("Expected foo/mad to be found, got %v", err)
+	}
+
+	// Resources in namespaces that are not watched should not be found.
+	if _, err = lister.MetricsAnomalyDetectorResources("baz").Get("mad"); !errors.IsNotFound(err) {
+		t.Errorf("Expected baz/mad not to be found, got %v", err)
+	}
+
+	// Namespaces that stop being watched should hand over their resources, and stop listing them.
+	s.remove("foo")
+	if len(removed) != 1 || removed[0].GetNamespace() != "foo" {
+		t.Errorf("Expected foo/mad to be removed, got %v", removed)
+	}
+	if _, err = lister.MetricsAnomalyDetectorResources("foo").Get("mad"); !errors.IsNotFound(err) {
+		t.Errorf("Expected foo/mad not to be found, got %v", err)
+	}
+	if resources, err := lister.List(labels.Everything()); err != nil || len(resources) != 1 {
+		t.Errorf("Expected 1 resource, got %d (%v)", len(resources), err)
+	}
+}
+
+func TestReleaseFinalizers(t *testing.T) {
+	ctx := context.Background()
+	finalized := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "finalized", Namespace: "foo", Finalizers: []string{"other", finalizerName}}}
+	unfinalized := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "unfinalized", Namespace: "foo"}}
+	gone := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "gone", Namespace: "foo", Finalizers: []string{finalizerName}}}
+	clientset := fake.NewSimpleClientset(finalized, unfinalized)
+	c := &Controller{madClientset: clientset}
+	s, err := newInformerSet(clientset, nil, WatchNamespaces{Namespaces: []string{"foo"}}, 0,
+		cache.ResourceEventHandlerFuncs{},
+		func(resources []*v1alpha1.MetricsAnomalyDetectorResource) {
+			c.releaseFinalizers(ctx, resources)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer := s.informers("foo").mad.Mad().V1alpha1().MetricsAnomalyDetectorResources().Informer().GetIndexer()
+	for _, resource := range []*v1alpha1.MetricsAnomalyDetectorResource{finalized, unfinalized, gone} {
+		if err = indexer.Add(resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Namespaces that stop being watched should have the finalizer removed from their resources, and only from them,
+	// so they can still be deleted. Resources that are already gone should be skipped.
+	s.remove("foo")
+	resource, err := clientset.MadV1alpha1().MetricsAnomalyDetectorResources("foo").Get(ctx, "finalized", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(resource.GetFinalizers(), []string{"other"}) {
+		t.Errorf("Expected only the finalizer to be removed, got %v", resource.GetFinalizers())
+	}
+	updates := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "update" {
+			updates++
+		}
+	}
+	if updates != 1 {
+		t.Errorf("Expected a single update, got %d", updates)
+	}
+}
@@ -1,12 +1,27 @@
 package internal
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
-	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -16,73 +31,462 @@ const (
 
 	// caCertSAPath is the path to the service account CA certificate.
 	certSAPath = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// defaultConnectTimeout is the time allowed for establishing a connection to an endpoint, per attempt.
+	defaultConnectTimeout = 5 * time.Second
+
+	// defaultRetryBackoff is the time waited before the first retry.
+	defaultRetryBackoff = time.Second
+
+	// maxDrainedBodyBytes is the size up to which response bodies are drained, so their connections are reused.
+	// Connections with larger bodies are closed instead.
+	maxDrainedBodyBytes = 64 << 10
 )
 
 // Querier knows how to query the endpoints of all associated components.
 type Querier struct {
 
-	// client is the http client used to query the endpoints.
+	// defaultConfig is the transport configuration used for endpoints that do not override the controller's credentials.
+	defaultConfig *transport.Config
+
+	// apiServerHost is the host, and port of the apiserver, which are the only ones the default credentials are sent to,
+	// so they cannot be collected by pointing endpoints elsewhere.
+	apiServerHost string
+
+	// secrets resolves the Secrets referenced by the endpoint configurations.
+	secrets *secretCache
+
+	// clientsMu guards clients.
+	clientsMu sync.Mutex
+
+	// clients caches the http clients built for each endpoint, keyed by the namespace of the referencing resource
+	// and the endpoint. Clients are rebuilt whenever the resolved credentials change.
+	clients map[string]*cachedClient
+}
+
+// cachedClient is an http client along with the credentials it was built from.
+type cachedClient struct {
+
+	// client is the http client used to query the endpoint.
 	client *http.Client
 
-	// token is the service account token.
-	token string
+	// fingerprint identifies the resolved credentials the client was built from.
+	fingerprint string
 }
 
-// NewQuerier creates a new Querier.
-func NewQuerier() *Querier {
-	utilruntime.HandleCrash()
+// QuerierCredentials is the source of the default credentials, i.e., the credentials used for endpoints that do not
+// override them.
+type QuerierCredentials string
 
-	// Read the SA token.
-	token, err := os.ReadFile(tokenSAPath)
-	if err != nil {
-		panic(err)
-	}
+const (
+
+	// QuerierCredentialsRESTConfig derives the default credentials from the controller's rest.Config. This amounts to
+	// the service account credentials when running in-cluster, and to the kubeconfig credentials otherwise. Default
+	// credentials are only ever sent to the apiserver.
+	QuerierCredentialsRESTConfig QuerierCredentials = "rest-config"
+
+	// QuerierCredentialsServiceAccount reads the default credentials from the mounted service account files, which
+	// must exist.
+	QuerierCredentialsServiceAccount QuerierCredentials = "service-account"
 
-	// Read the CA certificate.
-	caCert, err := os.ReadFile(certSAPath)
+	// QuerierCredentialsNone sends no default credentials.
+	QuerierCredentialsNone QuerierCredentials = "none"
+)
+
+// hostOf returns the lowercased host, and port of the URL, defaulting the port by its scheme, and the scheme to https.
+func hostOf(rawURL string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(caCert)
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port), nil
+}
+
+// toAPIServer returns whether the endpoint is served by the apiserver, and may thus be sent the default credentials.
+func (q *Querier) toAPIServer(endpoint string) bool {
+	host, err := hostOf(endpoint)
+
+	return err == nil && q.apiServerHost != "" && host == q.apiServerHost
+}
+
+// NewQuerier creates a new Querier. The Secrets referenced by the endpoint configurations are fetched through the
+// given clientset.
+func NewQuerier(restConfig *rest.Config, credentials QuerierCredentials, kubeClientset kubernetes.Interface) (*Querier, error) {
+
+	// Build the default transport configuration.
+	var defaultConfig *transport.Config
+	switch credentials {
+	case QuerierCredentialsRESTConfig:
+		var err error
+		defaultConfig, err = restConfig.TransportConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build transport config from rest config: %w", err)
+		}
+	case QuerierCredentialsServiceAccount:
+		for _, path := range []string{tokenSAPath, certSAPath} {
+			if _, err := os.Stat(path); err != nil {
+				return nil, fmt.Errorf("service account credentials unavailable: %w", err)
+			}
+		}
 
-	// Create the client.
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: certPool,
+		// Read the token from the file on every refresh, so that projected tokens are rotated.
+		defaultConfig = &transport.Config{
+			BearerTokenFile: tokenSAPath,
+			TLS: transport.TLSConfig{
+				CAFile: certSAPath,
 			},
-		},
+		}
+	case QuerierCredentialsNone:
+		defaultConfig = &transport.Config{}
+	default:
+		return nil, fmt.Errorf("unknown querier credentials: %s", credentials)
+	}
+
+	// Locate the apiserver, so the default credentials are only sent to it.
+	apiServerHost, err := hostOf(restConfig.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse apiserver host: %w", err)
 	}
 
 	// Create the Querier.
 	querier := &Querier{
-		client: client,
-		token:  string(token),
+		defaultConfig: defaultConfig,
+		apiServerHost: apiServerHost,
+		secrets:       newSecretCache(kubeClientset, secretCacheTTL),
+		clients:       make(map[string]*cachedClient),
 	}
 
-	return querier
+	return querier, nil
 }
 
-// DoMADQuery queries the healthcheck endpoint.
-func (q *Querier) DoMADQuery(endpoint string) bool {
+// QueryResult is the outcome of querying a healthcheck endpoint in a single tick.
+type QueryResult struct {
 
-	// Create the request.
-	req, err := http.NewRequest("GET", endpoint, nil)
+	// Healthy is true if the endpoint responded with a 200, possibly after retries.
+	Healthy bool
+
+	// Attempts is the number of queries made, including retries.
+	Attempts int
+
+	// Err is the error that caused the last attempt to fail, if any.
+	Err error
+
+	// Latency is the duration of the last attempt.
+	Latency time.Duration
+}
+
+// DoMADQuery queries the healthcheck endpoint, retrying transient failures as configured. The context is expected to
+// carry the tick's deadline.
+func (q *Querier) DoMADQuery(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) QueryResult {
+	logger := klog.FromContext(ctx)
+
+	// Get the client for the endpoint.
+	client, err := q.clientFor(ctx, namespace, endpoint, config)
 	if err != nil {
-		return false
+		logger.Error(err, "failed to build client", "endpoint", endpoint)
+		return QueryResult{Err: err}
+	}
+
+	// Bound all attempts by the configured timeout.
+	retries, backoff := 0, defaultRetryBackoff
+	if config != nil {
+		if config.Timeout != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.Timeout.Duration)
+			defer cancel()
+		}
+		retries = int(config.Retries)
+		if config.RetryBackoff != nil {
+			backoff = config.RetryBackoff.Duration
+		}
 	}
 
-	// Add the token to the request.
-	req.Header.Add("Authorization", "Bearer "+q.token)
+	// Query the endpoint, backing off between retries.
+	result := QueryResult{}
+	for {
+		var retryable bool
+		result.Attempts++
+		start := time.Now()
+		retryable, result.Err = q.doQuery(ctx, client, endpoint)
+		result.Latency = time.Since(start)
+		if result.Err == nil {
+			result.Healthy = true
+			return result
+		}
+		if !retryable || result.Attempts > retries {
+			return result
+		}
+		logger.V(4).Info("query failed, retrying", "endpoint", endpoint, "attempt", result.Attempts, "backoff", backoff, "err", result.Err)
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// doQuery performs a single query. It returns a nil error if the endpoint is healthy, and whether the failure, if any,
+// is worth retrying.
+func (q *Querier) doQuery(ctx context.Context, client *http.Client, endpoint string) (bool, error) {
+
+	// Create the request.
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
 
-	// Perform the request.
-	resp, err := q.client.Do(req)
+	// Perform the request. Connection errors and timeouts are considered transient.
+	resp, err := client.Do(req)
 	if err != nil {
-		return false
+		return true, err
 	}
-	defer resp.Body.Close()
+
+	// Drain the body before closing it, so the connection is reused, unless the body is larger than worth draining.
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainedBodyBytes))
+		_ = resp.Body.Close()
+	}()
 
 	// Check the response.
-	return resp.StatusCode == http.StatusOK
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+// clientFor returns the http client for the endpoint, building a new one if the resolved credentials have changed.
+func (q *Querier) clientFor(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) (*http.Client, error) {
+
+	// Resolve the credentials on every query, so rotated Secrets are picked up without a restart, once their cached
+	// versions expire.
+	transportConfig, err := q.transportConfigFor(ctx, namespace, endpoint, config)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeout := defaultConnectTimeout
+	if config != nil && config.ConnectTimeout != nil {
+		connectTimeout = config.ConnectTimeout.Duration
+	}
+	fingerprint := fingerprintTransportConfig(transportConfig) + "/" + connectTimeout.String()
+
+	q.clientsMu.Lock()
+	defer q.clientsMu.Unlock()
+
+	// Reuse the existing client if the credentials did not change.
+	key := namespace + "/" + endpoint
+	if cached, ok := q.clients[key]; ok {
+		if cached.fingerprint == fingerprint {
+			return cached.client, nil
+		}
+		cached.client.CloseIdleConnections()
+	}
+
+	// Build a new client.
+	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build TLS config: %w", err)
+	}
+	rt, err := transport.HTTPWrappersForConfig(transportConfig, utilnet.SetTransportDefaults(&http.Transport{
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build transport: %w", err)
+	}
+	client := &http.Client{Transport: rt}
+
+	// Keep the default credentials from following redirects off the apiserver, as they are set by the transport, on
+	// every request.
+	if q.toAPIServer(endpoint) {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if host, err := hostOf(req.URL.String()); err != nil || host != q.apiServerHost {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
+	q.clients[key] = &cachedClient{
+		client:      client,
+		fingerprint: fingerprint,
+	}
+
+	return client, nil
+}
+
+// transportConfigFor resolves the endpoint configuration into a transport configuration. The default credentials are
+// only resolved for endpoints on the apiserver.
+func (q *Querier) transportConfigFor(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) (*transport.Config, error) {
+	resolve := func(selector *corev1.SecretKeySelector) ([]byte, error) {
+		return q.resolveSecretKey(ctx, namespace, selector)
+	}
+
+	// Trust the default CA, unless overridden below.
+	transportConfig := &transport.Config{
+		TLS: transport.TLSConfig{
+			Insecure: q.defaultConfig.TLS.Insecure,
+			CAFile:   q.defaultConfig.TLS.CAFile,
+			CAData:   q.defaultConfig.TLS.CAData,
+		},
+	}
+
+	// Endpoints on the apiserver without any configuration use the controller's credentials, and others none.
+	if config == nil || config.Auth == nil || config.Auth.Type == "" {
+		if q.toAPIServer(endpoint) {
+			q.withDefaultCredentials(transportConfig)
+		}
+	} else {
+		switch config.Auth.Type {
+		case v1alpha1.HealthcheckEndpointAuthTypeServiceAccount:
+			if !q.toAPIServer(endpoint) {
+				return nil, fmt.Errorf("auth type %s is only allowed for endpoints on the apiserver (%s)", v1alpha1.HealthcheckEndpointAuthTypeServiceAccount, q.apiServerHost)
+			}
+			q.withDefaultCredentials(transportConfig)
+		case v1alpha1.HealthcheckEndpointAuthTypeNone:
+		case v1alpha1.HealthcheckEndpointAuthTypeBearerToken:
+			if config.Auth.BearerToken == nil {
+				return nil, fmt.Errorf("auth type %s requires a bearer token reference", config.Auth.Type)
+			}
+			token, err := resolve(config.Auth.BearerToken)
+			if err != nil {
+				return nil, err
+			}
+			transportConfig.BearerToken = string(token)
+		case v1alpha1.HealthcheckEndpointAuthTypeBasicAuth:
+			if config.Auth.BasicAuth == nil {
+				return nil, fmt.Errorf("auth type %s requires a basic auth reference", config.Auth.Type)
+			}
+			username, err := resolve(&config.Auth.BasicAuth.Username)
+			if err != nil {
+				return nil, err
+			}
+			password, err := resolve(&config.Auth.BasicAuth.Password)
+			if err != nil {
+				return nil, err
+			}
+			transportConfig.Username = string(username)
+			transportConfig.Password = string(password)
+		default:
+			return nil, fmt.Errorf("unknown auth type: %s", config.Auth.Type)
+		}
+	}
+
+	// Override the TLS settings, if any.
+	if config != nil && config.TLS != nil {
+		if config.TLS.CA != nil {
+			ca, err := resolve(config.TLS.CA)
+			if err != nil {
+				return nil, err
+			}
+			if len(ca) > 0 {
+				transportConfig.TLS.Insecure = false
+				transportConfig.TLS.CAFile = ""
+				transportConfig.TLS.CAData = ca
+			}
+		}
+		if (config.TLS.Cert == nil) != (config.TLS.Key == nil) {
+			return nil, fmt.Errorf("client certificate and key must be specified together")
+		}
+		if config.TLS.Cert != nil {
+			cert, err := resolve(config.TLS.Cert)
+			if err != nil {
+				return nil, err
+			}
+			key, err := resolve(config.TLS.Key)
+			if err != nil {
+				return nil, err
+			}
+			if len(cert) > 0 && len(key) > 0 {
+				transportConfig.TLS.CertData = cert
+				transportConfig.TLS.KeyData = key
+			}
+		}
+		if config.TLS.InsecureSkipVerify {
+
+			// Root certificates cannot be specified along with the insecure flag.
+			transportConfig.TLS.Insecure = true
+			transportConfig.TLS.CAFile = ""
+			transportConfig.TLS.CAData = nil
+		}
+	}
+
+	return transportConfig, nil
+}
+
+// withDefaultCredentials copies the default credentials into the given transport configuration.
+func (q *Querier) withDefaultCredentials(transportConfig *transport.Config) {
+	transportConfig.BearerToken = q.defaultConfig.BearerToken
+	transportConfig.BearerTokenFile = q.defaultConfig.BearerTokenFile
+	transportConfig.Username = q.defaultConfig.Username
+	transportConfig.Password = q.defaultConfig.Password
+	transportConfig.WrapTransport = q.defaultConfig.WrapTransport
+	transportConfig.TLS.CertFile = q.defaultConfig.TLS.CertFile
+	transportConfig.TLS.CertData = q.defaultConfig.TLS.CertData
+	transportConfig.TLS.KeyFile = q.defaultConfig.TLS.KeyFile
+	transportConfig.TLS.KeyData = q.defaultConfig.TLS.KeyData
+	transportConfig.TLS.GetCertHolder = q.defaultConfig.TLS.GetCertHolder
+}
+
+// resolveSecretKey returns the value of the referenced Secret key.
+func (q *Querier) resolveSecretKey(ctx context.Context, namespace string, selector *corev1.SecretKeySelector) ([]byte, error) {
+	optional := selector.Optional != nil && *selector.Optional
+	secret, err := q.secrets.Get(ctx, namespace, selector.Name)
+	if err != nil {
+		if optional && errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", namespace, selector.Name, err)
+	}
+	value, ok := secret.Data[selector.Key]
+	if !ok && !optional {
+		return nil, fmt.Errorf("key %q not found in secret %s/%s", selector.Key, namespace, selector.Name)
+	}
+
+	return value, nil
+}
+
+// fingerprintTransportConfig returns a digest of the credentials in the transport configuration.
+func fingerprintTransportConfig(config *transport.Config) string {
+	h := sha256.New()
+	for _, field := range [][]byte{
+		[]byte(config.BearerToken),
+		[]byte(config.BearerTokenFile),
+		[]byte(config.Username),
+		[]byte(config.Password),
+		[]byte(config.TLS.CAFile),
+		config.TLS.CAData,
+		[]byte(config.TLS.CertFile),
+		config.TLS.CertData,
+		[]byte(config.TLS.KeyFile),
+		config.TLS.KeyData,
+		[]byte(fmt.Sprint(config.TLS.Insecure)),
+	} {
+
+		// Length-prefix each field, so that adjacent fields cannot collide.
+		_, _ = fmt.Fprintf(h, "%d:", len(field))
+		_, _ = h.Write(field)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
 }
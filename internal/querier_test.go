@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+func TestQuerierSecretCredentials(t *testing.T) {
+
+	// Serve an endpoint that only accepts the expected token.
+	expectedToken := "foo"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+expectedToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	// Set up the Secrets referenced by the endpoint configuration, cached for a short while.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string][]byte{"token": []byte("foo"), "ca.crt": caCert},
+	}
+	kubeClientset := fake.NewSimpleClientset(secret)
+	ttl := 50 * time.Millisecond
+	q := &Querier{
+		defaultConfig: &transport.Config{BearerToken: "service-account-token"},
+		secrets:       newSecretCache(kubeClientset, ttl),
+		clients:       make(map[string]*cachedClient),
+	}
+	gets := func() int {
+		n := 0
+		for _, action := range kubeClientset.Actions() {
+			if action.Matches("get", "secrets") {
+				n++
+			}
+		}
+		return n
+	}
+	config := &v1alpha1.HealthcheckEndpointConfig{
+		Endpoint: server.URL,
+		Auth: &v1alpha1.HealthcheckEndpointAuth{
+			Type: v1alpha1.HealthcheckEndpointAuthTypeBearerToken,
+			BearerToken: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+				Key:                  "token",
+			},
+		},
+		TLS: &v1alpha1.HealthcheckEndpointTLSConfig{
+			CA: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+				Key:                  "ca.crt",
+			},
+		},
+	}
+
+	// The endpoint should be healthy with the referenced credentials.
+	if !q.DoMADQuery(context.Background(), "default", server.URL, config).Healthy {
+		t.Errorf("Expected the endpoint to be healthy")
+	}
+
+	// The Secret should be fetched once, and then be served from the cache.
+	if !q.DoMADQuery(context.Background(), "default", server.URL, config).Healthy {
+		t.Errorf("Expected the endpoint to be healthy")
+	}
+	if got := gets(); got != 1 {
+		t.Errorf("Expected the secret to be fetched once, got %d", got)
+	}
+	for _, action := range kubeClientset.Actions() {
+		if action.Matches("list", "secrets") || action.Matches("watch", "secrets") {
+			t.Errorf("Expected secrets to be fetched by name only, got %s", action.GetVerb())
+		}
+	}
+
+	// The endpoint should be unhealthy with the controller's credentials.
+	if q.DoMADQuery(context.Background(), "default", server.URL, &v1alpha1.HealthcheckEndpointConfig{
+		Endpoint: server.URL,
+		TLS:      config.TLS,
+	}).Healthy {
+		t.Errorf("Expected the endpoint to be unhealthy")
+	}
+
+	// Rotate the token on both sides, the endpoint should be healthy without any intervention once the cached Secret
+	// expires.
+	expectedToken = "bar"
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	secret.Data["token"] = []byte("bar")
+	if _, err := kubeClientset.CoreV1().Secrets("default").Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * ttl)
+	if !q.DoMADQuery(context.Background(), "default", server.URL, config).Healthy {
+		t.Errorf("Expected the endpoint to be healthy after rotation")
+	}
+
+	// The endpoint should be unhealthy if the referenced Secret does not exist.
+	if err := kubeClientset.CoreV1().Secrets("default").Delete(context.Background(), secret.GetName(), metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * ttl)
+	if q.DoMADQuery(context.Background(), "default", server.URL, config).Healthy {
+		t.Errorf("Expected the endpoint to be unhealthy")
+	}
+}
+
+func TestQuerierRetries(t *testing.T) {
+
+	// Serve an endpoint that fails the first two requests with a transient error, and rejects unauthorized ones.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests++
+		if requests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	apiServerHost, err := hostOf(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &Querier{
+		defaultConfig: &transport.Config{BearerToken: "service-account-token"},
+		apiServerHost: apiServerHost,
+		clients:       make(map[string]*cachedClient),
+	}
+	config := &v1alpha1.HealthcheckEndpointConfig{
+		Endpoint:     server.URL,
+		Auth:         &v1alpha1.HealthcheckEndpointAuth{Type: v1alpha1.HealthcheckEndpointAuthTypeNone},
+		Retries:      2,
+		RetryBackoff: &metav1.Duration{Duration: time.Millisecond},
+	}
+
+	// The endpoint should be healthy after two retries.
+	result := q.DoMADQuery(context.Background(), "default", server.URL, config)
+	if !result.Healthy || result.Attempts != 3 {
+		t.Errorf("Expected the endpoint to be healthy after 3 attempts, got healthy=%t after %d attempts", result.Healthy, result.Attempts)
+	}
+
+	// Hard failures should not be retried.
+	config.Auth = nil
+	result = q.DoMADQuery(context.Background(), "default", server.URL, config)
+	if result.Healthy || result.Attempts != 1 {
+		t.Errorf("Expected the endpoint to be unhealthy after 1 attempt, got healthy=%t after %d attempts", result.Healthy, result.Attempts)
+	}
+}
+
+func TestQuerierReusesConnections(t *testing.T) {
+
+	// Serve an endpoint with a body larger than the buffers of the client, counting the connections made to it.
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(make([]byte, 32<<10))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	server.Start()
+	defer server.Close()
+	q := &Querier{
+		defaultConfig: &transport.Config{},
+		clients:       make(map[string]*cachedClient),
+	}
+
+	// Consecutive queries should share a single connection.
+	for i := 0; i < 3; i++ {
+		if result := q.DoMADQuery(context.Background(), "default", server.URL, nil); !result.Healthy {
+			t.Fatalf("Expected the endpoint to be healthy, got %+v", result)
+		}
+	}
+	server.Close()
+	if connections != 1 {
+		t.Errorf("Expected a single connection, got %d", connections)
+	}
+}
+
+func TestQuerierDefaultCredentials(t *testing.T) {
+
+	// Serve the apiserver, which redirects to another endpoint, and the other endpoint, both recording the credentials
+	// they were sent.
+	var sent []string
+	record := func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Header.Get("Authorization"))
+	}
+	other := httptest.NewServer(http.HandlerFunc(record))
+	defer other.Close()
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(w, r)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL, http.StatusFound)
+		}
+	}))
+	defer apiServer.Close()
+	q, err := NewQuerier(&rest.Config{Host: apiServer.URL, BearerToken: "service-account-token"}, QuerierCredentialsRESTConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(endpoint string, config *v1alpha1.HealthcheckEndpointConfig) QueryResult {
+		sent = nil
+		return q.DoMADQuery(context.Background(), "default", endpoint, config)
+	}
+
+	// The apiserver should be sent the default credentials.
+	if result := query(apiServer.URL+"/livez", nil); !result.Healthy || len(sent) != 1 || sent[0] != "Bearer service-account-token" {
+		t.Errorf("Expected the apiserver to be sent the default credentials, got %v (err: %v)", sent, result.Err)
+	}
+
+	// Other endpoints should not be sent any, even when following redirects off the apiserver.
+	if result := query(other.URL, nil); !result.Healthy || len(sent) != 1 || sent[0] != "" {
+		t.Errorf("Expected another endpoint to be sent no credentials, got %v (err: %v)", sent, result.Err)
+	}
+	if result := query(apiServer.URL+"/redirect", nil); result.Healthy || len(sent) != 1 {
+		t.Errorf("Expected the redirect off the apiserver not to be followed, got %v (healthy: %t)", sent, result.Healthy)
+	}
+
+	// Requesting the default credentials for other endpoints should fail.
+	if result := query(other.URL, &v1alpha1.HealthcheckEndpointConfig{
+		Endpoint: other.URL,
+		Auth:     &v1alpha1.HealthcheckEndpointAuth{Type: v1alpha1.HealthcheckEndpointAuthTypeServiceAccount},
+	}); result.Err == nil || len(sent) != 0 {
+		t.Errorf("Expected the default credentials to be refused for another endpoint, got %v (err: %v)", sent, result.Err)
+	}
+}
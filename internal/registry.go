@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// endpointRegistry tracks exactly which resources subscribe to which endpoints. It replaces reference counting with
+// sets, so repeated events for the same resource never skew the bookkeeping, and is safe for concurrent use.
+type endpointRegistry struct {
+
+	// mu guards all fields below.
+	mu sync.RWMutex
+
+	// endpoints maps each endpoint to the keys of the resources subscribing to it.
+	endpoints map[string]sets.Set[string]
+
+	// resources maps each resource key to the endpoints it subscribes to.
+	resources map[string]sets.Set[string]
+}
+
+// registrySnapshot is a point-in-time copy of the registry's contents.
+type registrySnapshot struct {
+
+	// Endpoints maps each endpoint to the sorted keys of the resources subscribing to it.
+	Endpoints map[string][]string `json:"endpoints"`
+
+	// Resources maps each resource key to the sorted endpoints it subscribes to.
+	Resources map[string][]string `json:"resources"`
+}
+
+var _ http.Handler = &endpointRegistry{}
+
+// newEndpointRegistry creates a new endpointRegistry.
+func newEndpointRegistry() *endpointRegistry {
+	return &endpointRegistry{
+		endpoints: make(map[string]sets.Set[string]),
+		resources: make(map[string]sets.Set[string]),
+	}
+}
+
+// Sync sets the endpoints the resource subscribes to, and returns the ones it no longer subscribes to.
+func (r *endpointRegistry) Sync(key string, endpoints []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	desired := sets.New[string](endpoints...)
+	current, ok := r.resources[key]
+	if !ok {
+		current = sets.New[string]()
+	}
+	removed := current.Difference(desired)
+	for endpoint := range removed {
+		r.unlinkLocked(key, endpoint)
+	}
+	for endpoint := range desired.Difference(current) {
+		if _, ok := r.endpoints[endpoint]; !ok {
+			r.endpoints[endpoint] = sets.New[string]()
+		}
+		r.endpoints[endpoint].Insert(key)
+	}
+	if desired.Len() == 0 {
+		delete(r.resources, key)
+	} else {
+		r.resources[key] = desired
+	}
+
+	return sets.List(removed)
+}
+
+// Release drops all subscriptions of the resource, and returns the endpoints it subscribed to.
+func (r *endpointRegistry) Release(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.resources[key]
+	if !ok {
+		return nil
+	}
+	for endpoint := range current {
+		r.unlinkLocked(key, endpoint)
+	}
+	delete(r.resources, key)
+
+	return sets.List(current)
+}
+
+// unlinkLocked removes the resource from the endpoint's subscribers, dropping the endpoint if it has none left.
+func (r *endpointRegistry) unlinkLocked(key string, endpoint string) {
+	subscribers, ok := r.endpoints[endpoint]
+	if !ok {
+		return
+	}
+	subscribers.Delete(key)
+	if subscribers.Len() == 0 {
+		delete(r.endpoints, endpoint)
+	}
+}
+
+// Resources returns the keys of all resources with at least one subscription.
+func (r *endpointRegistry) Resources() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]string, 0, len(r.resources))
+	for key := range r.resources {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Snapshot returns a copy of the registry's contents.
+func (r *endpointRegistry) Snapshot() registrySnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snapshot := registrySnapshot{
+		Endpoints: make(map[string][]string, len(r.endpoints)),
+		Resources: make(map[string][]string, len(r.resources)),
+	}
+	for endpoint, subscribers := range r.endpoints {
+		snapshot.Endpoints[endpoint] = sets.List(subscribers)
+	}
+	for key, endpoints := range r.resources {
+		snapshot.Resources[key] = sets.List(endpoints)
+	}
+
+	return snapshot
+}
+
+// ServeHTTP exposes the registry's contents, for debugging.
+func (r *endpointRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.Snapshot()); err != nil {
+		http.Error(w, "Error encoding registry", http.StatusInternalServerError)
+	}
+}
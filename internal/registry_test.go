@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEndpointRegistry(t *testing.T) {
+	r := newEndpointRegistry()
+
+	// Repeated syncs should not skew the bookkeeping.
+	for i := 0; i < 3; i++ {
+		r.Sync("default/foo", []string{"https://foo", "https://bar"})
+		r.Sync("default/bar", []string{"https://foo"})
+	}
+	snapshot := r.Snapshot()
+	if got := snapshot.Endpoints["https://foo"]; !slices.Equal(got, []string{"default/bar", "default/foo"}) {
+		t.Errorf("Expected https://foo to be subscribed to by both resources, got %v", got)
+	}
+
+	// Dropping an endpoint from the spec should report it as removed, and only once.
+	if removed := r.Sync("default/foo", []string{"https://foo"}); !slices.Equal(removed, []string{"https://bar"}) {
+		t.Errorf("Expected https://bar to be removed, got %v", removed)
+	}
+	if removed := r.Sync("default/foo", []string{"https://foo"}); len(removed) != 0 {
+		t.Errorf("Expected nothing to be removed, got %v", removed)
+	}
+	if _, ok := r.Snapshot().Endpoints["https://bar"]; ok {
+		t.Errorf("Expected https://bar to be dropped")
+	}
+
+	// Releasing a resource should leave the endpoints of the others untouched.
+	if released := r.Release("default/foo"); !slices.Equal(released, []string{"https://foo"}) {
+		t.Errorf("Expected https://foo to be released, got %v", released)
+	}
+	if released := r.Release("default/foo"); len(released) != 0 {
+		t.Errorf("Expected nothing to be released, got %v", released)
+	}
+	if got := r.Snapshot().Endpoints["https://foo"]; !slices.Equal(got, []string{"default/bar"}) {
+		t.Errorf("Expected https://foo to be subscribed to by default/bar only, got %v", got)
+	}
+
+	// The debug handler should serve the registry's contents.
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/registry", nil))
+	if got, want := recorder.Body.String(), `{"endpoints":{"https://foo":["default/bar"]},"resources":{"default/bar":["https://foo"]}}`+"\n"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestEndpointRegistryConcurrency(t *testing.T) {
+	r := newEndpointRegistry()
+
+	// Sync and release many resources concurrently, with overlapping endpoints.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("default/resource-%d", i)
+			for j := 0; j < 100; j++ {
+				r.Sync(key, []string{fmt.Sprintf("https://endpoint-%d", j%5), fmt.Sprintf("https://endpoint-%d", (i+j)%7)})
+				_ = r.Snapshot()
+				if j%10 == 0 {
+					r.Release(key)
+				}
+			}
+			if i%2 == 0 {
+				r.Release(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every subscription should be reflected on both sides, and nothing should be left behind.
+	snapshot := r.Snapshot()
+	if len(snapshot.Resources) != 25 {
+		t.Errorf("Expected 25 resources, got %d", len(snapshot.Resources))
+	}
+	for key, endpoints := range snapshot.Resources {
+		for _, endpoint := range endpoints {
+			if !slices.Contains(snapshot.Endpoints[endpoint], key) {
+				t.Errorf("Expected %s to be subscribed to by %s", endpoint, key)
+			}
+		}
+	}
+	for endpoint, keys := range snapshot.Endpoints {
+		if len(keys) == 0 {
+			t.Errorf("Expected %s to be dropped", endpoint)
+		}
+		for _, key := range keys {
+			if !slices.Contains(snapshot.Resources[key], endpoint) {
+				t.Errorf("Expected %s to subscribe to %s", key, endpoint)
+			}
+		}
+	}
+}
@@ -31,8 +31,8 @@ func ringAppend(ptr *ring.Ring, record v1alpha1.HealthcheckRecord) *ring.Ring {
 	if _atCapacity(ptr) {
 
 		// Move event record one index up.
-		// Put the new record in the last place, since this is the oldest recorded event we will drop.
-		ptr = ptr.Move(ptr.Len() - 1)
+		// Put the new record in the next place, since this is the oldest recorded event we will drop.
+		ptr = ptr.Next()
 		ptr.Value = record
 		return ptr
 	}
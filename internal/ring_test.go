@@ -59,4 +59,12 @@ func TestRing(t *testing.T) {
 	if !_atCapacity(r) {
 		t.Errorf("Expected the ring to be at capacity")
 	}
+
+	// Appending to a ring at capacity should drop the oldest record.
+	r = ringAppend(r, v1alpha1.HealthcheckRecord{Healthy: ptr.To(false), Timestamp: ptr.To(metav1.Now())})
+	if *r.Value.(v1alpha1.HealthcheckRecord).Healthy ||
+		!*r.Prev().Value.(v1alpha1.HealthcheckRecord).Healthy ||
+		*r.Prev().Prev().Value.(v1alpha1.HealthcheckRecord).Healthy {
+		t.Errorf("Expected the oldest record to be dropped")
+	}
 }
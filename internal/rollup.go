@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+)
+
+// RollupTier is a tier of fixed-width buckets the raw history is downsampled to.
+type RollupTier struct {
+
+	// Width is the width of the buckets.
+	Width time.Duration
+
+	// Retention is the duration for which the buckets are kept.
+	Retention time.Duration
+}
+
+// ParseRollupTiers parses comma-separated "<width>:<retention>" tiers, e.g., "1m:24h,1h:720h", finest first. An empty
+// value disables rollups.
+func ParseRollupTiers(value string) ([]RollupTier, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var tiers []RollupTier
+	for _, tier := range strings.Split(value, ",") {
+		width, retention, ok := strings.Cut(strings.TrimSpace(tier), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid rollup tier %q: expected <width>:<retention>", tier)
+		}
+		widthTyped, err := time.ParseDuration(width)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup tier %q: %w", tier, err)
+		}
+		retentionTyped, err := time.ParseDuration(retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup tier %q: %w", tier, err)
+		}
+		if widthTyped < time.Second || widthTyped%time.Second != 0 {
+			return nil, fmt.Errorf("invalid rollup tier %q: width must be a positive number of seconds", tier)
+		}
+		if retentionTyped < widthTyped {
+			return nil, fmt.Errorf("invalid rollup tier %q: retention must be at least the width", tier)
+		}
+		if slices.ContainsFunc(tiers, func(t RollupTier) bool { return t.Width == widthTyped }) {
+			return nil, fmt.Errorf("invalid rollup tier %q: duplicate width", tier)
+		}
+		tiers = append(tiers, RollupTier{Width: widthTyped, Retention: retentionTyped})
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].Width < tiers[j].Width
+	})
+
+	return tiers, nil
+}
+
+// newHistoryRetentions validates the raw retention against the rollup tiers. Open buckets are recovered from the raw
+// series after restarts, so it needs to span the widest bucket.
+func newHistoryRetentions(raw time.Duration, tiers []RollupTier) (historyRetentions, error) {
+	if len(tiers) > 0 && raw < tiers[len(tiers)-1].Width {
+		return historyRetentions{}, fmt.Errorf("history retention (%s) must be at least the widest rollup bucket (%s)", raw, tiers[len(tiers)-1].Width)
+	}
+
+	return historyRetentions{raw: raw, tiers: tiers}, nil
+}
+
+// rollupHistoryStore persists raw records to a backend, and downsamples them into the buckets of each rollup tier.
+// Buckets are accumulated in memory while open, and persisted once closed, i.e., once a record falls into the next
+// bucket, or the bucket's window has passed. Buckets persisted as their window passed are kept until a record falls
+// into the next one, so late records are added to them, and they are persisted again, replacing the earlier version.
+// Queries transparently pick the finest series that is still retained for the whole range.
+type rollupHistoryStore struct {
+
+	// backend persists the raw records, and the closed buckets.
+	backend historyBackend
+
+	// retentions holds the raw retention, and the rollup tiers.
+	retentions historyRetentions
+
+	// mu guards rollups.
+	mu sync.Mutex
+
+	// rollups holds the open buckets of the resources, by UID. Resources are added once their open buckets have been
+	// recovered from the raw series.
+	rollups map[types.UID]*resourceRollups
+}
+
+// resourceRollups holds the open buckets of a resource.
+type resourceRollups struct {
+
+	// resource is the resource the buckets belong to.
+	resource *v1alpha1.MetricsAnomalyDetectorResource
+
+	// open holds the open bucket of each tier, if any.
+	open []*bucketAccumulator
+}
+
+// bucketAccumulator accumulates the records falling into a bucket. All latencies are kept, so percentiles are exact.
+type bucketAccumulator struct {
+
+	// start is the start of the bucket.
+	start time.Time
+
+	// width is the width of the bucket.
+	width time.Duration
+
+	// samples is the number of records in the bucket.
+	samples int32
+
+	// failures is the number of unhealthy records in the bucket.
+	failures int32
+
+	// latencies are the latencies of the records in the bucket.
+	latencies []time.Duration
+
+	// dirty is whether records were added since the bucket was last persisted, if ever.
+	dirty bool
+}
+
+// newRollupHistoryStore creates a new rollupHistoryStore.
+func newRollupHistoryStore(backend historyBackend, retentions historyRetentions) *rollupHistoryStore {
+	return &rollupHistoryStore{
+		backend:    backend,
+		retentions: retentions,
+		rollups:    map[types.UID]*resourceRollups{},
+	}
+}
+
+// Append persists the raw record, and adds it to the open buckets, persisting the ones it closes.
+func (s *rollupHistoryStore) Append(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) error {
+	if record.Timestamp == nil || len(s.retentions.tiers) == 0 {
+		return s.backend.Append(ctx, resource, record)
+	}
+
+	// Recover the open buckets before the record is persisted, so it is not counted twice.
+	rollups, err := s.seed(ctx, resource, record.Timestamp.Time)
+	if err != nil {
+		return err
+	}
+	if err = s.backend.Append(ctx, resource, record); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	rollups.resource = resource
+	var closed []v1alpha1.HealthcheckBucket
+	for i, tier := range s.retentions.tiers {
+		start := record.Timestamp.Truncate(tier.Width)
+		open := rollups.open[i]
+		if open != nil && start.After(open.start) {
+			if open.dirty {
+				closed = append(closed, open.bucket())
+			}
+			open = nil
+		}
+		if open == nil {
+			open = &bucketAccumulator{start: start, width: tier.Width}
+		}
+		if !record.Timestamp.Time.Before(open.start) {
+			open.add(record)
+		}
+		rollups.open[i] = open
+	}
+	s.mu.Unlock()
+
+	return s.persist(ctx, resource, closed)
+}
+
+// Records returns the raw records of the resource within [from, to), oldest first.
+func (s *rollupHistoryStore) Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	return s.backend.Records(ctx, resource, from, to)
+}
+
+// Buckets returns the history of the resource overlapping [from, to), oldest first, from the raw series if it still
+// retains the whole range, and from the finest tier that does otherwise. Ranges reaching further back than all tiers
+// are served from the coarsest one.
+func (s *rollupHistoryStore) Buckets(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	i, ok := s.tier(from, time.Now())
+	if !ok {
+		records, err := s.backend.Records(ctx, resource, from, to)
+		if err != nil {
+			return nil, err
+		}
+		buckets := make([]v1alpha1.HealthcheckBucket, 0, len(records))
+		for _, record := range records {
+			buckets = append(buckets, record.Bucket())
+		}
+		return buckets, nil
+	}
+	buckets, err := s.backend.Buckets(ctx, resource, s.retentions.tiers[i].Width, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Include the open bucket, which is yet to be persisted.
+	s.mu.Lock()
+	if rollups, ok := s.rollups[resource.GetUID()]; ok && rollups.open[i] != nil {
+		buckets = append(buckets, rollups.open[i].bucket())
+	}
+	s.mu.Unlock()
+
+	return bucketsWithin(sortedBuckets(buckets), from, to), nil
+}
+
+// Delete drops the open buckets, and the persisted history of the resource.
+func (s *rollupHistoryStore) Delete(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource) error {
+	s.mu.Lock()
+	delete(s.rollups, resource.GetUID())
+	s.mu.Unlock()
+
+	return s.backend.Delete(ctx, resource)
+}
+
+// Release drops the open buckets of the resource, which the replica taking it over recovers from the raw series.
+func (s *rollupHistoryStore) Release(key string) {
+	s.mu.Lock()
+	for uid, rollups := range s.rollups {
+		if rollups.resource.GetNamespace()+"/"+rollups.resource.GetName() == key {
+			delete(s.rollups, uid)
+		}
+	}
+	s.mu.Unlock()
+
+	s.backend.Release(key)
+}
+
+// Run runs the backend, and closes the buckets whose window has passed every finest bucket width, until the context
+// is cancelled.
+func (s *rollupHistoryStore) Run(ctx context.Context) {
+	if len(s.retentions.tiers) == 0 {
+		s.backend.Run(ctx)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.backend.Run(ctx)
+	}()
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		s.Flush(ctx, time.Now())
+	}, s.retentions.tiers[0].Width)
+	<-done
+}
+
+// Flush persists the open buckets whose window has passed by now, for resources that stopped receiving records. The
+// buckets are kept, so records arriving late are added to them, and they are persisted again, replacing the persisted
+// ones, rather than as buckets of their own.
+func (s *rollupHistoryStore) Flush(ctx context.Context, now time.Time) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "component", "history")
+	closed := map[*v1alpha1.MetricsAnomalyDetectorResource][]v1alpha1.HealthcheckBucket{}
+	s.mu.Lock()
+	for _, rollups := range s.rollups {
+		for _, open := range rollups.open {
+			if open != nil && open.dirty && !now.Before(open.start.Add(open.width)) {
+				closed[rollups.resource] = append(closed[rollups.resource], open.bucket())
+				open.dirty = false
+			}
+		}
+	}
+	s.mu.Unlock()
+	for resource, buckets := range closed {
+		if err := s.persist(ctx, resource, buckets); err != nil {
+			logger.Error(err, "failed to persist rollup buckets", "resource", klog.KObj(resource))
+		}
+	}
+}
+
+// seed returns the open buckets of the resource, recovering them from the raw records persisted before the given
+// time, if the resource was not rolled up yet, e.g., after a restart.
+func (s *rollupHistoryStore) seed(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, timestamp time.Time) (*resourceRollups, error) {
+	s.mu.Lock()
+	rollups, ok := s.rollups[resource.GetUID()]
+	s.mu.Unlock()
+	if ok {
+		return rollups, nil
+	}
+	tiers := s.retentions.tiers
+	records, err := s.backend.Records(ctx, resource, timestamp.Truncate(tiers[len(tiers)-1].Width).Add(-time.Nanosecond), timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("error recovering rollups of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+	}
+	rollups = &resourceRollups{resource: resource, open: make([]*bucketAccumulator, len(tiers))}
+	for i, tier := range tiers {
+		open := &bucketAccumulator{start: timestamp.Truncate(tier.Width), width: tier.Width}
+		for _, record := range records {
+			if !record.Timestamp.Time.Before(open.start) {
+				open.add(record)
+			}
+		}
+		if open.samples > 0 {
+			rollups.open[i] = open
+		}
+	}
+
+	// Keep the open buckets of a concurrent append, if any.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.rollups[resource.GetUID()]; ok {
+		return existing, nil
+	}
+	s.rollups[resource.GetUID()] = rollups
+
+	return rollups, nil
+}
+
+// persist appends the closed buckets to the backend.
+func (s *rollupHistoryStore) persist(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, buckets []v1alpha1.HealthcheckBucket) error {
+	for _, bucket := range buckets {
+		if err := s.backend.AppendBucket(ctx, resource, bucket); err != nil {
+			return fmt.Errorf("error persisting rollup bucket of %s/%s: %w", resource.GetNamespace(), resource.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// tier returns the index of the finest tier retaining the history since from, or false if the raw series still does.
+func (s *rollupHistoryStore) tier(from, now time.Time) (int, bool) {
+	tiers := s.retentions.tiers
+	if len(tiers) == 0 || !from.Before(now.Add(-s.retentions.raw)) {
+		return 0, false
+	}
+	for i, tier := range tiers {
+		if !from.Before(now.Add(-tier.Retention)) {
+			return i, true
+		}
+	}
+
+	return len(tiers) - 1, true
+}
+
+// add adds the record to the bucket.
+func (a *bucketAccumulator) add(record v1alpha1.HealthcheckRecord) {
+	a.dirty = true
+	a.samples++
+	if record.Healthy == nil || !*record.Healthy {
+		a.failures++
+	}
+	if record.Latency != nil {
+		a.latencies = append(a.latencies, record.Latency.Duration)
+	}
+}
+
+// bucket returns the bucket accumulated so far. Percentiles use the nearest-rank method.
+func (a *bucketAccumulator) bucket() v1alpha1.HealthcheckBucket {
+	bucket := v1alpha1.HealthcheckBucket{
+		Timestamp: ptr.To(metav1.NewTime(a.start)),
+		Width:     metav1.Duration{Duration: a.width},
+		Samples:   a.samples,
+		Failures:  a.failures,
+	}
+	if len(a.latencies) == 0 {
+		return bucket
+	}
+	latencies := slices.Clone(a.latencies)
+	slices.Sort(latencies)
+	percentile := func(p float64) *metav1.Duration {
+		rank := max(int(math.Ceil(p*float64(len(latencies))))-1, 0)
+		return &metav1.Duration{Duration: latencies[rank]}
+	}
+	bucket.LatencyMin = &metav1.Duration{Duration: latencies[0]}
+	bucket.LatencyMax = &metav1.Duration{Duration: latencies[len(latencies)-1]}
+	bucket.LatencyP50 = percentile(0.5)
+	bucket.LatencyP90 = percentile(0.9)
+	bucket.LatencyP99 = percentile(0.99)
+
+	return bucket
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestParseRollupTiers(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    []RollupTier
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "1h:720h, 1m:24h", want: []RollupTier{{Width: time.Minute, Retention: 24 * time.Hour}, {Width: time.Hour, Retention: 720 * time.Hour}}},
+		{value: "1m", wantErr: true},
+		{value: "1m:foo", wantErr: true},
+		{value: "1500ms:1h", wantErr: true},
+		{value: "1h:1m", wantErr: true},
+		{value: "1m:1h,60s:2h", wantErr: true},
+	} {
+		got, err := ParseRollupTiers(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Expected error for %q to be %t, got %v", tc.value, tc.wantErr, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("Expected %q to parse to %v, got %v", tc.value, tc.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("Expected %q to parse to %v, got %v", tc.value, tc.want, got)
+				break
+			}
+		}
+	}
+}
+
+// assertBuckets asserts that the store returns the given number of buckets of the given width overlapping
+// [from, to), holding the given number of samples, and failures in total.
+func assertBuckets(t *testing.T, store HistoryStore, from, to time.Time, width time.Duration, want int, wantSamples, wantFailures int32) []v1alpha1.HealthcheckBucket {
+	t.Helper()
+	buckets, err := store.Buckets(context.Background(), historyResource, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != want {
+		t.Errorf("Expected %d buckets within [%s, %s), got %d", want, from, to, len(buckets))
+		return buckets
+	}
+	var samples, failures int32
+	for _, bucket := range buckets {
+		if bucket.Width.Duration != width {
+			t.Errorf("Expected buckets of width %s, got %s", width, bucket.Width.Duration)
+		}
+		samples += bucket.Samples
+		failures += bucket.Failures
+	}
+	if samples != wantSamples || failures != wantFailures {
+		t.Errorf("Expected %d samples, and %d failures, got %d, and %d", wantSamples, wantFailures, samples, failures)
+	}
+
+	return buckets
+}
+
+func TestRollupHistoryStore(t *testing.T) {
+	ctx := context.Background()
+	retentions, err := newHistoryRetentions(time.Hour, []RollupTier{{Width: time.Minute, Retention: 24 * time.Hour}, {Width: time.Hour, Retention: 720 * time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newHistoryRetentions(time.Minute, retentions.tiers); err == nil {
+		t.Errorf("Expected a raw retention shorter than the widest bucket to be rejected")
+	}
+
+	// Queries should pick the finest series retaining the whole range.
+	now := time.Now()
+	store := newRollupHistoryStore(nil, retentions)
+	for _, tc := range []struct {
+		from   time.Time
+		want   int
+		wantOk bool
+	}{
+		{from: now.Add(-30 * time.Minute)},
+		{from: now.Add(-2 * time.Hour), want: 0, wantOk: true},
+		{from: now.Add(-48 * time.Hour), want: 1, wantOk: true},
+		{from: now.Add(-90 * 24 * time.Hour), want: 1, wantOk: true},
+	} {
+		if got, ok := store.tier(tc.from, now); got != tc.want || ok != tc.wantOk {
+			t.Errorf("Expected tier (%d, %t) for %s, got (%d, %t)", tc.want, tc.wantOk, now.Sub(tc.from), got, ok)
+		}
+	}
+
+	for name, newBackend := range map[string]func() historyBackend{
+		"file": func() historyBackend {
+			return newFileHistoryBackend(t.TempDir(), retentions)
+		},
+		"configmap": func() historyBackend {
+			return newConfigMapHistoryBackend(fake.NewSimpleClientset(), 100, time.Minute, retentions)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend()
+			store := newRollupHistoryStore(backend, retentions)
+
+			// Record two hours worth of records every ten seconds, failing every fourth one.
+			start := time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+			for i := 0; i < 720; i++ {
+				if err := store.Append(ctx, historyResource, v1alpha1.HealthcheckRecord{
+					Healthy:   ptr.To(i%4 != 0),
+					Timestamp: ptr.To(metav1.NewTime(start.Add(time.Duration(i) * 10 * time.Second))),
+					Latency:   &metav1.Duration{Duration: time.Duration(i%6+1) * 10 * time.Millisecond},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Closed, and open buckets should be returned alike.
+			buckets := assertBuckets(t, store, start, start.Add(2*time.Hour), time.Minute, 120, 720, 180)
+			if len(buckets) > 0 {
+				bucket := buckets[0]
+				for name, got := range map[string]*metav1.Duration{
+					"min": bucket.LatencyMin,
+					"p50": bucket.LatencyP50,
+					"p90": bucket.LatencyP90,
+					"p99": bucket.LatencyP99,
+					"max": bucket.LatencyMax,
+				} {
+					want := map[string]time.Duration{"min": 10, "p50": 30, "p90": 60, "p99": 60, "max": 60}[name] * time.Millisecond
+					if got == nil || got.Duration != want {
+						t.Errorf("Expected the %s latency to be %s, got %v", name, want, got)
+					}
+				}
+			}
+			assertBuckets(t, store, start.Add(-48*time.Hour), start.Add(2*time.Hour), time.Hour, 2, 720, 180)
+
+			// Open buckets should be recovered from the raw series after a restart.
+			store = newRollupHistoryStore(backend, retentions)
+			if err := store.Append(ctx, historyResource, v1alpha1.HealthcheckRecord{
+				Healthy:   ptr.To(true),
+				Timestamp: ptr.To(metav1.NewTime(start.Add(2*time.Hour - 5*time.Second))),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			store.Flush(ctx, start.Add(3*time.Hour))
+			buckets = assertBuckets(t, store, start.Add(-48*time.Hour), start.Add(2*time.Hour), time.Hour, 2, 721, 180)
+			if len(buckets) == 2 && buckets[1].Samples != 361 {
+				t.Errorf("Expected the recovered bucket to hold 361 samples, got %d", buckets[1].Samples)
+			}
+			assertBuckets(t, store, start.Add(time.Hour+59*time.Minute), start.Add(2*time.Hour), time.Minute, 1, 7, 1)
+
+			// Records arriving late should be added to their flushed buckets, which should then replace the persisted
+			// ones, rather than be persisted as buckets of their own.
+			if err := store.Append(ctx, historyResource, v1alpha1.HealthcheckRecord{
+				Healthy:   ptr.To(false),
+				Timestamp: ptr.To(metav1.NewTime(start.Add(2*time.Hour - 2*time.Second))),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			store.Flush(ctx, start.Add(3*time.Hour))
+			assertBuckets(t, store, start.Add(-48*time.Hour), start.Add(2*time.Hour), time.Hour, 2, 722, 181)
+			assertBuckets(t, store, start.Add(time.Hour+59*time.Minute), start.Add(2*time.Hour), time.Minute, 1, 8, 2)
+
+			// Releasing the resource should drop its buckets from memory, but not from the backend.
+			store.Release(historyResource.GetNamespace() + "/" + historyResource.GetName())
+			if len(store.rollups) != 0 {
+				t.Errorf("Expected the buckets to be released, got %d resources", len(store.rollups))
+			}
+			assertBuckets(t, store, start.Add(-48*time.Hour), start.Add(2*time.Hour), time.Hour, 2, 722, 181)
+
+			// Deleting the history should drop all series.
+			if err := store.Delete(ctx, historyResource); err != nil {
+				t.Fatal(err)
+			}
+			assertBuckets(t, store, start.Add(-48*time.Hour), start.Add(2*time.Hour), time.Hour, 0, 0, 0)
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+const (
+
+	// probeJitterFactor is the maximum fraction of the interval by which a probe is shifted either way, so that probes
+	// sharing an interval do not stay in lockstep.
+	probeJitterFactor = 0.05
+
+	// defaultProbeConcurrency is the default maximum number of endpoints queried at once.
+	defaultProbeConcurrency = 10
+)
+
+// queryFunc queries an endpoint, using the given endpoint configuration, if any.
+type queryFunc func(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) QueryResult
+
+// probeScheduler owns the timings of all probes. Due probes are popped off a min-heap ordered by their next run, and
+// handed to a fixed pool of workers, which bounds the number of endpoints queried at once. Resources subscribing to
+// the same endpoint, with the same configuration, share a single probe whose results are fanned out to each of them.
+type probeScheduler struct {
+
+	// query queries an endpoint.
+	query queryFunc
+
+	// workers is the maximum number of probes running at once.
+	workers int
+
+	// busy is the number of workers running a probe.
+	busy atomic.Int32
+
+	// mu guards all fields below.
+	mu sync.Mutex
+
+	// probes is the set of scheduled probes, keyed by their probe key.
+	probes map[string]*probe
+
+	// subscriptions maps each subscription to the key of the probe it is attached to.
+	subscriptions map[subscriptionKey]string
+
+	// queue holds the probes that are not in-flight, ordered by their next run.
+	queue probeHeap
+
+	// wakeup signals the scheduling loop that the head of the queue may have changed.
+	wakeup chan struct{}
+}
+
+// subscriptionKey identifies a resource's subscription to one of its endpoints.
+type subscriptionKey struct {
+	subscriber string
+	endpoint   string
+}
+
+// probe is a periodic query against an endpoint, shared by all its subscribers.
+type probe struct {
+
+	// key identifies the probe, see probeKeyFor.
+	key string
+
+	// namespace is the namespace in which the endpoint configuration references are resolved.
+	namespace string
+
+	// endpoint is the endpoint to query.
+	endpoint string
+
+	// config is the endpoint configuration, if any.
+	config *v1alpha1.HealthcheckEndpointConfig
+
+	// interval is the shortest interval amongst the subscribers.
+	interval time.Duration
+
+	// next is the time of the next run.
+	next time.Time
+
+	// index is the probe's position in the queue, or -1 if it is not queued, i.e., in-flight.
+	index int
+
+	// subscribers are the subscriptions fanned out to, keyed by the subscriber.
+	subscribers map[string]*probeSubscriber
+}
+
+// probeSubscriber is a single subscription to a probe.
+type probeSubscriber struct {
+
+	// interval is the interval at which the subscriber expects results.
+	interval time.Duration
+
+	// next is the time the subscriber is next due a result.
+	next time.Time
+
+	// deliver is called with the results of the probe.
+	deliver func(QueryResult)
+}
+
+// newProbeScheduler creates a new probeScheduler.
+func newProbeScheduler(query queryFunc, workers int) *probeScheduler {
+	if workers <= 0 {
+		workers = defaultProbeConcurrency
+	}
+
+	return &probeScheduler{
+		query:         query,
+		workers:       workers,
+		probes:        make(map[string]*probe),
+		subscriptions: make(map[subscriptionKey]string),
+		wakeup:        make(chan struct{}, 1),
+	}
+}
+
+// Subscribe subscribes the subscriber to the endpoint, delivering results every interval. Subscribing again replaces
+// the existing subscription, so repeated calls never lead to duplicate probes.
+func (s *probeScheduler) Subscribe(
+	subscriber string,
+	namespace string,
+	endpoint string,
+	config *v1alpha1.HealthcheckEndpointConfig,
+	interval time.Duration,
+	deliver func(QueryResult),
+) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Detach the subscriber from its current probe, if the endpoint configuration changed.
+	subKey := subscriptionKey{subscriber: subscriber, endpoint: endpoint}
+	key := probeKeyFor(namespace, endpoint, config)
+	if current, ok := s.subscriptions[subKey]; ok && current != key {
+		s.detachLocked(subKey)
+	}
+	s.subscriptions[subKey] = key
+
+	// Attach the subscriber to the probe, creating it if needed. New probes are spread over their interval.
+	now := time.Now()
+	p, ok := s.probes[key]
+	if !ok {
+		p = &probe{
+			key:         key,
+			namespace:   namespace,
+			endpoint:    endpoint,
+			config:      config,
+			interval:    interval,
+			next:        now.Add(time.Duration(rand.Int63n(int64(interval)))),
+			index:       -1,
+			subscribers: make(map[string]*probeSubscriber),
+		}
+		s.probes[key] = p
+		heap.Push(&s.queue, p)
+	}
+	if existing, ok := p.subscribers[subscriber]; ok {
+		existing.interval = interval
+		existing.deliver = deliver
+	} else {
+		p.subscribers[subscriber] = &probeSubscriber{
+			interval: interval,
+			next:     now,
+			deliver:  deliver,
+		}
+	}
+	s.resetIntervalLocked(p)
+	s.signal()
+}
+
+// Unsubscribe removes the subscriber's subscription to the endpoint. The probe is stopped once it has no subscribers.
+func (s *probeScheduler) Unsubscribe(subscriber string, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.detachLocked(subscriptionKey{subscriber: subscriber, endpoint: endpoint})
+	s.signal()
+}
+
+// Subscriptions returns the endpoints each subscriber is subscribed to.
+func (s *probeScheduler) Subscriptions() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriptions := make(map[string][]string)
+	for subKey := range s.subscriptions {
+		subscriptions[subKey.subscriber] = append(subscriptions[subKey.subscriber], subKey.endpoint)
+	}
+
+	return subscriptions
+}
+
+// Stats returns the number of workers running a probe, the number of workers, and the number of scheduled probes, and
+// subscriptions.
+func (s *probeScheduler) Stats() (busy, workers, probes, subscriptions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int(s.busy.Load()), s.workers, len(s.probes), len(s.subscriptions)
+}
+
+// detachLocked removes the subscription from its probe, and drops the probe if it has no subscribers left.
+func (s *probeScheduler) detachLocked(subKey subscriptionKey) {
+	key, ok := s.subscriptions[subKey]
+	if !ok {
+		return
+	}
+	delete(s.subscriptions, subKey)
+	p, ok := s.probes[key]
+	if !ok {
+		return
+	}
+	delete(p.subscribers, subKey.subscriber)
+	if len(p.subscribers) > 0 {
+		s.resetIntervalLocked(p)
+		return
+	}
+
+	// In-flight probes are not queued, and are dropped once they return.
+	delete(s.probes, key)
+	if p.index >= 0 {
+		heap.Remove(&s.queue, p.index)
+		s.forgetLocked(p.endpoint)
+	}
+}
+
+// forgetLocked drops the metrics of the endpoint, unless other probes still query it.
+func (s *probeScheduler) forgetLocked(endpoint string) {
+	label := probeEndpointLabel(endpoint)
+	for _, p := range s.probes {
+		if probeEndpointLabel(p.endpoint) == label {
+			return
+		}
+	}
+	forgetProbeDuration(endpoint)
+}
+
+// resetIntervalLocked sets the probe's interval to the shortest one amongst its subscribers.
+func (s *probeScheduler) resetIntervalLocked(p *probe) {
+	var interval time.Duration
+	for _, sub := range p.subscribers {
+		if interval == 0 || sub.interval < interval {
+			interval = sub.interval
+		}
+	}
+	if interval == p.interval {
+		return
+	}
+	p.interval = interval
+
+	// Pull the next run in, if it lies beyond the new interval.
+	if latest := time.Now().Add(interval); p.index >= 0 && p.next.After(latest) {
+		p.next = latest
+		heap.Fix(&s.queue, p.index)
+	}
+}
+
+// signal wakes up the scheduling loop, without blocking.
+func (s *probeScheduler) signal() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches due probes to the workers until the context is cancelled.
+func (s *probeScheduler) Run(ctx context.Context) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "component", "scheduler")
+	logger.Info("Starting probe scheduler", "workers", s.workers)
+
+	// Start the workers. The unbuffered channel blocks dispatching while all workers are busy.
+	work := make(chan *probe)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				s.busy.Add(1)
+				s.runProbe(ctx, p)
+				s.busy.Add(-1)
+			}
+		}()
+	}
+	defer func() {
+		close(work)
+		wg.Wait()
+	}()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+
+		// Pop all due probes, and find out how long to wait for the next one.
+		s.mu.Lock()
+		now := time.Now()
+		var due []*probe
+		for s.queue.Len() > 0 && !s.queue[0].next.After(now) {
+			due = append(due, heap.Pop(&s.queue).(*probe))
+		}
+		wait := time.Hour
+		if s.queue.Len() > 0 {
+			wait = s.queue[0].next.Sub(now)
+		}
+		s.mu.Unlock()
+
+		// Dispatch the due probes.
+		for _, p := range due {
+			select {
+			case work <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Wait for the next probe, or for the queue to change.
+		if len(due) > 0 {
+			continue
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopping probe scheduler")
+			return
+		case <-s.wakeup:
+		case <-timer.C:
+		}
+	}
+}
+
+// runProbe queries the probe's endpoint, fans the result out to all due subscribers, and requeues the probe.
+func (s *probeScheduler) runProbe(ctx context.Context, p *probe) {
+
+	// Take a snapshot of the probe, as it may be updated while the query is in-flight.
+	s.mu.Lock()
+	namespace, endpoint, config, interval := p.namespace, p.endpoint, p.config, p.interval
+	s.mu.Unlock()
+
+	// A probe can never outlive its interval.
+	queryCtx, cancel := context.WithTimeout(ctx, interval)
+	result := s.query(queryCtx, namespace, endpoint, config)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Collect the due subscribers. A subscriber is considered due if it would otherwise have to wait for more than
+	// half the probe's interval, which accommodates for the jitter.
+	s.mu.Lock()
+	now := time.Now()
+	var deliveries []func(QueryResult)
+	for _, sub := range p.subscribers {
+		if sub.next.After(now.Add(p.interval / 2)) {
+			continue
+		}
+		deliveries = append(deliveries, sub.deliver)
+		sub.next = now.Add(sub.interval)
+	}
+
+	// Requeue the probe, unless all its subscribers left while it was in-flight.
+	if s.probes[p.key] == p {
+		p.next = now.Add(jitter(p.interval))
+		heap.Push(&s.queue, p)
+		s.signal()
+	} else {
+		s.forgetLocked(endpoint)
+	}
+	s.mu.Unlock()
+
+	// Deliver outside the lock, so subscribers can call back into the scheduler.
+	for _, deliver := range deliveries {
+		deliver(result)
+	}
+}
+
+// jitter shifts the interval by up to probeJitterFactor either way.
+func jitter(interval time.Duration) time.Duration {
+	return interval + time.Duration((rand.Float64()*2-1)*probeJitterFactor*float64(interval))
+}
+
+// probeKeyFor returns the key identifying the probe for the endpoint. Endpoints are only shared across namespaces if
+// their configuration does not reference any Secrets, since those are resolved in the subscriber's namespace.
+func probeKeyFor(namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) string {
+	if config == nil {
+		return endpoint
+	}
+	encoded, err := json.Marshal(config)
+	if err != nil {
+
+		// This should never happen, fall back to a dedicated probe.
+		return namespace + "/" + endpoint
+	}
+	if referencesSecrets(config) {
+		return namespace + "/" + endpoint + "/" + string(encoded)
+	}
+
+	return endpoint + "/" + string(encoded)
+}
+
+// referencesSecrets returns true if the endpoint configuration references any Secrets.
+func referencesSecrets(config *v1alpha1.HealthcheckEndpointConfig) bool {
+	if config.Auth != nil && (config.Auth.BearerToken != nil || config.Auth.BasicAuth != nil) {
+		return true
+	}
+	if config.TLS != nil && (config.TLS.CA != nil || config.TLS.Cert != nil || config.TLS.Key != nil) {
+		return true
+	}
+
+	return false
+}
+
+// probeHeap is a min-heap of probes, ordered by their next run.
+type probeHeap []*probe
+
+var _ heap.Interface = &probeHeap{}
+
+func (h probeHeap) Len() int { return len(h) }
+
+func (h probeHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+
+func (h probeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *probeHeap) Push(x interface{}) {
+	p := x.(*probe)
+	p.index = len(*h)
+	*h = append(*h, p)
+}
+
+func (h *probeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	p.index = -1
+	*h = old[:n-1]
+	return p
+}
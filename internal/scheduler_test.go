@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+)
+
+func TestProbeScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Count the queries, and the maximum number of concurrent ones.
+	var queries, inFlight, maxInFlight atomic.Int32
+	s := newProbeScheduler(func(ctx context.Context, namespace string, endpoint string, config *v1alpha1.HealthcheckEndpointConfig) QueryResult {
+		queries.Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			highest := maxInFlight.Load()
+			if current <= highest || maxInFlight.CompareAndSwap(highest, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return QueryResult{Healthy: true, Attempts: 1}
+	}, 1)
+
+	// Subscribe two resources to the same endpoint, repeatedly, and a third one to a different endpoint.
+	var mu sync.Mutex
+	delivered := map[string]int{}
+	deliverTo := func(subscriber string) func(QueryResult) {
+		return func(QueryResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[subscriber]++
+		}
+	}
+	interval := 50 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		s.Subscribe("default/foo", "default", "https://foo", nil, interval, deliverTo("default/foo"))
+		s.Subscribe("default/bar", "default", "https://foo", nil, interval, deliverTo("default/bar"))
+	}
+	s.Subscribe("default/baz", "default", "https://baz", nil, interval, deliverTo("default/baz"))
+
+	// Shared endpoints should be probed once.
+	s.mu.Lock()
+	if len(s.probes) != 2 {
+		t.Errorf("Expected 2 probes, got %d", len(s.probes))
+	}
+	s.mu.Unlock()
+
+	// Every subscriber should receive the results of its probe.
+	go s.Run(ctx)
+	time.Sleep(10 * interval)
+	mu.Lock()
+	for _, subscriber := range []string{"default/foo", "default/bar", "default/baz"} {
+		if delivered[subscriber] < 5 {
+			t.Errorf("Expected %s to receive at least 5 results, got %d", subscriber, delivered[subscriber])
+		}
+	}
+	mu.Unlock()
+
+	// Two probes should not take twice the number of queries a probe per subscriber would.
+	if got := queries.Load(); got > 2*12 {
+		t.Errorf("Expected at most %d queries, got %d", 2*12, got)
+	}
+
+	// The concurrency limit should be respected.
+	if got := maxInFlight.Load(); got != 1 {
+		t.Errorf("Expected at most 1 query in-flight, got %d", got)
+	}
+
+	// Probes should be dropped once all their subscribers leave.
+	s.Unsubscribe("default/foo", "https://foo")
+	s.Unsubscribe("default/bar", "https://foo")
+	s.mu.Lock()
+	if _, ok := s.probes["https://foo"]; ok {
+		t.Errorf("Expected the probe to be dropped")
+	}
+	if len(s.probes) != 1 {
+		t.Errorf("Expected 1 probe, got %d", len(s.probes))
+	}
+	s.mu.Unlock()
+}
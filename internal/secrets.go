@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+
+	// secretCacheTTL is the time the Secrets referenced by the endpoint configurations are cached for, which bounds the
+	// time rotated credentials take to be picked up.
+	secretCacheTTL = 30 * time.Second
+
+	// secretCacheSize is the number of Secrets cached at most.
+	secretCacheSize = 1024
+)
+
+// secretCache gets the Secrets referenced by the endpoint configurations by name, and caches them for a while, so the
+// controller neither lists, nor watches Secrets, and only ever holds the ones it was pointed at in memory.
+type secretCache struct {
+
+	// client is a standard kubernetes clientset.
+	client kubernetes.Interface
+
+	// ttl is the time Secrets, and their absence, are cached for.
+	ttl time.Duration
+
+	// secrets maps the namespace/name of the Secrets to their last fetched versions, or to nil if they were not found.
+	secrets *cache.LRUExpireCache
+}
+
+// newSecretCache creates a new secretCache.
+func newSecretCache(client kubernetes.Interface, ttl time.Duration) *secretCache {
+	return &secretCache{
+		client:  client,
+		ttl:     ttl,
+		secrets: cache.NewLRUExpireCache(secretCacheSize),
+	}
+}
+
+// Get returns the Secret, fetching it if it is not cached, or its cached version expired. Missing Secrets are cached
+// as such, so endpoints referencing them do not cost a request on every query.
+func (c *secretCache) Get(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	key := namespace + "/" + name
+	if cached, ok := c.secrets.Get(key); ok {
+		secret := cached.(*corev1.Secret)
+		if secret == nil {
+			return nil, errors.NewNotFound(corev1.Resource("secrets"), name)
+		}
+		return secret, nil
+	}
+
+	// Fetch the Secret, and cache it, or its absence. Other errors are not cached, so they are retried right away.
+	secret, err := c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		c.secrets.Add(key, (*corev1.Secret)(nil), c.ttl)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.secrets.Add(key, secret, c.ttl)
+
+	return secret, nil
+}
@@ -2,9 +2,9 @@ package server
 
 import "github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
 
-// evaluateHealth computes the overall health status.
+// EvaluateHealth computes the overall health status.
 // NOTE: The algorithm below is extremely naive and is only meant to serve as a placeholder.
-func evaluateHealth(buffer []v1alpha1.HealthcheckRecord) ([]v1alpha1.HealthcheckRecord, float64) {
+func EvaluateHealth(buffer []v1alpha1.HealthcheckRecord) ([]v1alpha1.HealthcheckRecord, float64) {
 
 	// Filter out all unhealthy records.
 	unhealthyRecords := make([]v1alpha1.HealthcheckRecord, 0)
@@ -22,3 +22,23 @@ func evaluateHealth(buffer []v1alpha1.HealthcheckRecord) ([]v1alpha1.Healthcheck
 
 	return unhealthyRecords, healthScore
 }
+
+// EvaluateBuckets computes the overall health status from rollup buckets, and raw records alike, in the same way as
+// EvaluateHealth does from raw records. It returns the number of unhealthy, and healthy records along with it.
+func EvaluateBuckets(buckets []v1alpha1.HealthcheckBucket) (int, int, float64) {
+
+	// Count all unhealthy records.
+	var samples, failures int
+	for _, bucket := range buckets {
+		samples += int(bucket.Samples)
+		failures += int(bucket.Failures)
+	}
+
+	// Calculate the health score.
+	if samples == 0 {
+		return 0, 0, 0
+	}
+	healthScore := float64(samples-failures) / float64(samples)
+
+	return failures, samples - failures, healthScore
+}
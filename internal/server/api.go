@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// APIVersion is the version of the API, served under /api/<version>.
+const APIVersion = "v1"
+
+// APIPrefix is the path prefix of the API.
+const APIPrefix = "/api/" + APIVersion
+
+// The API types below make up the contract of the API, and are described in the OpenAPI document served at
+// /openapi.json. Their fields are described through the `description` struct tag, which the document is generated
+// from. Query parameters are bound to request fields through the `query` struct tag, and are optional unless tagged
+// with `required:"true"`.
+
+// ErrorCode identifies the class of an APIError, so clients can handle errors without parsing their messages.
+type ErrorCode string
+
+const (
+
+	// ErrorCodeInvalidParameter denotes a missing, or malformed query parameter.
+	ErrorCodeInvalidParameter ErrorCode = "InvalidParameter"
+
+	// ErrorCodeUnauthorized denotes a request without a valid bearer token.
+	ErrorCodeUnauthorized ErrorCode = "Unauthorized"
+
+	// ErrorCodeForbidden denotes a request about resources in a namespace the caller cannot get them in.
+	ErrorCodeForbidden ErrorCode = "Forbidden"
+
+	// ErrorCodeNotFound denotes an unknown route, or a resource that is not watched by the controller.
+	ErrorCodeNotFound ErrorCode = "NotFound"
+
+	// ErrorCodeMethodNotAllowed denotes a request with a method other than GET.
+	ErrorCodeMethodNotAllowed ErrorCode = "MethodNotAllowed"
+
+	// ErrorCodeRateLimited denotes a request that exceeded the rate limit.
+	ErrorCodeRateLimited ErrorCode = "RateLimited"
+
+	// ErrorCodeUnavailable denotes a request that could not be forwarded to the replica owning the resource.
+	ErrorCodeUnavailable ErrorCode = "Unavailable"
+
+	// ErrorCodeInternal denotes an unexpected error.
+	ErrorCodeInternal ErrorCode = "Internal"
+)
+
+// errorCodeStatuses maps error codes to HTTP status codes.
+var errorCodeStatuses = map[ErrorCode]int{
+	ErrorCodeInvalidParameter: http.StatusBadRequest,
+	ErrorCodeUnauthorized:     http.StatusUnauthorized,
+	ErrorCodeForbidden:        http.StatusForbidden,
+	ErrorCodeNotFound:         http.StatusNotFound,
+	ErrorCodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrorCodeRateLimited:      http.StatusTooManyRequests,
+	ErrorCodeUnavailable:      http.StatusBadGateway,
+	ErrorCodeInternal:         http.StatusInternalServerError,
+}
+
+// APIError describes why a request failed.
+type APIError struct {
+	Code      ErrorCode `json:"code" description:"The class of the error." enum:"InvalidParameter,Unauthorized,Forbidden,NotFound,MethodNotAllowed,RateLimited,Unavailable,Internal"`
+	Message   string    `json:"message" description:"A human-readable description of the error."`
+	Parameter string    `json:"parameter,omitempty" description:"The offending query parameter, for InvalidParameter errors."`
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	if e.Parameter != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.Code, e.Message, e.Parameter)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// ErrorResponse is the envelope of every failed request.
+type ErrorResponse struct {
+	Error APIError `json:"error" description:"The error the request failed with."`
+}
+
+// TimeRange is the time range of a request, which includes its start, and excludes its end, so adjacent ranges never
+// overlap. It is given either by its bounds, by its window, or by how long ago it starts. Omitted bounds leave the
+// range open, so requests without a range span the whole history.
+type TimeRange struct {
+	From   time.Time      `query:"ts_a" description:"The start of the time range, included, in RFC3339 format, or in Unix seconds. Defaults to the oldest record."`
+	To     time.Time      `query:"ts_b" description:"The end of the time range, excluded, in RFC3339 format, or in Unix seconds. Defaults to none, i.e., the range is left open."`
+	Window model.Duration `query:"window" description:"The length of the time range, which ends at ts_b, or now, e.g., 1h. Cannot be combined with ts_a."`
+	Since  model.Duration `query:"since" description:"How long ago the time range starts, e.g., 30m. The range is left open. Cannot be combined with ts_a, ts_b, or window."`
+}
+
+// resolve resolves the bounds of the time range, relative to now.
+func (r *TimeRange) resolve(now time.Time) *APIError {
+	switch {
+	case r.Since != 0:
+		if !r.From.IsZero() || !r.To.IsZero() || r.Window != 0 {
+			return &APIError{Code: ErrorCodeInvalidParameter, Message: "since cannot be combined with ts_a, ts_b, or window", Parameter: "since"}
+		}
+		r.From = now.Add(-time.Duration(r.Since))
+	case r.Window != 0:
+		if !r.From.IsZero() {
+			return &APIError{Code: ErrorCodeInvalidParameter, Message: "window cannot be combined with ts_a", Parameter: "window"}
+		}
+		if r.To.IsZero() {
+			r.To = now
+		}
+		r.From = r.To.Add(-time.Duration(r.Window))
+	}
+	if !r.From.IsZero() && !r.To.IsZero() && !r.From.Before(r.To) {
+		return &APIError{Code: ErrorCodeInvalidParameter, Message: "ts_b must be after ts_a", Parameter: "ts_b"}
+	}
+
+	return nil
+}
+
+// bounds returns the bounds of the resolved time range, as given in responses. Open bounds are nil.
+func (r *TimeRange) bounds() (*time.Time, *time.Time) {
+	var from, to *time.Time
+	if !r.From.IsZero() {
+		from = &r.From
+	}
+	if !r.To.IsZero() {
+		to = &r.To
+	}
+
+	return from, to
+}
+
+// HealthRequest requests the health of a resource over a time range.
+type HealthRequest struct {
+	Key string `query:"key" required:"true" description:"The key of the resource, in the format namespace/name."`
+	TimeRange
+}
+
+// HealthResponse is the health of a resource over a time range.
+type HealthResponse struct {
+	Namespace        string     `json:"namespace" description:"The namespace of the resource."`
+	Name             string     `json:"name" description:"The name of the resource."`
+	From             *time.Time `json:"from,omitempty" description:"The start of the time range, included. Unset if the range is open."`
+	To               *time.Time `json:"to,omitempty" description:"The end of the time range, excluded. Unset if the range is open."`
+	HealthScore      float64    `json:"healthScore" description:"The ratio of healthy records to all records within the time range, or zero if there are none."`
+	HealthyRecords   int        `json:"healthyRecords" description:"The number of healthy records within the time range."`
+	UnhealthyRecords int        `json:"unhealthyRecords" description:"The number of unhealthy records within the time range."`
+}
+
+// resolvedRequest is implemented by requests whose parameters are resolved once decoded, e.g., relative to now.
+type resolvedRequest interface {
+
+	// resolve resolves the parameters of the request, relative to now.
+	resolve(now time.Time) *APIError
+}
+
+// ownedRequest is implemented by requests about a single resource, which are served by the replica owning it.
+type ownedRequest interface {
+
+	// resource returns the namespace and name of the resource, or empty strings if the request does not name one.
+	resource() (string, string)
+}
+
+// resource implements ownedRequest.
+func (r HealthRequest) resource() (string, string) {
+	namespace, name, err := splitKey(r.Key)
+	if err != nil {
+		return "", ""
+	}
+
+	return namespace, name
+}
+
+// apiRoute is a route of the API, along with what the OpenAPI document describes it with.
+type apiRoute struct {
+
+	// path is the path of the route, relative to APIPrefix.
+	path string
+
+	// summary is a short description of the route.
+	summary string
+
+	// request, and response are the types of the request, and the response of the route.
+	request, response reflect.Type
+
+	// serve serves the route.
+	serve http.HandlerFunc
+}
+
+// newAPIRoute creates a GET route that decodes its request from the query parameters, and encodes the response, or the
+// error it is handled with, as JSON. Requests about a single resource are forwarded to the replica owning it.
+func newAPIRoute[Request, Response any](s *apiServer, path, summary string, handle func(ctx context.Context, request *Request) (*Response, *APIError)) apiRoute {
+	return apiRoute{
+		path:     path,
+		summary:  summary,
+		request:  reflect.TypeOf((*Request)(nil)).Elem(),
+		response: reflect.TypeOf((*Response)(nil)).Elem(),
+		serve: func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeError(w, &APIError{Code: ErrorCodeMethodNotAllowed, Message: fmt.Sprintf("method %s is not allowed", r.Method)})
+				return
+			}
+
+			// Decode the request.
+			request := new(Request)
+			if err := decodeRequest(r.URL.Query(), request); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			// Forward the request to the replica owning the resource, if any.
+			if owned, ok := any(request).(ownedRequest); ok {
+				if namespace, name := owned.resource(); name != "" && s.forward(w, r, namespace, name) {
+					return
+				}
+			}
+
+			// Handle the request.
+			response, err := handle(r.Context(), request)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, response)
+		},
+	}
+}
+
+// routes returns the routes of the API.
+func (s *apiServer) routes() []apiRoute {
+	return []apiRoute{
+		newAPIRoute(s, "/health", "Get the health of a resource over a time range.", s.health),
+		newAPIRoute(s, "/resources", "List the selected resources, along with their current health.", s.resources),
+		newAPIRoute(s, "/endpoints", "Get the health of each endpoint of the selected resources over a time range.", s.endpoints),
+		newAPIRoute(s, "/records", "List the raw records of the selected resources, a page at a time.", s.records),
+		newAPIRoute(s, "/compare", "Compare the health of the selected resources over two time ranges.", s.compare),
+	}
+}
+
+// health serves HealthRequests.
+func (s *apiServer) health(ctx context.Context, request *HealthRequest) (*HealthResponse, *APIError) {
+	namespace, name, err := splitKey(request.Key)
+	if err != nil {
+		return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: "key"}
+	}
+
+	// Gather the health buffer for the given time-intervals, from the controller's cache.
+	resource, apiErr := s.resource(ctx, namespace, name)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	healthBuffer, err := s.history.History(ctx, resource, request.From, request.To)
+	if err != nil {
+		return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting history: %v", err)}
+	}
+
+	// Detect anomalies in the health buffer.
+	unhealthyRecords, healthyRecords, healthScore := EvaluateBuckets(healthBuffer)
+
+	from, to := request.bounds()
+	return &HealthResponse{
+		Namespace:        namespace,
+		Name:             name,
+		From:             from,
+		To:               to,
+		HealthScore:      healthScore,
+		HealthyRecords:   healthyRecords,
+		UnhealthyRecords: unhealthyRecords,
+	}, nil
+}
+
+// resource gets the resource from the controller's cache, if the user of the request can get it.
+func (s *apiServer) resource(ctx context.Context, namespace, name string) (*v1alpha1.MetricsAnomalyDetectorResource, *APIError) {
+	if apiErr := s.authorizeNamespace(ctx, namespace); apiErr != nil {
+		return nil, apiErr
+	}
+	resource, err := s.lister.MetricsAnomalyDetectorResources(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, &APIError{Code: ErrorCodeNotFound, Message: fmt.Sprintf("resource %s/%s not found", namespace, name)}
+		}
+		return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting resource: %v", err)}
+	}
+
+	return resource, nil
+}
+
+// splitKey splits a resource key into its namespace and name.
+func splitKey(key string) (string, string, error) {
+	keyParts := strings.Split(key, "/")
+	if len(keyParts) != 2 || keyParts[0] == "" || keyParts[1] == "" {
+		return "", "", fmt.Errorf("invalid key %q, expected namespace/name", key)
+	}
+
+	return keyParts[0], keyParts[1], nil
+}
+
+// decodeRequest decodes the query parameters into the request, and resolves it.
+func decodeRequest(values url.Values, request interface{}) *APIError {
+	if err := decodeQuery(values, request); err != nil {
+		return err
+	}
+	if resolved, ok := request.(resolvedRequest); ok {
+		return resolved.resolve(time.Now())
+	}
+
+	return nil
+}
+
+// decodeQuery decodes the query parameters into the fields of the request they are bound to.
+func decodeQuery(values url.Values, request interface{}) *APIError {
+	v := reflect.ValueOf(request).Elem()
+	for _, field := range queryFields(v.Type()) {
+		parameter := field.Tag.Get("query")
+		raw := values.Get(parameter)
+		if raw == "" {
+			if field.Tag.Get("required") == "true" {
+				return &APIError{Code: ErrorCodeInvalidParameter, Message: "missing parameter", Parameter: parameter}
+			}
+			continue
+		}
+		var err error
+		switch target := v.FieldByIndex(field.Index).Addr().Interface().(type) {
+		case *string:
+			*target = raw
+		case *int:
+			*target, err = strconv.Atoi(raw)
+		case *bool:
+			*target, err = strconv.ParseBool(raw)
+		case **bool:
+			var parsed bool
+			parsed, err = strconv.ParseBool(raw)
+			*target = &parsed
+		case *time.Time:
+			*target, err = parseTimestamp(raw)
+		case *model.Duration:
+			*target, err = model.ParseDuration(raw)
+			if err == nil && *target <= 0 {
+				err = fmt.Errorf("duration must be positive")
+			}
+		default:
+			return &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("unsupported parameter type %s", field.Type)}
+		}
+		if err != nil {
+			return &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: parameter}
+		}
+	}
+
+	return nil
+}
+
+// Timestamps in Unix seconds must lie within the years RFC3339 can represent, like the ones in RFC3339 format, as
+// times are written back in it.
+var (
+	minUnixTimestamp = float64(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	maxUnixTimestamp = float64(time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+)
+
+// parseTimestamp parses a timestamp in RFC3339 format, or in Unix seconds, possibly fractional.
+func parseTimestamp(raw string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		if math.IsNaN(seconds) || seconds < minUnixTimestamp || seconds >= maxUnixTimestamp {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q, expected a finite number of Unix seconds within the years 0 to 9999", raw)
+		}
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(fraction*1e9))).UTC(), nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC3339, or Unix seconds", raw)
+	}
+
+	return timestamp, nil
+}
+
+// queryFields returns the fields of the request type that are bound to query parameters, including the ones of
+// embedded structs.
+func queryFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.Anonymous && field.Tag.Get("query") != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// writeJSON writes the value as JSON, with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error in an ErrorResponse envelope.
+func writeError(w http.ResponseWriter, err *APIError) {
+	status, ok := errorCodeStatuses[err.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, ErrorResponse{Error: *err})
+}
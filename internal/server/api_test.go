@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// fakeHistory serves the records of each resource, by key, as raw records, and buckets of their own.
+type fakeHistory map[string][]v1alpha1.HealthcheckRecord
+
+// History implements HistoryReader.
+func (h fakeHistory) History(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error) {
+	records, _ := h.Records(ctx, resource, from, to)
+	buckets := make([]v1alpha1.HealthcheckBucket, 0, len(records))
+	for _, record := range records {
+		buckets = append(buckets, record.Bucket())
+	}
+
+	return buckets, nil
+}
+
+// Records implements HistoryReader.
+func (h fakeHistory) Records(_ context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error) {
+	var records []v1alpha1.HealthcheckRecord
+	for _, record := range h[resource.GetNamespace()+"/"+resource.GetName()] {
+		if !record.Timestamp.Time.Before(from) && (to.IsZero() || record.Timestamp.Time.Before(to)) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// newRecord creates a record of the endpoint at the given time.
+func newRecord(timestamp time.Time, endpoint string, healthy bool) v1alpha1.HealthcheckRecord {
+	return v1alpha1.HealthcheckRecord{Timestamp: &metav1.Time{Time: timestamp}, Endpoint: endpoint, Healthy: &healthy}
+}
+
+// localRouter owns every resource.
+type localRouter struct{}
+
+// OwnerAddress implements ShardRouter.
+func (localRouter) OwnerAddress(_, _ string) string {
+	return ""
+}
+
+// newTestServer creates a server watching the given resources, whose history is made up of the given records.
+func newTestServer(t *testing.T, history fakeHistory, resources ...*v1alpha1.MetricsAnomalyDetectorResource) http.Handler {
+	t.Helper()
+
+	return newTestAPIServer(t, history, resources...).handler(nil)
+}
+
+// newTestAPIServer is newTestServer, returning the server itself.
+func newTestAPIServer(t *testing.T, history fakeHistory, resources ...*v1alpha1.MetricsAnomalyDetectorResource) *apiServer {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, resource := range resources {
+		if err := indexer.Add(resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &apiServer{
+		lister:         listers.NewMetricsAnomalyDetectorResourceLister(indexer),
+		history:        history,
+		router:         localRouter{},
+		addressLimiter: newCallerLimiter(rate.Inf, 0),
+		userLimiter:    newCallerLimiter(rate.Inf, 0),
+		logger:         klog.Background(),
+	}
+}
+
+// get sends a GET request to the handler, and decodes the JSON response into v.
+func get(t *testing.T, handler http.Handler, target string, v interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected a JSON response for %s, got %q", target, contentType)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("Error decoding the response for %s: %v", target, err)
+	}
+
+	return recorder.Code
+}
+
+func TestAPI(t *testing.T) {
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler := newTestServer(t, fakeHistory{"default/foo": {
+		newRecord(start.Add(time.Hour), "a", true),
+		newRecord(start.Add(2*time.Hour), "a", false),
+		newRecord(start.Add(3*time.Hour), "a", true),
+		newRecord(start.Add(48*time.Hour), "a", true),
+		newRecord(start.Add(4*time.Hour), "a", true),
+	}}, resource)
+
+	// Health should be computed over the history.
+	var health HealthResponse
+	if code := get(t, handler, APIPrefix+"/health?key=default/foo&ts_a=2024-01-01T00:00:00Z&ts_b=2024-01-02T00:00:00Z", &health); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	if health.Namespace != "default" || health.Name != "foo" || health.HealthyRecords != 3 || health.UnhealthyRecords != 1 || health.HealthScore != 0.75 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	// Errors should be enveloped, and carry their codes.
+	for target, want := range map[string]APIError{
+		APIPrefix + "/health?ts_a=2024-01-01T00:00:00Z&ts_b=2024-01-02T00:00:00Z":                 {Code: ErrorCodeInvalidParameter, Parameter: "key"},
+		APIPrefix + "/health?key=foo&ts_a=2024-01-01T00:00:00Z&ts_b=2024-01-02T00:00:00Z":         {Code: ErrorCodeInvalidParameter, Parameter: "key"},
+		APIPrefix + "/health?key=default/foo&ts_a=yesterday&ts_b=2024-01-02T00:00:00Z":            {Code: ErrorCodeInvalidParameter, Parameter: "ts_a"},
+		APIPrefix + "/health?key=default/bar&ts_a=2024-01-01T00:00:00Z&ts_b=2024-01-02T00:00:00Z": {Code: ErrorCodeNotFound},
+		APIPrefix + "/unknown": {Code: ErrorCodeNotFound},
+	} {
+		var response ErrorResponse
+		code := get(t, handler, target, &response)
+		if response.Error.Code != want.Code || response.Error.Parameter != want.Parameter || response.Error.Message == "" {
+			t.Errorf("Expected %+v for %s, got %+v", want, target, response.Error)
+		}
+		if code != errorCodeStatuses[want.Code] {
+			t.Errorf("Expected %d for %s, got %d", errorCodeStatuses[want.Code], target, code)
+		}
+	}
+
+	// The compatibility endpoint should keep its response body.
+	var legacy map[string]interface{}
+	if code := get(t, handler, "/compute_health?key=default/foo&ts_a=2024-01-01T00:00:00Z&ts_b=2024-01-02T00:00:00Z", &legacy); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	if legacy["health_score"] != 0.75 || legacy["healthy_records"] != float64(3) || legacy["unhealthy_records"] != float64(1) {
+		t.Errorf("Unexpected response %v", legacy)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]struct {
+			Get struct {
+				Parameters []struct {
+					Name     string `json:"name"`
+					Required bool   `json:"required"`
+				} `json:"parameters"`
+				Responses map[string]struct {
+					Content map[string]struct {
+						Schema map[string]interface{} `json:"schema"`
+					} `json:"content"`
+				} `json:"responses"`
+			} `json:"get"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+				Required   []string                          `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if code := get(t, newTestServer(t, nil), "/openapi.json", &document); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	if document.OpenAPI != openAPIVersion {
+		t.Errorf("Expected OpenAPI %s, got %q", openAPIVersion, document.OpenAPI)
+	}
+
+	// Every route should be described, along with its parameters, and responses.
+	for _, route := range (&apiServer{}).routes() {
+		path, ok := document.Paths[APIPrefix+route.path]
+		if !ok {
+			t.Errorf("Expected %s to be described", route.path)
+			continue
+		}
+		if fields := queryFields(route.request); len(path.Get.Parameters) != len(fields) {
+			t.Errorf("Expected %d parameters for %s, got %d", len(fields), route.path, len(path.Get.Parameters))
+		}
+		if ref := path.Get.Responses["200"].Content["application/json"].Schema["$ref"]; ref != "#/components/schemas/"+route.response.Name() {
+			t.Errorf("Expected %s to respond with %s, got %v", route.path, route.response.Name(), ref)
+		}
+		if ref := path.Get.Responses["default"].Content["application/json"].Schema["$ref"]; ref != "#/components/schemas/ErrorResponse" {
+			t.Errorf("Expected %s to fail with ErrorResponse, got %v", route.path, ref)
+		}
+	}
+
+	// Schemas should be generated from the API types.
+	health := document.Components.Schemas["HealthResponse"]
+	if score := health.Properties["healthScore"]; score["type"] != "number" || score["description"] == "" {
+		t.Errorf("Unexpected healthScore schema %v", score)
+	}
+	if from := health.Properties["from"]; from["format"] != "date-time" {
+		t.Errorf("Unexpected from schema %v", from)
+	}
+	apiError := document.Components.Schemas["APIError"]
+	if len(apiError.Required) != 2 {
+		t.Errorf("Expected only code, and message to be required, got %v", apiError.Required)
+	}
+	if enum, ok := apiError.Properties["code"]["enum"].([]interface{}); !ok || len(enum) != len(errorCodeStatuses) {
+		t.Errorf("Expected every error code to be enumerated, got %v", apiError.Properties["code"]["enum"])
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for query, want := range map[string]struct {
+		from, to  time.Time
+		parameter string
+	}{
+		"":                                    {},
+		"ts_a=2024-01-01T10:00:00Z":           {from: now.Add(-2 * time.Hour)},
+		"ts_b=1704103200":                     {to: now.Add(-2 * time.Hour)},
+		"ts_a=1704103200.5&ts_b=1704110400":   {from: now.Add(-2*time.Hour + 500*time.Millisecond), to: now},
+		"window=1h":                           {from: now.Add(-time.Hour), to: now},
+		"window=1d&ts_b=2024-01-01T10:00:00Z": {from: now.Add(-26 * time.Hour), to: now.Add(-2 * time.Hour)},
+		"since=30m":                           {from: now.Add(-30 * time.Minute)},
+		"since=30m&window=1h":                 {parameter: "since"},
+		"window=1h&ts_a=2024-01-01T10:00:00Z": {parameter: "window"},
+		"window=-1h":                          {parameter: "window"},
+		"window=0s":                           {parameter: "window"},
+		"ts_a=2024-01-01T10:00:00Z&ts_b=1704103200": {parameter: "ts_b"},
+		"ts_a=today": {parameter: "ts_a"},
+		"ts_a=NaN":   {parameter: "ts_a"},
+		"ts_a=-Inf":  {parameter: "ts_a"},
+		"ts_b=+Inf":  {parameter: "ts_b"},
+		"ts_b=1e300": {parameter: "ts_b"},
+	} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var timeRange TimeRange
+		apiErr := decodeQuery(values, &timeRange)
+		if apiErr == nil {
+			apiErr = timeRange.resolve(now)
+		}
+		if want.parameter != "" {
+			if apiErr == nil || apiErr.Parameter != want.parameter {
+				t.Errorf("Expected an invalid %s for %q, got %v", want.parameter, query, apiErr)
+			}
+			continue
+		}
+		if apiErr != nil {
+			t.Errorf("Expected %q to be valid, got %v", query, apiErr)
+			continue
+		}
+		if !timeRange.From.Equal(want.from) || !timeRange.To.Equal(want.to) {
+			t.Errorf("Expected [%s, %s) for %q, got [%s, %s)", want.from, want.to, query, timeRange.From, timeRange.To)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+
+	// authCacheTTL is the duration for which the outcomes of token, and access reviews are cached, so that requests do
+	// not each cost a review. This is the default of the delegated authentication, and authorization of the
+	// Kubernetes components.
+	authCacheTTL = 10 * time.Second
+
+	// authCacheSize is the number of outcomes cached, for each kind of review.
+	authCacheSize = 4096
+
+	// resourcesResource is the resource callers are authorized against, in the namespaces of the resources they query.
+	resourcesResource = "metricsanomalydetectorresources"
+)
+
+// Authorizer authenticates the callers of the server by their bearer tokens, through TokenReviews, and authorizes them
+// through SubjectAccessReviews, so they can only query the resources in the namespaces they can get them in.
+type Authorizer struct {
+
+	// client creates the reviews.
+	client kubernetes.Interface
+
+	// users caches the users the reviewed tokens belong to, by token digest, or nil for tokens that were rejected.
+	users *cache.LRUExpireCache
+
+	// decisions caches the outcomes of the access reviews, by their encoded spec.
+	decisions *cache.LRUExpireCache
+}
+
+// NewAuthorizer creates a new Authorizer, which reviews tokens, and accesses through the client.
+func NewAuthorizer(client kubernetes.Interface) *Authorizer {
+	return &Authorizer{
+		client:    client,
+		users:     cache.NewLRUExpireCache(authCacheSize),
+		decisions: cache.NewLRUExpireCache(authCacheSize),
+	}
+}
+
+// userContextKey is the context key of the authenticated user of a request.
+type userContextKey struct{}
+
+// authenticate returns the user the token belongs to, or nil if it was rejected.
+func (a *Authorizer) authenticate(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	digest := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(digest[:])
+	if user, ok := a.users.Get(key); ok {
+		return user.(*authenticationv1.UserInfo), nil
+	}
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reviewing token: %w", err)
+	}
+	var user *authenticationv1.UserInfo
+	if review.Status.Authenticated {
+		user = &review.Status.User
+	}
+	a.users.Add(key, user, authCacheTTL)
+
+	return user, nil
+}
+
+// allowed returns whether the user is allowed the access described by the attributes.
+func (a *Authorizer) allowed(ctx context.Context, user *authenticationv1.UserInfo, resourceAttributes *authorizationv1.ResourceAttributes, nonResourceAttributes *authorizationv1.NonResourceAttributes) (bool, error) {
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		ResourceAttributes:    resourceAttributes,
+		NonResourceAttributes: nonResourceAttributes,
+		User:                  user.Username,
+		Groups:                user.Groups,
+		UID:                   user.UID,
+	}
+	if len(user.Extra) > 0 {
+		spec.Extra = make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for k, v := range user.Extra {
+			spec.Extra[k] = authorizationv1.ExtraValue(v)
+		}
+	}
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return false, fmt.Errorf("error encoding access review: %w", err)
+	}
+	key := string(encoded)
+	if allowed, ok := a.decisions.Get(key); ok {
+		return allowed.(bool), nil
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{Spec: spec}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error reviewing access: %w", err)
+	}
+	a.decisions.Add(key, review.Status.Allowed, authCacheTTL)
+
+	return review.Status.Allowed, nil
+}
+
+// authenticated rejects the requests without a valid bearer token, and passes the user the token belongs to on to the
+// next handler, through the request's context. All requests are passed on if authentication is disabled.
+func (s *apiServer) authenticated(next http.Handler) http.Handler {
+	if s.authorizer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mad"`)
+			writeError(w, &APIError{Code: ErrorCodeUnauthorized, Message: "a bearer token is required"})
+			return
+		}
+		user, err := s.authorizer.authenticate(r.Context(), strings.TrimSpace(token))
+		if err != nil {
+			s.logger.Error(err, "Error authenticating request", "remoteAddr", r.RemoteAddr)
+			writeError(w, &APIError{Code: ErrorCodeInternal, Message: "error authenticating request"})
+			return
+		}
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mad", error="invalid_token"`)
+			writeError(w, &APIError{Code: ErrorCodeUnauthorized, Message: "invalid bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// authorizedPath rejects the requests of users that cannot get the path, e.g., as granted to Prometheus for /metrics,
+// through the nonResourceURLs of a ClusterRole. All requests are passed on if authentication is disabled.
+func (s *apiServer) authorizedPath(next http.Handler) http.Handler {
+	if s.authorizer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value(userContextKey{}).(*authenticationv1.UserInfo)
+		if user == nil {
+			writeError(w, &APIError{Code: ErrorCodeUnauthorized, Message: "a bearer token is required"})
+			return
+		}
+		allowed, err := s.authorizer.allowed(r.Context(), user, nil, &authorizationv1.NonResourceAttributes{Path: r.URL.Path, Verb: "get"})
+		if err != nil {
+			s.logger.Error(err, "Error authorizing request", "user", user.Username, "path", r.URL.Path)
+			writeError(w, &APIError{Code: ErrorCodeInternal, Message: "error authorizing request"})
+			return
+		}
+		if !allowed {
+			writeError(w, &APIError{Code: ErrorCodeForbidden, Message: fmt.Sprintf("user %q cannot get path %q", user.Username, r.URL.Path)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize returns whether the user of the request can get the resources in the namespace, or in all namespaces,
+// given an empty one. All users can if authentication is disabled.
+func (s *apiServer) authorize(ctx context.Context, namespace string) (bool, *APIError) {
+	if s.authorizer == nil {
+		return true, nil
+	}
+	user, _ := ctx.Value(userContextKey{}).(*authenticationv1.UserInfo)
+	if user == nil {
+		return false, &APIError{Code: ErrorCodeUnauthorized, Message: "a bearer token is required"}
+	}
+	allowed, err := s.authorizer.allowed(ctx, user, &authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      "get",
+		Group:     mad.GroupName,
+		Version:   v1alpha1.SchemeGroupVersion.Version,
+		Resource:  resourcesResource,
+	}, nil)
+	if err != nil {
+		s.logger.Error(err, "Error authorizing request", "user", user.Username, "namespace", namespace)
+		return false, &APIError{Code: ErrorCodeInternal, Message: "error authorizing request"}
+	}
+
+	return allowed, nil
+}
+
+// authorizeNamespace rejects the requests of users that cannot get the resources in the namespace.
+func (s *apiServer) authorizeNamespace(ctx context.Context, namespace string) *APIError {
+	allowed, apiErr := s.authorize(ctx, namespace)
+	if apiErr != nil {
+		return apiErr
+	}
+	if !allowed {
+		return &APIError{Code: ErrorCodeForbidden, Message: fmt.Sprintf("cannot get %s in namespace %q", resourcesResource, namespace)}
+	}
+
+	return nil
+}
+
+// authorizedResources returns the resources in the namespaces the user of the request can get them in, in order.
+// Users that can get them in all namespaces are authorized through a single review.
+func (s *apiServer) authorizedResources(ctx context.Context, resources []*v1alpha1.MetricsAnomalyDetectorResource) ([]*v1alpha1.MetricsAnomalyDetectorResource, *APIError) {
+	allowed, apiErr := s.authorize(ctx, metav1.NamespaceAll)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if allowed {
+		return resources, nil
+	}
+	namespaces := map[string]bool{}
+	authorized := make([]*v1alpha1.MetricsAnomalyDetectorResource, 0, len(resources))
+	for _, resource := range resources {
+		namespace := resource.GetNamespace()
+		if _, ok := namespaces[namespace]; !ok {
+			if namespaces[namespace], apiErr = s.authorize(ctx, namespace); apiErr != nil {
+				return nil, apiErr
+			}
+		}
+		if namespaces[namespace] {
+			authorized = append(authorized, resource)
+		}
+	}
+
+	return authorized, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// authorizedGet sends a GET request to the handler with the bearer token, if any, and decodes the JSON response into v.
+func authorizedGet(t *testing.T, handler http.Handler, target, token string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	handler.ServeHTTP(recorder, request)
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatalf("Error decoding the response for %s: %v", target, err)
+		}
+	}
+
+	return recorder
+}
+
+func TestAuth(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestAPIServer(t, fakeHistory{
+		"default/foo": {newRecord(start, "a", true)},
+		"other/bar":   {newRecord(start, "a", false)},
+	},
+		&v1alpha1.MetricsAnomalyDetectorResource{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{HealthcheckEndpoints: []string{"a"}},
+		},
+		&v1alpha1.MetricsAnomalyDetectorResource{
+			ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "other"},
+			Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{HealthcheckEndpoints: []string{"a"}},
+		},
+	)
+
+	// Review tokens, and accesses against fixed users, and the namespaces, or paths they can get.
+	users := map[string]string{"alice-token": "alice", "admin-token": "admin", "prometheus-token": "prometheus"}
+	grants := map[string][]string{"alice": {"default"}, "admin": {""}, "prometheus": {"/metrics"}}
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		username, ok := users[review.Spec.Token]
+		review.Status = authenticationv1.TokenReviewStatus{Authenticated: ok, User: authenticationv1.UserInfo{Username: username}}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		var granted string
+		if attributes := review.Spec.ResourceAttributes; attributes != nil {
+			if attributes.Verb != "get" || attributes.Resource != resourcesResource {
+				t.Errorf("Unexpected resource attributes %+v", attributes)
+			}
+			granted = attributes.Namespace
+		} else {
+			granted = review.Spec.NonResourceAttributes.Path
+		}
+		review.Status.Allowed = slices.Contains(grants[review.Spec.User], granted)
+		return true, review, nil
+	})
+	s.authorizer = NewAuthorizer(client)
+	handler := s.handler(map[string]http.Handler{"/metrics": http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{})
+	})})
+	health := APIPrefix + "/health?key="
+
+	// Requests without a valid token should be rejected.
+	for _, token := range []string{"", "unknown-token"} {
+		var response ErrorResponse
+		recorder := authorizedGet(t, handler, health+"default/foo", token, &response)
+		if recorder.Code != http.StatusUnauthorized || response.Error.Code != ErrorCodeUnauthorized || recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected %d, and a challenge for token %q, got %d, and %+v", http.StatusUnauthorized, token, recorder.Code, response.Error)
+		}
+	}
+
+	// Resources should only be served in the namespaces the user can get them in.
+	for target, want := range map[string]int{
+		health + "default/foo":                    http.StatusOK,
+		health + "other/bar":                      http.StatusForbidden,
+		health + "other/unknown":                  http.StatusForbidden,
+		"/compute_health?key=other/bar":           http.StatusForbidden,
+		APIPrefix + "/resources?namespace=other":  http.StatusForbidden,
+		APIPrefix + "/resources?namespace=absent": http.StatusForbidden,
+		APIPrefix + "/watch?key=other/bar":        http.StatusForbidden,
+		"/metrics":                                http.StatusForbidden,
+	} {
+		if recorder := authorizedGet(t, handler, target, "alice-token", nil); recorder.Code != want {
+			t.Errorf("Expected %d for %s, got %d", want, target, recorder.Code)
+		}
+	}
+
+	// Listed resources, and series should be filtered down to the namespaces the user can get them in.
+	for token, want := range map[string][]string{"alice-token": {"default"}, "admin-token": {"default", "other"}} {
+		var list ResourceList
+		authorizedGet(t, handler, APIPrefix+"/resources", token, &list)
+		var namespaces []string
+		for _, item := range list.Items {
+			namespaces = append(namespaces, item.Namespace)
+		}
+		if !slices.Equal(namespaces, want) {
+			t.Errorf("Expected resources in %v for %s, got %v", want, token, namespaces)
+		}
+		var values struct {
+			Data []string `json:"data"`
+		}
+		authorizedGet(t, handler, APIPrefix+"/label/namespace/values?start="+url.QueryEscape(start.Add(-time.Minute).Format(time.RFC3339))+"&end="+url.QueryEscape(start.Add(time.Minute).Format(time.RFC3339)), token, &values)
+		if !slices.Equal(values.Data, want) {
+			t.Errorf("Expected series in %v for %s, got %v", want, token, values.Data)
+		}
+	}
+
+	// Debug handlers should be served to the users that can get their paths.
+	if recorder := authorizedGet(t, handler, "/metrics", "prometheus-token", nil); recorder.Code != http.StatusOK {
+		t.Errorf("Expected %d for /metrics, got %d", http.StatusOK, recorder.Code)
+	}
+
+	// The OpenAPI document should be served to anyone, and describe the token.
+	var document map[string]interface{}
+	if recorder := authorizedGet(t, handler, "/openapi.json", "", &document); recorder.Code != http.StatusOK || document["security"] == nil {
+		t.Errorf("Expected a public document requiring a bearer token, got %d, and %v", recorder.Code, document["security"])
+	}
+
+	// Reviews should be cached.
+	reviews := len(client.Actions())
+	authorizedGet(t, handler, health+"default/foo", "alice-token", nil)
+	if len(client.Actions()) != reviews {
+		t.Errorf("Expected cached reviews, got %d more", len(client.Actions())-reviews)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the document conforms to.
+const openAPIVersion = "3.0.3"
+
+// openAPIDocument generates the OpenAPI document describing the routes, from their request, and response types, along
+// with the bearer token they require, if authenticated.
+func openAPIDocument(routes []apiRoute, authenticated bool) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorResponse := map[string]interface{}{
+		"description": "The request failed.",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": openAPISchema(reflect.TypeOf(ErrorResponse{}), schemas)},
+		},
+	}
+
+	// Describe each route.
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		parameters := make([]interface{}, 0)
+		for _, field := range queryFields(route.request) {
+			name := field.Tag.Get("query")
+			parameters = append(parameters, map[string]interface{}{
+				"name":        name,
+				"in":          "query",
+				"required":    field.Tag.Get("required") == "true",
+				"description": field.Tag.Get("description"),
+				"schema":      openAPIParameterSchema(field.Type, schemas),
+			})
+		}
+		paths[APIPrefix+route.path] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"operationId": operationID(route.path),
+				"summary":     route.summary,
+				"parameters":  parameters,
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "The request succeeded.",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{"schema": openAPISchema(route.response, schemas)},
+						},
+					},
+					"default": errorResponse,
+				},
+			},
+		}
+	}
+
+	document := map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Metrics Anomaly Detector API",
+			"version": APIVersion,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+
+	// Require a Kubernetes bearer token, if authenticated.
+	if authenticated {
+		document["components"].(map[string]interface{})["securitySchemes"] = map[string]interface{}{
+			"bearer": map[string]interface{}{
+				"type":        "http",
+				"scheme":      "bearer",
+				"description": "A Kubernetes token, e.g., of a service account, which is reviewed through a TokenReview.",
+			},
+		}
+		document["security"] = []interface{}{map[string]interface{}{"bearer": []interface{}{}}}
+	}
+
+	return document
+}
+
+// openAPISchema returns the schema of the type. Named structs are registered in schemas, and referenced.
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}), reflect.TypeOf(metav1.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(metav1.Duration{}), reflect.TypeOf(time.Duration(0)), reflect.TypeOf(model.Duration(0)):
+		return map[string]interface{}{"type": "string", "description": "A duration, e.g., 1m30s."}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := openAPISchema(t.Elem(), schemas)
+		if _, ok := schema["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		schema := map[string]interface{}{"type": "object"}
+		schemas[t.Name()] = schema
+		properties, required := map[string]interface{}{}, make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" || !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			property := openAPISchema(field.Type, schemas)
+			if _, ok := property["$ref"]; ok {
+				property = map[string]interface{}{"allOf": []interface{}{property}}
+			}
+			if description := field.Tag.Get("description"); description != "" {
+				property["description"] = description
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema["properties"] = properties
+		schema["required"] = required
+		return ref
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// openAPIParameterSchema returns the schema of a query parameter of the type. Timestamps are given in several formats,
+// so they are described as plain strings.
+func openAPIParameterSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string"}
+	}
+
+	return openAPISchema(t, schemas)
+}
+
+// operationID derives the ID of the operation from the path of its route, e.g., getResourcesRecords for
+// /resources/records.
+func operationID(path string) string {
+	id := "get"
+	for _, segment := range strings.Split(path, "/") {
+		segment = strings.Trim(segment, "{}")
+		if segment != "" {
+			id += strings.ToUpper(segment[:1]) + segment[1:]
+		}
+	}
+
+	return id
+}
+
+// openAPIHandler serves the OpenAPI document.
+func openAPIHandler(routes []apiRoute, authenticated bool) http.Handler {
+	document := openAPIDocument(routes, authenticated)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, document)
+	})
+}
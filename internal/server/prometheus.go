@@ -0,0 +1,626 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The routes below implement the subset of the Prometheus HTTP API that Grafana's Prometheus data source relies on,
+// so MAD can be charted without a plugin. They serve synthetic series, computed from the raw records of the watched
+// resources at query time, and only support vector selectors, i.e., a metric name, and label matchers, as queries.
+
+const (
+
+	// promMetricHealthScore is the ratio of healthy records to all records within the lookback window, per endpoint,
+	// and per resource, across all of its endpoints.
+	promMetricHealthScore = "mad_health_score"
+
+	// promMetricProbeUp is whether the latest probe of an endpoint within the lookback window was healthy.
+	promMetricProbeUp = "mad_probe_up"
+
+	// promMetricProbeLatency is the latency of the latest probe of an endpoint within the lookback window.
+	promMetricProbeLatency = "mad_probe_latency_seconds"
+
+	// promDefaultLookback is the window series look back over for records at each evaluation, unless requested
+	// otherwise, as in Prometheus.
+	promDefaultLookback = 5 * time.Minute
+
+	// promMaxPoints is the highest number of points per series of a range query, as in Prometheus.
+	promMaxPoints = 11000
+)
+
+// promLabelNames are the names of the labels of the series, sorted.
+var promLabelNames = []string{model.MetricNameLabel, "endpoint", "name", "namespace", "resource"}
+
+// promMetrics evaluate the series of each metric over the records within the lookback window, oldest first.
+var promMetrics = map[string]func(records []v1alpha1.HealthcheckRecord) (float64, bool){
+	promMetricHealthScore: func(records []v1alpha1.HealthcheckRecord) (float64, bool) {
+		_, _, healthScore := evaluateRecords(records)
+		return healthScore, len(records) > 0
+	},
+	promMetricProbeUp: func(records []v1alpha1.HealthcheckRecord) (float64, bool) {
+		if len(records) == 0 {
+			return 0, false
+		}
+		if healthy := records[len(records)-1].Healthy; healthy != nil && *healthy {
+			return 1, true
+		}
+		return 0, true
+	},
+	promMetricProbeLatency: func(records []v1alpha1.HealthcheckRecord) (float64, bool) {
+		if len(records) == 0 || records[len(records)-1].Latency == nil {
+			return 0, false
+		}
+		return records[len(records)-1].Latency.Seconds(), true
+	},
+}
+
+// promResponse is the envelope of the responses of the Prometheus HTTP API.
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// promQueryData is the result of a query.
+type promQueryData struct {
+	ResultType string       `json:"resultType"`
+	Result     []promSample `json:"result"`
+}
+
+// promSample is a series of a query result, along with its value at the evaluation time for instant queries, or its
+// values at each step for range queries.
+type promSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+// promError is an error of the Prometheus HTTP API.
+type promError struct {
+
+	// errorType is the type of the error, e.g., bad_data.
+	errorType string
+
+	// status is the HTTP status code of the error.
+	status int
+
+	// err is the error.
+	err error
+}
+
+// badData returns a bad_data error.
+func badData(format string, args ...interface{}) *promError {
+	return &promError{errorType: "bad_data", status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+// promMatcher matches the value of a label.
+type promMatcher struct {
+
+	// name is the name of the label.
+	name string
+
+	// matches returns whether the value matches.
+	matches func(value string) bool
+}
+
+// promSeries is a series, along with the records it is evaluated over, oldest first.
+type promSeries struct {
+
+	// labels are the labels of the series.
+	labels map[string]string
+
+	// records are the records of the series.
+	records []v1alpha1.HealthcheckRecord
+}
+
+// prometheusRoutes returns the handlers of the Prometheus HTTP API, by path.
+func (s *apiServer) prometheusRoutes() map[string]http.Handler {
+	return map[string]http.Handler{
+		APIPrefix + "/query":       s.promHandler(s.promQuery),
+		APIPrefix + "/query_range": s.promHandler(s.promQueryRange),
+		APIPrefix + "/series":      s.promHandler(s.promSeries),
+		APIPrefix + "/labels":      s.promHandler(s.promLabels),
+		APIPrefix + "/label/":      s.promHandler(s.promLabelValues),
+	}
+}
+
+// promHandler serves a route of the Prometheus HTTP API, which takes its parameters in either the query, or a form
+// body, and answers in its envelope.
+func (s *apiServer) promHandler(handle func(r *http.Request) (interface{}, *promError)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, promResponse{Status: "error", ErrorType: "bad_data", Error: fmt.Sprintf("method %s is not allowed", r.Method)})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, promResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+			return
+		}
+		data, err := handle(r)
+		if err != nil {
+			writeJSON(w, err.status, promResponse{Status: "error", ErrorType: err.errorType, Error: err.err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, promResponse{Status: "success", Data: data})
+	})
+}
+
+// promQuery evaluates an instant query.
+func (s *apiServer) promQuery(r *http.Request) (interface{}, *promError) {
+	at := time.Now()
+	if raw := r.Form.Get("time"); raw != "" {
+		var err error
+		if at, err = parseTimestamp(raw); err != nil {
+			return nil, badData("invalid time: %v", err)
+		}
+	}
+	lookback, perr := promLookback(r)
+	if perr != nil {
+		return nil, perr
+	}
+	metrics, matchers, perr := parsePromSelector(r.Form.Get("query"))
+	if perr != nil {
+		return nil, perr
+	}
+	series, perr := s.selectPromSeries(r.Context(), metrics, matchers, at.Add(-lookback), at)
+	if perr != nil {
+		return nil, perr
+	}
+
+	// Evaluate each series at the given time.
+	result := make([]promSample, 0, len(series))
+	for _, series := range series {
+		if value, ok := promMetrics[series.labels[model.MetricNameLabel]](recordsInLookback(series.records, at, lookback)); ok {
+			result = append(result, promSample{Metric: series.labels, Value: promPoint(at, value)})
+		}
+	}
+
+	return promQueryData{ResultType: "vector", Result: result}, nil
+}
+
+// promQueryRange evaluates a range query.
+func (s *apiServer) promQueryRange(r *http.Request) (interface{}, *promError) {
+	start, err := parseTimestamp(r.Form.Get("start"))
+	if err != nil {
+		return nil, badData("invalid start: %v", err)
+	}
+	end, err := parseTimestamp(r.Form.Get("end"))
+	if err != nil {
+		return nil, badData("invalid end: %v", err)
+	}
+	if end.Before(start) {
+		return nil, badData("end must not be before start")
+	}
+	step, err := parsePromDuration(r.Form.Get("step"))
+	if err != nil || step <= 0 {
+		return nil, badData("invalid step %q, expected a positive duration", r.Form.Get("step"))
+	}
+	if end.Sub(start)/step > promMaxPoints {
+		return nil, badData("exceeded maximum resolution of %d points per series", promMaxPoints)
+	}
+	lookback, perr := promLookback(r)
+	if perr != nil {
+		return nil, perr
+	}
+	metrics, matchers, perr := parsePromSelector(r.Form.Get("query"))
+	if perr != nil {
+		return nil, perr
+	}
+	series, perr := s.selectPromSeries(r.Context(), metrics, matchers, start.Add(-lookback), end)
+	if perr != nil {
+		return nil, perr
+	}
+
+	// Evaluate each series at every step.
+	result := make([]promSample, 0, len(series))
+	for _, series := range series {
+		evaluate := promMetrics[series.labels[model.MetricNameLabel]]
+		var values [][]interface{}
+		for at := start; !at.After(end); at = at.Add(step) {
+			if value, ok := evaluate(recordsInLookback(series.records, at, lookback)); ok {
+				values = append(values, promPoint(at, value))
+			}
+		}
+		if len(values) > 0 {
+			result = append(result, promSample{Metric: series.labels, Values: values})
+		}
+	}
+
+	return promQueryData{ResultType: "matrix", Result: result}, nil
+}
+
+// promSeries lists the series matching any of the match[] selectors, that have records within the time range.
+func (s *apiServer) promSeries(r *http.Request) (interface{}, *promError) {
+	series, perr := s.matchPromSeries(r)
+	if perr != nil {
+		return nil, perr
+	}
+	data := make([]map[string]string, 0, len(series))
+	for _, series := range series {
+		data = append(data, series.labels)
+	}
+
+	return data, nil
+}
+
+// promLabels lists the names of the labels of the series.
+func (s *apiServer) promLabels(r *http.Request) (interface{}, *promError) {
+	if len(r.Form["match[]"]) == 0 {
+		return promLabelNames, nil
+	}
+	series, perr := s.matchPromSeries(r)
+	if perr != nil {
+		return nil, perr
+	}
+	names := map[string]struct{}{}
+	for _, series := range series {
+		for name := range series.labels {
+			names[name] = struct{}{}
+		}
+	}
+
+	return sortedKeys(names), nil
+}
+
+// promLabelValues lists the values of a label, given in the path, of the series matching any of the match[]
+// selectors, or of all series if there are none.
+func (s *apiServer) promLabelValues(r *http.Request) (interface{}, *promError) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, APIPrefix+"/label/"), "/values")
+	if !ok || !model.LabelName(name).IsValid() {
+		return nil, &promError{errorType: "not_found", status: http.StatusNotFound, err: fmt.Errorf("no route for %s", r.URL.Path)}
+	}
+	if len(r.Form["match[]"]) == 0 {
+		r.Form["match[]"] = []string{"{__name__=~\".+\"}"}
+	}
+	series, perr := s.matchPromSeries(r)
+	if perr != nil {
+		return nil, perr
+	}
+	values := map[string]struct{}{}
+	for _, series := range series {
+		if value, ok := series.labels[name]; ok {
+			values[value] = struct{}{}
+		}
+	}
+
+	return sortedKeys(values), nil
+}
+
+// matchPromSeries returns the series matching any of the match[] selectors, that have records within the time range,
+// which defaults to the lookback window.
+func (s *apiServer) matchPromSeries(r *http.Request) ([]promSeries, *promError) {
+	end := time.Now()
+	if raw := r.Form.Get("end"); raw != "" {
+		var err error
+		if end, err = parseTimestamp(raw); err != nil {
+			return nil, badData("invalid end: %v", err)
+		}
+	}
+	start := end.Add(-promDefaultLookback)
+	if raw := r.Form.Get("start"); raw != "" {
+		var err error
+		if start, err = parseTimestamp(raw); err != nil {
+			return nil, badData("invalid start: %v", err)
+		}
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		return nil, badData("no match[] parameter provided")
+	}
+	seen := map[string]struct{}{}
+	var matched []promSeries
+	for _, selector := range selectors {
+		metrics, matchers, perr := parsePromSelector(selector)
+		if perr != nil {
+			return nil, perr
+		}
+		series, perr := s.selectPromSeries(r.Context(), metrics, matchers, start, end)
+		if perr != nil {
+			return nil, perr
+		}
+		for _, series := range series {
+			if len(recordsWithin(series.records, start, end)) == 0 {
+				continue
+			}
+			key := labels.Set(series.labels).String()
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				matched = append(matched, series)
+			}
+		}
+	}
+
+	return matched, nil
+}
+
+// selectPromSeries returns the series of the given metrics matching all matchers, along with their records within
+// [from, to], ordered by their labels. Only the resources in the namespaces the user of the request can get them in
+// make up series.
+func (s *apiServer) selectPromSeries(ctx context.Context, metrics []string, matchers []promMatcher, from, to time.Time) ([]promSeries, *promError) {
+	resources, err := s.lister.List(labels.Everything())
+	if err != nil {
+		return nil, &promError{errorType: "internal", status: http.StatusInternalServerError, err: fmt.Errorf("error listing resources: %w", err)}
+	}
+	resources, apiErr := s.authorizedResources(ctx, resources)
+	if apiErr != nil {
+		return nil, &promError{errorType: "internal", status: errorCodeStatuses[apiErr.Code], err: apiErr}
+	}
+	var series []promSeries
+	for _, resource := range resources {
+		resourceLabels := map[string]string{
+			"namespace": resource.GetNamespace(),
+			"name":      resource.GetName(),
+			"resource":  resource.GetNamespace() + "/" + resource.GetName(),
+		}
+
+		// Skip the resources whose labels do not match, before reading their records.
+		if !matchPromLabels(resourceLabels, matchers, true) {
+			continue
+		}
+		records, err := s.history.Records(ctx, resource, from, to.Add(time.Nanosecond))
+		if err != nil {
+			return nil, &promError{errorType: "internal", status: http.StatusInternalServerError, err: fmt.Errorf("error getting records of %s: %w", resourceLabels["resource"], err)}
+		}
+
+		// Group the records by endpoint, including the probed endpoints without records.
+		byEndpoint := map[string][]v1alpha1.HealthcheckRecord{}
+		for _, endpoint := range resource.Spec.HealthcheckEndpoints {
+			byEndpoint[endpoint] = nil
+		}
+		for _, record := range records {
+			if record.Endpoint != "" {
+				byEndpoint[record.Endpoint] = append(byEndpoint[record.Endpoint], record)
+			}
+		}
+
+		// Build the series of each metric, per endpoint, and per resource for the health score.
+		for _, metric := range metrics {
+			candidates := make([]promSeries, 0, len(byEndpoint)+1)
+			if metric == promMetricHealthScore {
+				candidates = append(candidates, promSeries{labels: promLabels(metric, resourceLabels, ""), records: records})
+			}
+			for endpoint, endpointRecords := range byEndpoint {
+				candidates = append(candidates, promSeries{labels: promLabels(metric, resourceLabels, endpoint), records: endpointRecords})
+			}
+			for _, candidate := range candidates {
+				if matchPromLabels(candidate.labels, matchers, false) {
+					series = append(series, candidate)
+				}
+			}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Set(series[i].labels).String() < labels.Set(series[j].labels).String()
+	})
+
+	return series, nil
+}
+
+// promLabels returns the labels of the series of the metric for the resource, and endpoint, if any.
+func promLabels(metric string, resourceLabels map[string]string, endpoint string) map[string]string {
+	seriesLabels := map[string]string{model.MetricNameLabel: metric}
+	for name, value := range resourceLabels {
+		seriesLabels[name] = value
+	}
+	if endpoint != "" {
+		seriesLabels["endpoint"] = endpoint
+	}
+
+	return seriesLabels
+}
+
+// matchPromLabels returns whether the labels match all matchers. Missing labels match as empty values, as in
+// Prometheus, unless partial is set, in which case matchers of missing labels are skipped.
+func matchPromLabels(seriesLabels map[string]string, matchers []promMatcher, partial bool) bool {
+	for _, matcher := range matchers {
+		value, ok := seriesLabels[matcher.name]
+		if !ok && partial {
+			continue
+		}
+		if !matcher.matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parsePromSelector parses a vector selector, i.e., an optional metric name, followed by optional label matchers
+// within braces, into the metrics it selects, and the matchers of the other labels.
+func parsePromSelector(query string) ([]string, []promMatcher, *promError) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil, badData("empty query")
+	}
+	unsupported := badData("unsupported query %q, only vector selectors, e.g., %s{resource=\"default/foo\"}, are supported", query, promMetricProbeUp)
+
+	// Split the metric name off the matchers.
+	name, rest := query, ""
+	if i := strings.IndexByte(query, '{'); i >= 0 {
+		if !strings.HasSuffix(query, "}") {
+			return nil, nil, unsupported
+		}
+		name, rest = strings.TrimSpace(query[:i]), query[i+1:len(query)-1]
+	}
+	if name != "" && !model.IsValidMetricName(model.LabelValue(name)) {
+		return nil, nil, unsupported
+	}
+
+	// Parse the matchers, one at a time.
+	var matchers []promMatcher
+	nameMatchers := []promMatcher{}
+	if name != "" {
+		nameMatchers = append(nameMatchers, promMatcher{name: model.MetricNameLabel, matches: func(value string) bool { return value == name }})
+	}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ",")) {
+		matcher, remaining, err := parsePromMatcher(rest)
+		if err != nil {
+			return nil, nil, badData("invalid matcher in %q: %v", query, err)
+		}
+		rest = remaining
+		if matcher.name == model.MetricNameLabel {
+			nameMatchers = append(nameMatchers, matcher)
+		} else {
+			matchers = append(matchers, matcher)
+		}
+	}
+	if len(nameMatchers) == 0 && len(matchers) == 0 {
+		return nil, nil, badData("vector selector must contain at least one matcher")
+	}
+
+	// Select the metrics matching all metric name matchers.
+	var metrics []string
+	for metric := range promMetrics {
+		if matchPromLabels(map[string]string{model.MetricNameLabel: metric}, nameMatchers, false) {
+			metrics = append(metrics, metric)
+		}
+	}
+	sort.Strings(metrics)
+
+	return metrics, matchers, nil
+}
+
+// parsePromMatcher parses the label matcher the input starts with, and returns the remaining input.
+func parsePromMatcher(input string) (promMatcher, string, error) {
+	i := 0
+	for i < len(input) && (input[i] == '_' || input[i] >= 'a' && input[i] <= 'z' || input[i] >= 'A' && input[i] <= 'Z' || i > 0 && input[i] >= '0' && input[i] <= '9') {
+		i++
+	}
+	name := input[:i]
+	if name == "" {
+		return promMatcher{}, "", fmt.Errorf("expected a label name at %q", input)
+	}
+	rest := strings.TrimSpace(input[i:])
+	var op string
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return promMatcher{}, "", fmt.Errorf("expected a matching operator after %q", name)
+	}
+	value, rest, err := parsePromString(strings.TrimSpace(rest[len(op):]))
+	if err != nil {
+		return promMatcher{}, "", err
+	}
+	matcher := promMatcher{name: name}
+	switch op {
+	case "=":
+		matcher.matches = func(v string) bool { return v == value }
+	case "!=":
+		matcher.matches = func(v string) bool { return v != value }
+	default:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return promMatcher{}, "", err
+		}
+		matcher.matches = func(v string) bool { return re.MatchString(v) == (op == "=~") }
+	}
+
+	return matcher, rest, nil
+}
+
+// parsePromString parses the quoted string the input starts with, and returns the remaining input.
+func parsePromString(input string) (string, string, error) {
+	if input == "" || input[0] != '"' && input[0] != '\'' && input[0] != '`' {
+		return "", "", fmt.Errorf("expected a quoted string at %q", input)
+	}
+	quote := input[0]
+	for i := 1; i < len(input); i++ {
+		switch {
+		case input[i] == '\\' && quote != '`':
+			i++
+		case input[i] == quote:
+			raw := input[:i+1]
+			if quote == '\'' {
+				raw = `"` + strings.ReplaceAll(strings.ReplaceAll(raw[1:i], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s: %w", input[:i+1], err)
+			}
+			return value, input[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string %q", input)
+}
+
+// promLookback returns the lookback window of the request.
+func promLookback(r *http.Request) (time.Duration, *promError) {
+	raw := r.Form.Get("lookback_delta")
+	if raw == "" {
+		return promDefaultLookback, nil
+	}
+	lookback, err := parsePromDuration(raw)
+	if err != nil || lookback <= 0 {
+		return 0, badData("invalid lookback_delta %q, expected a positive duration", raw)
+	}
+
+	return lookback, nil
+}
+
+// parsePromDuration parses a duration, e.g., 1m, or a number of seconds, possibly fractional.
+func parsePromDuration(raw string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, fmt.Errorf("invalid duration %q", raw)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	duration, err := model.ParseDuration(raw)
+
+	return time.Duration(duration), err
+}
+
+// recordsInLookback returns the records within (at - lookback, at], as in Prometheus.
+func recordsInLookback(records []v1alpha1.HealthcheckRecord, at time.Time, lookback time.Duration) []v1alpha1.HealthcheckRecord {
+	from := sort.Search(len(records), func(i int) bool {
+		return recordTime(records[i]).After(at.Add(-lookback))
+	})
+	to := sort.Search(len(records), func(i int) bool {
+		return recordTime(records[i]).After(at)
+	})
+	if to < from {
+		return nil
+	}
+
+	return records[from:to]
+}
+
+// recordsWithin returns the records within [from, to].
+func recordsWithin(records []v1alpha1.HealthcheckRecord, from, to time.Time) []v1alpha1.HealthcheckRecord {
+	return recordsInLookback(records, to, to.Sub(from)+time.Nanosecond)
+}
+
+// promPoint returns the point of a sample, in the format of the Prometheus HTTP API.
+func promPoint(at time.Time, value float64) []interface{} {
+	return []interface{}{float64(at.UnixMilli()) / 1000, strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+// sortedKeys returns the keys of the set, sorted.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
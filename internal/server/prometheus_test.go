@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrometheusAPI(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	latency := func(record v1alpha1.HealthcheckRecord, latency time.Duration) v1alpha1.HealthcheckRecord {
+		record.Latency = &metav1.Duration{Duration: latency}
+		return record
+	}
+	handler := newTestServer(t, fakeHistory{
+		"default/foo": {
+			latency(newRecord(start.Add(1*time.Minute), "a", true), 100*time.Millisecond),
+			latency(newRecord(start.Add(1*time.Minute), "b", true), 200*time.Millisecond),
+			latency(newRecord(start.Add(2*time.Minute), "a", false), 300*time.Millisecond),
+			latency(newRecord(start.Add(2*time.Minute), "b", true), 400*time.Millisecond),
+		},
+		"other/bar": {
+			newRecord(start.Add(2*time.Minute), "a", false),
+		},
+	},
+		&v1alpha1.MetricsAnomalyDetectorResource{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{HealthcheckEndpoints: []string{"a", "b"}},
+		},
+		&v1alpha1.MetricsAnomalyDetectorResource{
+			ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "other"},
+			Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{HealthcheckEndpoints: []string{"a"}},
+		},
+	)
+	at := func(minutes int) string {
+		return url.QueryEscape(start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339))
+	}
+	type response struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Data      struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+				Values [][]interface{}   `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+
+	// Instant queries should evaluate the selected series over the lookback window.
+	for query, want := range map[string]map[string]string{
+		`mad_health_score{resource="default/foo",endpoint=""}`: {"default/foo/": "0.75"},
+		`mad_health_score{namespace="default"}`:                {"default/foo/": "0.75", "default/foo/a": "0.5", "default/foo/b": "1"},
+		`mad_probe_up{endpoint=~"a|b"}`:                        {"default/foo/a": "0", "default/foo/b": "1", "other/bar/a": "0"},
+		`mad_probe_latency_seconds{name!="bar"}`:               {"default/foo/a": "0.3", "default/foo/b": "0.4"},
+		`{__name__=~"mad_probe_.+",resource='other/bar'}`:      {"other/bar/a": "0"},
+	} {
+		var got response
+		target := "/api/v1/query?query=" + url.QueryEscape(query) + "&time=" + at(3)
+		if code := get(t, handler, target, &got); code != http.StatusOK || got.Status != "success" || got.Data.ResultType != "vector" {
+			t.Fatalf("Expected a vector for %s, got %d (%+v)", query, code, got)
+		}
+		values := map[string]string{}
+		for _, sample := range got.Data.Result {
+			values[sample.Metric["resource"]+"/"+sample.Metric["endpoint"]] = sample.Value[1].(string)
+		}
+		if len(values) != len(want) {
+			t.Errorf("Expected %v for %s, got %v", want, query, values)
+			continue
+		}
+		for endpoint, value := range want {
+			if values[endpoint] != value {
+				t.Errorf("Expected %v for %s, got %v", want, query, values)
+				break
+			}
+		}
+	}
+
+	// Records past the lookback window should be dropped.
+	var stale response
+	get(t, handler, "/api/v1/query?query=mad_probe_up&lookback_delta=30s&time="+at(3), &stale)
+	if len(stale.Data.Result) != 0 {
+		t.Errorf("Expected no samples past the lookback window, got %+v", stale.Data.Result)
+	}
+
+	// Range queries should evaluate the selected series at every step, and accept form bodies.
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader(url.Values{
+		"query": {`mad_probe_up{resource="default/foo",endpoint="a"}`},
+		"start": {start.Format(time.RFC3339)},
+		"end":   {start.Add(3 * time.Minute).Format(time.RFC3339)},
+		"step":  {"60"},
+	}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"values":[[1704067260,"1"],[1704067320,"0"],[1704067380,"0"]]`) {
+		t.Errorf("Unexpected range query response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Series, and labels should be listed.
+	var series struct {
+		Data []map[string]string `json:"data"`
+	}
+	get(t, handler, "/api/v1/series?match[]=mad_probe_up&start="+at(0)+"&end="+at(3), &series)
+	if len(series.Data) != 3 || series.Data[0]["resource"] != "other/bar" || series.Data[2]["endpoint"] != "b" {
+		t.Errorf("Unexpected series %v", series.Data)
+	}
+	var values struct {
+		Data []string `json:"data"`
+	}
+	get(t, handler, "/api/v1/label/__name__/values?start="+at(0)+"&end="+at(3), &values)
+	if strings.Join(values.Data, ",") != "mad_health_score,mad_probe_latency_seconds,mad_probe_up" {
+		t.Errorf("Unexpected metric names %v", values.Data)
+	}
+	get(t, handler, "/api/v1/labels", &values)
+	if len(values.Data) != len(promLabelNames) {
+		t.Errorf("Unexpected label names %v", values.Data)
+	}
+
+	// Unsupported queries, and invalid parameters should be rejected.
+	for _, target := range []string{
+		"/api/v1/query?query=" + url.QueryEscape("rate(mad_probe_up[5m])"),
+		"/api/v1/query?query=" + url.QueryEscape(`mad_probe_up{endpoint~"a"}`),
+		"/api/v1/query?query=" + url.QueryEscape(`{}`),
+		"/api/v1/query?query=mad_probe_up&time=yesterday",
+		"/api/v1/query_range?query=mad_probe_up&start=" + at(0) + "&end=" + at(3) + "&step=0",
+		"/api/v1/query_range?query=mad_probe_up&start=" + at(0) + "&end=" + at(3) + "&step=1ms",
+		"/api/v1/series",
+	} {
+		var got response
+		if code := get(t, handler, target, &got); code != http.StatusBadRequest || got.Status != "error" || got.ErrorType != "bad_data" {
+			t.Errorf("Expected bad_data for %s, got %d (%+v)", target, code, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+
+	// callerLimiterTTL is the duration for which the limiter of a caller is kept after its last request, after which
+	// the caller starts over with a full burst.
+	callerLimiterTTL = 10 * time.Minute
+
+	// callerLimiterSize is the number of callers limiters are kept for. The least recently seen callers start over
+	// with a full burst once more callers are seen.
+	callerLimiterSize = 4096
+)
+
+// callerLimiter limits the rate of the requests of each caller on its own, so that callers, e.g., Grafana dashboards
+// issuing a burst of queries at once, do not exhaust the rate of the others. It is safe for concurrent use.
+type callerLimiter struct {
+
+	// limit, and burst are the rate, and the burst of the requests allowed to each caller.
+	limit rate.Limit
+	burst int
+
+	// mu guards the creation of limiters.
+	mu sync.Mutex
+
+	// limiters caches the limiter of each caller, by caller.
+	limiters *cache.LRUExpireCache
+}
+
+// newCallerLimiter creates a new callerLimiter, allowing each caller the rate, and the burst. Callers are not limited
+// given a rate of rate.Inf.
+func newCallerLimiter(limit rate.Limit, burst int) *callerLimiter {
+	return &callerLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: cache.NewLRUExpireCache(callerLimiterSize),
+	}
+}
+
+// allow returns whether the caller is allowed another request now.
+func (l *callerLimiter) allow(caller string) bool {
+	if l.limit == rate.Inf {
+		return true
+	}
+	l.mu.Lock()
+	limiter, ok := l.limiters.Get(caller)
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+	}
+	l.limiters.Add(caller, limiter, callerLimiterTTL)
+	l.mu.Unlock()
+
+	return limiter.(*rate.Limiter).Allow()
+}
+
+// addressOf returns the IP the request was sent from.
+func addressOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// fromPeer returns whether the request was forwarded by another replica, as verified through the client certificate
+// it presented, against the peer CA. No requests are, unless the server is served over TLS, with a peer CA.
+func (s *apiServer) fromPeer(r *http.Request) bool {
+	return r.Header.Get(forwardedHeader) != "" && s.certificates != nil && s.certificates.verifyPeer(r.TLS)
+}
+
+// addressRateLimited rejects the requests of the IPs exceeding their rate. It is to wrap authenticated, so requests
+// are limited before their tokens are reviewed, e.g., as a caller sends random tokens. Requests forwarded by other
+// replicas are exempt, as they were limited by the replica they were sent to.
+func (s *apiServer) addressRateLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.fromPeer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		address := addressOf(r)
+		if !s.addressLimiter.allow(address) {
+			writeError(w, &APIError{Code: ErrorCodeRateLimited, Message: "rate limit exceeded"})
+			s.logger.V(4).Info("Rate limit exceeded", "remoteAddr", r.RemoteAddr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userRateLimited rejects the requests of the users exceeding their rate. It is to be wrapped by authenticated, so
+// users are limited across the addresses they call from. Requests forwarded by other replicas are exempt, as they were
+// limited by the replica they were sent to, and all requests pass if authentication is disabled.
+func (s *apiServer) userRateLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value(userContextKey{}).(*authenticationv1.UserInfo)
+		if user == nil || s.fromPeer(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.userLimiter.allow(user.Username) {
+			writeError(w, &APIError{Code: ErrorCodeRateLimited, Message: "rate limit exceeded"})
+			s.logger.V(4).Info("Rate limit exceeded", "user", user.Username, "remoteAddr", r.RemoteAddr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2"
+)
+
+func TestRateLimited(t *testing.T) {
+	s := newTestAPIServer(t, fakeHistory{})
+	s.addressLimiter = newCallerLimiter(rate.Every(time.Hour), 2)
+	s.userLimiter = newCallerLimiter(rate.Every(time.Hour), 2)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status = authenticationv1.TokenReviewStatus{Authenticated: review.Spec.Token == "alice-token", User: authenticationv1.UserInfo{Username: "alice"}}
+		return true, review, nil
+	})
+	s.authorizer = NewAuthorizer(client)
+	handler := s.addressRateLimited(s.authenticated(s.userRateLimited(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))))
+	serve := func(remoteAddr, token string, header http.Header, state *tls.ConnectionState) int {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr, request.TLS = remoteAddr, state
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// Callers should be limited by their IPs before their tokens are reviewed.
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if code := serve("10.0.0.1:1234", "random-token-"+string(rune('a'+i)), nil, nil); code != want {
+			t.Errorf("Expected %d for request %d with a random token, got %d", want, i, code)
+		}
+	}
+	if reviews := len(client.Actions()); reviews != 2 {
+		t.Errorf("Expected 2 token reviews, got %d", reviews)
+	}
+
+	// Authenticated callers should be limited by their users, across their addresses.
+	for i, want := range []int{http.StatusOK, http.StatusOK} {
+		if code := serve("10.0.0.2:1234", "alice-token", nil, nil); code != want {
+			t.Errorf("Expected %d for request %d of alice, got %d", want, i, code)
+		}
+	}
+	if code := serve("10.0.0.3:1234", "alice-token", nil, nil); code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d for alice at another address, got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Requests forwarded by other replicas should be exempt, as verified through their client certificates only.
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	peer, err := x509.ParseCertificate(writeCertificate(t, "mad", certFile, keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := x509.ParseCertificate(writeCertificate(t, "other", filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.certificates, err = newCertificateReloader(certFile, keyFile, certFile, "", klog.Background()); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := http.Header{forwardedHeader: {"true"}, "X-Forwarded-For": {"10.0.0.4"}}
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		state  *tls.ConnectionState
+		want   int
+	}{
+		{name: "a peer", header: forwarded, state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}, want: http.StatusOK},
+		{name: "a peer not forwarding", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}, want: http.StatusTooManyRequests},
+		{name: "a client with another certificate", header: forwarded, state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}, want: http.StatusTooManyRequests},
+		{name: "a client without a certificate", header: forwarded, state: &tls.ConnectionState{}, want: http.StatusTooManyRequests},
+	} {
+		if code := serve("10.0.0.3:1234", "alice-token", tc.header, tc.state); code != tc.want {
+			t.Errorf("Expected %d for %s, got %d", tc.want, tc.name, code)
+		}
+	}
+}
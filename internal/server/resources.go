@@ -0,0 +1,460 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+
+	// defaultRecordsLimit is the number of records returned per page, unless requested otherwise.
+	defaultRecordsLimit = 100
+
+	// maxRecordsLimit is the highest number of records returned per page.
+	maxRecordsLimit = 1000
+)
+
+// selectableFields are the fields resources can be selected by, through field selectors.
+var selectableFields = []string{"metadata.name", "metadata.namespace"}
+
+// ResourceSelector selects the resources a request is about. A key selects a single resource, and the request is
+// forwarded to the replica owning it. Resources that do not match every given selector are left out.
+type ResourceSelector struct {
+	Key           string `query:"key" description:"The key of a single resource, in the format namespace/name."`
+	Namespace     string `query:"namespace" description:"The namespace of the resources. Defaults to all namespaces."`
+	LabelSelector string `query:"labelSelector" description:"A label selector the resources must match, e.g., app=foo,tier!=db."`
+	FieldSelector string `query:"fieldSelector" description:"A field selector over metadata.name, and metadata.namespace the resources must match, e.g., metadata.name!=foo."`
+}
+
+// resource implements ownedRequest.
+func (r ResourceSelector) resource() (string, string) {
+	namespace, name, err := splitKey(r.Key)
+	if err != nil {
+		return "", ""
+	}
+
+	return namespace, name
+}
+
+// ResourcesRequest requests the current health of the selected resources.
+type ResourcesRequest struct {
+	ResourceSelector
+}
+
+// ResourceSummary is the current health of a resource, over the raw records retained for it.
+type ResourceSummary struct {
+	Namespace        string            `json:"namespace" description:"The namespace of the resource."`
+	Name             string            `json:"name" description:"The name of the resource."`
+	Labels           map[string]string `json:"labels,omitempty" description:"The labels of the resource."`
+	Endpoints        []string          `json:"endpoints" description:"The endpoints the resource probes."`
+	HealthScore      float64           `json:"healthScore" description:"The ratio of healthy records to all records, or zero if there are none."`
+	HealthyRecords   int               `json:"healthyRecords" description:"The number of healthy records."`
+	UnhealthyRecords int               `json:"unhealthyRecords" description:"The number of unhealthy records."`
+	LastRecordTime   *time.Time        `json:"lastRecordTime,omitempty" description:"The time of the most recent record."`
+	AnomalyDetected  bool              `json:"anomalyDetected" description:"Whether the AnomalyDetected condition of the resource is True."`
+}
+
+// ResourceList is the current health of the selected resources.
+type ResourceList struct {
+	Items []ResourceSummary `json:"items" description:"The selected resources, ordered by namespace, and name."`
+}
+
+// EndpointsRequest requests the health of each endpoint of the selected resources over a time range.
+type EndpointsRequest struct {
+	ResourceSelector
+	TimeRange
+}
+
+// EndpointSummary is the health of an endpoint over a time range.
+type EndpointSummary struct {
+	Endpoint         string     `json:"endpoint" description:"The endpoint."`
+	Healthy          *bool      `json:"healthy,omitempty" description:"Whether the endpoint was healthy in its last probe. Unset if it was not probed yet."`
+	HealthScore      float64    `json:"healthScore" description:"The ratio of healthy records of the endpoint to all of its records within the time range, or zero if there are none."`
+	HealthyRecords   int        `json:"healthyRecords" description:"The number of healthy records of the endpoint within the time range."`
+	UnhealthyRecords int        `json:"unhealthyRecords" description:"The number of unhealthy records of the endpoint within the time range."`
+	LastRecordTime   *time.Time `json:"lastRecordTime,omitempty" description:"The time of the most recent record of the endpoint within the time range."`
+}
+
+// ResourceEndpoints is the health of each endpoint of a resource over a time range.
+type ResourceEndpoints struct {
+	Namespace string            `json:"namespace" description:"The namespace of the resource."`
+	Name      string            `json:"name" description:"The name of the resource."`
+	Endpoints []EndpointSummary `json:"endpoints" description:"The endpoints the resource probes, followed by the ones it no longer probes, but has records of."`
+}
+
+// EndpointList is the health of each endpoint of the selected resources over a time range.
+type EndpointList struct {
+	Items []ResourceEndpoints `json:"items" description:"The selected resources, ordered by namespace, and name."`
+}
+
+// RecordsRequest requests a page of the raw records of the selected resources.
+type RecordsRequest struct {
+	ResourceSelector
+	TimeRange
+	Endpoint string `query:"endpoint" description:"The endpoint of the records."`
+	Healthy  *bool  `query:"healthy" description:"The health of the records."`
+	Limit    int    `query:"limit" description:"The maximum number of records to return, up to 1000. Defaults to 100."`
+	Continue string `query:"continue" description:"The continue token of the previous page. The other parameters must not change between pages."`
+}
+
+// ResourceRecord is a raw record of a resource.
+type ResourceRecord struct {
+	Namespace string                     `json:"namespace" description:"The namespace of the resource."`
+	Name      string                     `json:"name" description:"The name of the resource."`
+	Record    v1alpha1.HealthcheckRecord `json:"record" description:"The record."`
+}
+
+// RecordList is a page of the raw records of the selected resources.
+type RecordList struct {
+	Items    []ResourceRecord `json:"items" description:"The records, ordered by the namespace, and name of their resources, then oldest first."`
+	Continue string           `json:"continue,omitempty" description:"The token to request the next page with. Unset on the last page."`
+}
+
+// CompareRequest requests the health of the selected resources over two time ranges. The first one is given like any
+// other TimeRange, and the second one by its bounds.
+type CompareRequest struct {
+	ResourceSelector
+	TimeRange
+	FromB time.Time `query:"ts_c" required:"true" description:"The start of the second time range, included, in RFC3339 format, or in Unix seconds."`
+	ToB   time.Time `query:"ts_d" required:"true" description:"The end of the second time range, excluded, in RFC3339 format, or in Unix seconds."`
+}
+
+// resolve resolves the first time range, and validates the second one.
+func (r *CompareRequest) resolve(now time.Time) *APIError {
+	if !r.FromB.Before(r.ToB) {
+		return &APIError{Code: ErrorCodeInvalidParameter, Message: "ts_d must be after ts_c", Parameter: "ts_d"}
+	}
+
+	return r.TimeRange.resolve(now)
+}
+
+// RangeHealth is the health of a resource over a time range.
+type RangeHealth struct {
+	From             *time.Time `json:"from,omitempty" description:"The start of the time range, included. Unset if the range is open."`
+	To               *time.Time `json:"to,omitempty" description:"The end of the time range, excluded. Unset if the range is open."`
+	HealthScore      float64    `json:"healthScore" description:"The ratio of healthy records to all records within the time range, or zero if there are none."`
+	HealthyRecords   int        `json:"healthyRecords" description:"The number of healthy records within the time range."`
+	UnhealthyRecords int        `json:"unhealthyRecords" description:"The number of unhealthy records within the time range."`
+}
+
+// ResourceComparison is the health of a resource over two time ranges.
+type ResourceComparison struct {
+	Namespace        string      `json:"namespace" description:"The namespace of the resource."`
+	Name             string      `json:"name" description:"The name of the resource."`
+	A                RangeHealth `json:"a" description:"The health over the first time range."`
+	B                RangeHealth `json:"b" description:"The health over the second time range."`
+	HealthScoreDelta float64     `json:"healthScoreDelta" description:"The health score over the second time range, minus the one over the first."`
+}
+
+// ComparisonList is the health of the selected resources over two time ranges.
+type ComparisonList struct {
+	Items []ResourceComparison `json:"items" description:"The selected resources, ordered by namespace, and name."`
+}
+
+// resources serves ResourcesRequests.
+func (s *apiServer) resources(ctx context.Context, request *ResourcesRequest) (*ResourceList, *APIError) {
+	resources, apiErr := s.selectResources(ctx, request.ResourceSelector)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	list := &ResourceList{Items: make([]ResourceSummary, 0, len(resources))}
+	for _, resource := range resources {
+		records, err := s.history.Records(ctx, resource, time.Time{}, time.Time{})
+		if err != nil {
+			return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting records of %s/%s: %v", resource.GetNamespace(), resource.GetName(), err)}
+		}
+		summary := ResourceSummary{
+			Namespace:       resource.GetNamespace(),
+			Name:            resource.GetName(),
+			Labels:          resource.GetLabels(),
+			Endpoints:       resource.Spec.HealthcheckEndpoints,
+			LastRecordTime:  lastRecordTime(records),
+			AnomalyDetected: meta.IsStatusConditionTrue(resource.Status.Conditions, v1alpha1.ConditionTypeAnomalyDetected),
+		}
+		summary.UnhealthyRecords, summary.HealthyRecords, summary.HealthScore = evaluateRecords(records)
+		list.Items = append(list.Items, summary)
+	}
+
+	return list, nil
+}
+
+// endpoints serves EndpointsRequests.
+func (s *apiServer) endpoints(ctx context.Context, request *EndpointsRequest) (*EndpointList, *APIError) {
+	resources, apiErr := s.selectResources(ctx, request.ResourceSelector)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	list := &EndpointList{Items: make([]ResourceEndpoints, 0, len(resources))}
+	for _, resource := range resources {
+		records, err := s.history.Records(ctx, resource, request.From, request.To)
+		if err != nil {
+			return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting records of %s/%s: %v", resource.GetNamespace(), resource.GetName(), err)}
+		}
+
+		// Group the records by endpoint, listing the probed endpoints first.
+		endpoints := append([]string{}, resource.Spec.HealthcheckEndpoints...)
+		byEndpoint := map[string][]v1alpha1.HealthcheckRecord{}
+		for _, record := range records {
+			if record.Endpoint == "" {
+				continue
+			}
+			if _, ok := byEndpoint[record.Endpoint]; !ok && !slices.Contains(resource.Spec.HealthcheckEndpoints, record.Endpoint) {
+				endpoints = append(endpoints, record.Endpoint)
+			}
+			byEndpoint[record.Endpoint] = append(byEndpoint[record.Endpoint], record)
+		}
+		sort.Strings(endpoints[len(resource.Spec.HealthcheckEndpoints):])
+
+		// Summarize each endpoint.
+		item := ResourceEndpoints{Namespace: resource.GetNamespace(), Name: resource.GetName(), Endpoints: make([]EndpointSummary, 0, len(endpoints))}
+		for _, endpoint := range endpoints {
+			summary := EndpointSummary{Endpoint: endpoint, LastRecordTime: lastRecordTime(byEndpoint[endpoint])}
+			if healthy, ok := resource.Status.HealthcheckEndpointsHealthy[endpoint]; ok {
+				summary.Healthy = &healthy
+			}
+			summary.UnhealthyRecords, summary.HealthyRecords, summary.HealthScore = evaluateRecords(byEndpoint[endpoint])
+			item.Endpoints = append(item.Endpoints, summary)
+		}
+		list.Items = append(list.Items, item)
+	}
+
+	return list, nil
+}
+
+// recordsCursor is the position of the last record of a page, which the next page starts after.
+type recordsCursor struct {
+	Key       string    `json:"k"`
+	Timestamp time.Time `json:"t"`
+	Endpoint  string    `json:"e,omitempty"`
+}
+
+// after returns whether the position is after the cursor.
+func (c recordsCursor) after(key string, timestamp time.Time, endpoint string) bool {
+	if key != c.Key {
+		return key > c.Key
+	}
+	if !timestamp.Equal(c.Timestamp) {
+		return timestamp.After(c.Timestamp)
+	}
+
+	return endpoint > c.Endpoint
+}
+
+// records serves RecordsRequests.
+func (s *apiServer) records(ctx context.Context, request *RecordsRequest) (*RecordList, *APIError) {
+	limit := request.Limit
+	if limit == 0 {
+		limit = defaultRecordsLimit
+	}
+	if limit < 0 || limit > maxRecordsLimit {
+		return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: fmt.Sprintf("limit must be between 1, and %d", maxRecordsLimit), Parameter: "limit"}
+	}
+	var cursor *recordsCursor
+	if request.Continue != "" {
+		cursor = &recordsCursor{}
+		decoded, err := base64.RawURLEncoding.DecodeString(request.Continue)
+		if err == nil {
+			err = json.Unmarshal(decoded, cursor)
+		}
+		if err != nil {
+			return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: "invalid continue token", Parameter: "continue"}
+		}
+	}
+	resources, apiErr := s.selectResources(ctx, request.ResourceSelector)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	// Collect one record past the page, to tell whether there is a next one.
+	list := &RecordList{Items: make([]ResourceRecord, 0)}
+	var last recordsCursor
+	for _, resource := range resources {
+		key := resource.GetNamespace() + "/" + resource.GetName()
+		if cursor != nil && key < cursor.Key {
+			continue
+		}
+		records, err := s.history.Records(ctx, resource, request.From, request.To)
+		if err != nil {
+			return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting records of %s: %v", key, err)}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			ti, tj := recordTime(records[i]), recordTime(records[j])
+			return ti.Before(tj) || (ti.Equal(tj) && records[i].Endpoint < records[j].Endpoint)
+		})
+		for _, record := range records {
+			if request.Endpoint != "" && record.Endpoint != request.Endpoint {
+				continue
+			}
+			if request.Healthy != nil && (record.Healthy != nil && *record.Healthy) != *request.Healthy {
+				continue
+			}
+			if cursor != nil && !cursor.after(key, recordTime(record), record.Endpoint) {
+				continue
+			}
+			if len(list.Items) == limit {
+				encoded, err := json.Marshal(last)
+				if err != nil {
+					return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error encoding continue token: %v", err)}
+				}
+				list.Continue = base64.RawURLEncoding.EncodeToString(encoded)
+				return list, nil
+			}
+			list.Items = append(list.Items, ResourceRecord{Namespace: resource.GetNamespace(), Name: resource.GetName(), Record: record})
+			last = recordsCursor{Key: key, Timestamp: recordTime(record), Endpoint: record.Endpoint}
+		}
+	}
+
+	return list, nil
+}
+
+// compare serves CompareRequests.
+func (s *apiServer) compare(ctx context.Context, request *CompareRequest) (*ComparisonList, *APIError) {
+	resources, apiErr := s.selectResources(ctx, request.ResourceSelector)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	list := &ComparisonList{Items: make([]ResourceComparison, 0, len(resources))}
+	for _, resource := range resources {
+		a, apiErr := s.rangeHealth(ctx, resource, request.TimeRange)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		b, apiErr := s.rangeHealth(ctx, resource, TimeRange{From: request.FromB, To: request.ToB})
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		list.Items = append(list.Items, ResourceComparison{
+			Namespace:        resource.GetNamespace(),
+			Name:             resource.GetName(),
+			A:                a,
+			B:                b,
+			HealthScoreDelta: b.HealthScore - a.HealthScore,
+		})
+	}
+
+	return list, nil
+}
+
+// rangeHealth computes the health of the resource over the resolved time range, from its history.
+func (s *apiServer) rangeHealth(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, timeRange TimeRange) (RangeHealth, *APIError) {
+	buckets, err := s.history.History(ctx, resource, timeRange.From, timeRange.To)
+	if err != nil {
+		return RangeHealth{}, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting history of %s/%s: %v", resource.GetNamespace(), resource.GetName(), err)}
+	}
+	health := RangeHealth{}
+	health.From, health.To = timeRange.bounds()
+	health.UnhealthyRecords, health.HealthyRecords, health.HealthScore = EvaluateBuckets(buckets)
+
+	return health, nil
+}
+
+// selectResources returns the resources matching the selector, ordered by namespace, and name. Only the resources in
+// the namespaces the user of the request can get them in are selected, and selecting a namespace they cannot get them
+// in is forbidden.
+func (s *apiServer) selectResources(ctx context.Context, selector ResourceSelector) ([]*v1alpha1.MetricsAnomalyDetectorResource, *APIError) {
+	labelSelector, err := labels.Parse(selector.LabelSelector)
+	if err != nil {
+		return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: "labelSelector"}
+	}
+	fieldSelector, err := fields.ParseSelector(selector.FieldSelector)
+	if err != nil {
+		return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: "fieldSelector"}
+	}
+	for _, requirement := range fieldSelector.Requirements() {
+		if !slices.Contains(selectableFields, requirement.Field) {
+			return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: fmt.Sprintf("field %q is not selectable, expected one of %s", requirement.Field, strings.Join(selectableFields, ", ")), Parameter: "fieldSelector"}
+		}
+	}
+
+	// Get the resource, if a key is given, and list the resources otherwise.
+	var resources []*v1alpha1.MetricsAnomalyDetectorResource
+	if selector.Key != "" {
+		namespace, name, err := splitKey(selector.Key)
+		if err != nil {
+			return nil, &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: "key"}
+		}
+		resource, apiErr := s.resource(ctx, namespace, name)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		if selector.Namespace == "" || selector.Namespace == namespace {
+			if labelSelector.Matches(labels.Set(resource.GetLabels())) {
+				resources = append(resources, resource)
+			}
+		}
+	} else if selector.Namespace != "" {
+		if apiErr := s.authorizeNamespace(ctx, selector.Namespace); apiErr != nil {
+			return nil, apiErr
+		}
+		resources, err = s.lister.MetricsAnomalyDetectorResources(selector.Namespace).List(labelSelector)
+	} else {
+		resources, err = s.lister.List(labelSelector)
+		if err == nil {
+			var apiErr *APIError
+			if resources, apiErr = s.authorizedResources(ctx, resources); apiErr != nil {
+				return nil, apiErr
+			}
+		}
+	}
+	if err != nil {
+		return nil, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error listing resources: %v", err)}
+	}
+
+	// Filter the resources by their fields.
+	selected := make([]*v1alpha1.MetricsAnomalyDetectorResource, 0, len(resources))
+	for _, resource := range resources {
+		if fieldSelector.Matches(fields.Set{"metadata.name": resource.GetName(), "metadata.namespace": resource.GetNamespace()}) {
+			selected = append(selected, resource)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].GetNamespace() != selected[j].GetNamespace() {
+			return selected[i].GetNamespace() < selected[j].GetNamespace()
+		}
+		return selected[i].GetName() < selected[j].GetName()
+	})
+
+	return selected, nil
+}
+
+// evaluateRecords computes the health of the records, in the same way as EvaluateBuckets does.
+func evaluateRecords(records []v1alpha1.HealthcheckRecord) (int, int, float64) {
+	buckets := make([]v1alpha1.HealthcheckBucket, 0, len(records))
+	for _, record := range records {
+		buckets = append(buckets, record.Bucket())
+	}
+
+	return EvaluateBuckets(buckets)
+}
+
+// lastRecordTime returns the time of the most recent record, if any.
+func lastRecordTime(records []v1alpha1.HealthcheckRecord) *time.Time {
+	var last *time.Time
+	for _, record := range records {
+		if record.Timestamp != nil && (last == nil || record.Timestamp.After(*last)) {
+			last = &record.Timestamp.Time
+		}
+	}
+
+	return last
+}
+
+// recordTime returns the time of the record, or the zero time if it has none.
+func recordTime(record v1alpha1.HealthcheckRecord) time.Time {
+	if record.Timestamp == nil {
+		return time.Time{}
+	}
+
+	return record.Timestamp.Time
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResources(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newResource := func(namespace, name, tier string, endpoints ...string) *v1alpha1.MetricsAnomalyDetectorResource {
+		return &v1alpha1.MetricsAnomalyDetectorResource{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"tier": tier}},
+			Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{HealthcheckEndpoints: endpoints},
+			Status:     v1alpha1.MetricsAnomalyDetectorResourceStatus{HealthcheckEndpointsHealthy: map[string]bool{"a": false}},
+		}
+	}
+	history := fakeHistory{
+		"default/foo": {
+			newRecord(start.Add(1*time.Minute), "a", true),
+			newRecord(start.Add(1*time.Minute), "b", true),
+			newRecord(start.Add(2*time.Minute), "a", false),
+			newRecord(start.Add(2*time.Minute), "b", true),
+			newRecord(start.Add(3*time.Minute), "c", false),
+		},
+		"default/bar": {
+			newRecord(start.Add(1*time.Minute), "a", false),
+		},
+		"other/baz": {
+			newRecord(start.Add(1*time.Minute), "a", true),
+		},
+	}
+	handler := newTestServer(t, history,
+		newResource("default", "foo", "web", "a", "b"),
+		newResource("default", "bar", "db", "a"),
+		newResource("other", "baz", "web", "a"),
+	)
+	names := func(items int, name func(i int) string) []string {
+		names := make([]string, items)
+		for i := range names {
+			names[i] = name(i)
+		}
+		return names
+	}
+	assertNames := func(target string, got, want []string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("Expected %v for %s, got %v", want, target, got)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Expected %v for %s, got %v", want, target, got)
+				return
+			}
+		}
+	}
+
+	// Resources should be selected by key, namespace, labels, and fields.
+	for query, want := range map[string][]string{
+		"":                                      {"default/bar", "default/foo", "other/baz"},
+		"key=default/foo":                       {"default/foo"},
+		"key=default/foo&labelSelector=tier=db": {},
+		"namespace=default":                     {"default/bar", "default/foo"},
+		"labelSelector=tier=web":                {"default/foo", "other/baz"},
+		"fieldSelector=metadata.name!=foo":      {"default/bar", "other/baz"},
+		"namespace=default&labelSelector=tier=web": {"default/foo"},
+	} {
+		var list ResourceList
+		target := APIPrefix + "/resources?" + query
+		if code := get(t, handler, target, &list); code != http.StatusOK {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusOK, target, code)
+		}
+		assertNames(target, names(len(list.Items), func(i int) string { return list.Items[i].Namespace + "/" + list.Items[i].Name }), want)
+	}
+	for query, parameter := range map[string]string{
+		"key=foo":                         "key",
+		"labelSelector=tier+in+(web":      "labelSelector",
+		"fieldSelector=spec.bufferSize=1": "fieldSelector",
+	} {
+		var response ErrorResponse
+		if code := get(t, handler, APIPrefix+"/resources?"+query, &response); code != http.StatusBadRequest || response.Error.Parameter != parameter {
+			t.Errorf("Expected an invalid %s for %s, got %d (%+v)", parameter, query, code, response.Error)
+		}
+	}
+
+	// Resources should be listed along with their current health.
+	var list ResourceList
+	get(t, handler, APIPrefix+"/resources?key=default/foo", &list)
+	if summary := list.Items[0]; summary.HealthyRecords != 3 || summary.UnhealthyRecords != 2 || !summary.LastRecordTime.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	// Endpoints should be broken down, listing the probed ones first.
+	var endpoints EndpointList
+	get(t, handler, APIPrefix+"/endpoints?key=default/foo&ts_a="+url.QueryEscape(start.Format(time.RFC3339)), &endpoints)
+	got := endpoints.Items[0].Endpoints
+	assertNames("endpoints", names(len(got), func(i int) string { return got[i].Endpoint }), []string{"a", "b", "c"})
+	if got[0].HealthyRecords != 1 || got[0].UnhealthyRecords != 1 || got[0].Healthy == nil || *got[0].Healthy {
+		t.Errorf("Unexpected summary of a %+v", got[0])
+	}
+	if got[1].HealthScore != 1 || got[1].Healthy != nil {
+		t.Errorf("Unexpected summary of b %+v", got[1])
+	}
+
+	// Records should be filtered, and paged through.
+	var all []string
+	query := APIPrefix + "/records?namespace=default&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("Expected the records to be paged through in 3 pages")
+		}
+		var page RecordList
+		if code := get(t, handler, query, &page); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		for _, item := range page.Items {
+			all = append(all, item.Name+"/"+item.Record.Timestamp.Format("04")+"/"+item.Record.Endpoint)
+		}
+		if page.Continue == "" {
+			break
+		}
+		query = APIPrefix + "/records?namespace=default&limit=2&continue=" + page.Continue
+	}
+	assertNames("records", all, []string{"bar/01/a", "foo/01/a", "foo/01/b", "foo/02/a", "foo/02/b", "foo/03/c"})
+	var filtered RecordList
+	get(t, handler, APIPrefix+"/records?key=default/foo&endpoint=a&healthy=false", &filtered)
+	if len(filtered.Items) != 1 || !filtered.Items[0].Record.Timestamp.Equal(&metav1.Time{Time: start.Add(2 * time.Minute)}) || filtered.Continue != "" {
+		t.Errorf("Expected the unhealthy record of a, got %+v", filtered)
+	}
+	for query, parameter := range map[string]string{
+		"limit=1001":      "limit",
+		"continue=foo":    "continue",
+		"healthy=perhaps": "healthy",
+	} {
+		var response ErrorResponse
+		if code := get(t, handler, APIPrefix+"/records?"+query, &response); code != http.StatusBadRequest || response.Error.Parameter != parameter {
+			t.Errorf("Expected an invalid %s for %s, got %d (%+v)", parameter, query, code, response.Error)
+		}
+	}
+
+	// Time ranges should be compared.
+	var comparisons ComparisonList
+	at := func(minutes int) string {
+		return url.QueryEscape(start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339))
+	}
+	get(t, handler, APIPrefix+"/compare?key=default/foo&ts_a="+at(1)+"&ts_b="+at(2)+"&ts_c="+at(2)+"&ts_d="+at(4), &comparisons)
+	if comparison := comparisons.Items[0]; comparison.A.HealthScore != 1 || comparison.B.HealthScore != 1.0/3 || math.Abs(comparison.HealthScoreDelta-(1.0/3-1)) > 1e-9 {
+		t.Errorf("Unexpected comparison %+v", comparison)
+	}
+}
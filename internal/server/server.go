@@ -2,141 +2,358 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"strings"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/url"
 	"time"
 
 	"golang.org/x/time/rate"
 
 	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
-	"github.com/rexagod/mad/pkg/generated/clientset/versioned"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/util/retry"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
 	"k8s.io/klog/v2"
 )
 
-// Run starts the server and listens for incoming requests.
+// HistoryReader reads the history of resources, from the controller's in-memory buffers, or its history store.
+type HistoryReader interface {
+
+	// History returns the history of the resource overlapping [from, to), oldest first. Zero times leave the range open.
+	History(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckBucket, error)
+
+	// Records returns the raw records of the resource within [from, to), oldest first. Zero times leave the range open.
+	Records(ctx context.Context, resource *v1alpha1.MetricsAnomalyDetectorResource, from, to time.Time) ([]v1alpha1.HealthcheckRecord, error)
+}
+
+// ShardRouter locates the replicas owning resources, when resources are sharded across replicas, or handled by a
+// leader.
+type ShardRouter interface {
+
+	// OwnerAddress returns the address of the replica owning the resource, or an empty string if this replica owns it.
+	OwnerAddress(namespace, name string) string
+}
+
+// forwardedHeader marks requests forwarded by another replica, so they are never forwarded again.
+const forwardedHeader = "X-Mad-Forwarded"
+
+// shutdownTimeout is the duration for which in-flight requests are waited for, once the server is shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// Options configures how the server is served.
+type Options struct {
+
+	// Address is the address the API is served at.
+	Address string
+
+	// InternalAddress is the address the debug handlers, and pprof are served at. The debug handlers are served
+	// alongside the API, and pprof is not served, if empty.
+	InternalAddress string
+
+	// TLSCertFile, and TLSKeyFile are the paths of the PEM-encoded certificate, and key both addresses are served over
+	// TLS with, which are reloaded as they change. Both addresses are served over plain HTTP if empty.
+	TLSCertFile, TLSKeyFile string
+
+	// TLSPeerCAFile is the path of the PEM-encoded CA bundle the certificates of other replicas are verified against,
+	// when forwarding requests to them over TLS, which is reloaded as it changes. The system roots are used if empty.
+	TLSPeerCAFile string
+
+	// TLSPeerServerName is the name the certificates of other replicas are verified for, as they are addressed by their
+	// IPs. Their certificates need to name their IPs if empty.
+	TLSPeerServerName string
+
+	// ReadTimeout, WriteTimeout, and IdleTimeout are the timeouts of the server, as http.Server's. Watch streams outlive
+	// the read, and write timeouts, and only time out once a write stalls.
+	ReadTimeout, WriteTimeout, IdleTimeout time.Duration
+
+	// MaxHeaderBytes is the maximum size of the request headers, as http.Server's.
+	MaxHeaderBytes int
+
+	// QueryRate, and QueryBurst are the rate, in requests per second, and the burst of the requests allowed to each IP,
+	// and to each authenticated user. Requests forwarded by other replicas, as verified against the peer CA, are
+	// exempt. Callers are not limited given a non-positive rate.
+	QueryRate  float64
+	QueryBurst int
+}
+
+// apiServer serves the API.
+type apiServer struct {
+
+	// lister is the lister of the resources watched by the controller.
+	lister listers.MetricsAnomalyDetectorResourceLister
+
+	// history reads the history of the resources.
+	history HistoryReader
+
+	// watcher watches the events of the resources.
+	watcher Watcher
+
+	// router locates the replicas owning the resources.
+	router ShardRouter
+
+	// authorizer authenticates, and authorizes the callers of the server, or is nil if authentication is disabled.
+	authorizer *Authorizer
+
+	// addressLimiter, and userLimiter limit the rate of the requests of each IP, and of each authenticated user.
+	addressLimiter, userLimiter *callerLimiter
+
+	// certificates serves the certificate of the server, and verifies the replicas forwarding requests to it, or is
+	// nil if the server is served over plain HTTP.
+	certificates *certificateReloader
+
+	// forwardScheme, and forwardTransport are the scheme, and the transport requests are forwarded to other replicas
+	// with. Requests are forwarded over plain HTTP, with the default transport, if unset.
+	forwardScheme    string
+	forwardTransport http.RoundTripper
+
+	// stopping is closed once the server is shutting down, to end the watch streams.
+	stopping chan struct{}
+
+	// logger is the logger of the server.
+	logger klog.Logger
+}
+
+// forward forwards the request to the replica owning the resource, and returns whether it did so.
+func (s *apiServer) forward(w http.ResponseWriter, r *http.Request, namespace, name string) bool {
+	address := s.router.OwnerAddress(namespace, name)
+	if address == "" || r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	scheme := s.forwardScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme, Host: address})
+	proxy.Transport = s.forwardTransport
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		s.logger.Error(err, "Error forwarding request", "address", address)
+		writeError(w, &APIError{Code: ErrorCodeUnavailable, Message: fmt.Sprintf("error forwarding request to %s", address)})
+	}
+	forwarded := r.Clone(r.Context())
+	forwarded.Header.Set(forwardedHeader, "true")
+
+	// Carry the parsed parameters in the query, as any form body has already been consumed.
+	if r.Form != nil {
+		forwarded.URL.RawQuery = r.Form.Encode()
+		forwarded.Body, forwarded.ContentLength = http.NoBody, 0
+		forwarded.Header.Del("Content-Type")
+	}
+	proxy.ServeHTTP(w, forwarded)
+
+	return true
+}
+
+// Run starts the server and listens for incoming requests, until the context is cancelled, or serving fails, in which
+// case the error is returned.
 // The lifecycle of a request is as follows:
 // * extract the time-intervals from the request,
 // * gather the health buffer for the given time-intervals,
 // * detect anomalies in the health buffer, and,
 // * relay the response back to the client.
-func Run(clientset *versioned.Clientset, logger klog.Logger, ctx context.Context) {
-
-	// Create a rate limiter.
-	var limiter = rate.NewLimiter(1, 5)
+// Resources are read from the controller's informer cache, and their health buffers from its in-memory buffers, or
+// its history store, so requests are served locally, and see samples that are yet to be written to the status.
+// Resources that are not watched by the controller are not found.
+// Requests for resources owned by other replicas are forwarded to them, as only the owner has their buffers in memory.
+// The API is served under APIPrefix, and described by the OpenAPI document at /openapi.json. /compute_health is kept
+// for compatibility, and answers with its original response body. The events of a resource are streamed at
+// APIPrefix/watch, as server-sent events. A subset of the Prometheus HTTP API is served alongside, so the history can
+// be charted by Grafana.
+// Given an authorizer, callers are authenticated by their bearer tokens, and can only query the resources in the
+// namespaces they can get them in. Forwarded requests carry the caller's token, so they are authorized by the owner.
+// The debug handlers are served as-is, keyed by their paths, to the callers that can get their paths, at the internal
+// address along with pprof, if any, and alongside the API otherwise.
+func Run(lister listers.MetricsAnomalyDetectorResourceLister, history HistoryReader, watcher Watcher, router ShardRouter, authorizer *Authorizer, debugHandlers map[string]http.Handler, options Options, logger klog.Logger, ctx context.Context) error {
+	queryRate := rate.Limit(options.QueryRate)
+	if queryRate <= 0 {
+		queryRate = rate.Inf
+	}
+	s := &apiServer{
+		lister:         lister,
+		history:        history,
+		watcher:        watcher,
+		router:         router,
+		authorizer:     authorizer,
+		addressLimiter: newCallerLimiter(queryRate, options.QueryBurst),
+		userLimiter:    newCallerLimiter(queryRate, options.QueryBurst),
+		stopping:       make(chan struct{}),
+		logger:         logger,
+	}
 
-	// Define the server's mux.
-	mux := http.NewServeMux()
-	mux.HandleFunc("/compute_health", func(w http.ResponseWriter, r *http.Request) {
-		logger.Info(fmt.Sprintf("Received request from %s", r.RemoteAddr))
-
-		// Rate limit the requests.
-		if !limiter.Allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			logger.Info(fmt.Sprintf("Rate limit exceeded for %s", r.RemoteAddr))
-			return
+	// Load the certificate, if any, and reload it as its files change. Requests are then forwarded over TLS as well.
+	var tlsConfig *tls.Config
+	if options.TLSCertFile != "" || options.TLSKeyFile != "" {
+		if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+			return fmt.Errorf("error loading serving certificate: both a certificate, and a key file are required")
 		}
-
-		// Parse the form.
-		err := r.ParseForm()
+		certificates, err := newCertificateReloader(options.TLSCertFile, options.TLSKeyFile, options.TLSPeerCAFile, options.TLSPeerServerName, logger)
 		if err != nil {
-			http.Error(w, "Error parsing form", http.StatusBadRequest)
-			return
-		}
-
-		// Extract the time-intervals from the request.
-		key := r.Form.Get("key")  // Should be of the form: "namespace/name".
-		tsA := r.Form.Get("ts_a") // Should be of the form: "2006-01-02T15:04:05Z07:00" (RFC3339).
-		tsB := r.Form.Get("ts_b") // Should be of the form: "2006-01-02T15:04:05Z07:00" (RFC3339).
-
-		// Validate the input.
-		if key == "" || tsA == "" || tsB == "" {
-			http.Error(w, "Missing parameters", http.StatusBadRequest)
-			return
+			return fmt.Errorf("error loading serving certificate: %w", err)
 		}
+		go certificates.run(ctx)
+		tlsConfig = certificates.serverTLSConfig()
+		s.certificates, s.forwardScheme, s.forwardTransport = certificates, "https", certificates
+	}
 
-		// Extract the namespace and name from the key.
-		keyParts := strings.Split(key, "/")
-		if len(keyParts) != 2 {
-			http.Error(w, "Invalid key", http.StatusBadRequest)
-			return
-		}
-		namespace := keyParts[0]
-		name := keyParts[1]
+	// Define the servers. The internal server is exempt from the write timeout, as profiles are taken over longer
+	// durations.
+	servers := []*http.Server{{
+		Addr:           options.Address,
+		ReadTimeout:    options.ReadTimeout,
+		WriteTimeout:   options.WriteTimeout,
+		IdleTimeout:    options.IdleTimeout,
+		MaxHeaderBytes: options.MaxHeaderBytes,
+		TLSConfig:      tlsConfig,
+	}}
+	if options.InternalAddress == "" {
+		servers[0].Handler = s.handler(debugHandlers)
+	} else {
+		servers[0].Handler = s.handler(nil)
+		servers = append(servers, &http.Server{
+			Addr:           options.InternalAddress,
+			Handler:        s.internalHandler(debugHandlers),
+			ReadTimeout:    options.ReadTimeout,
+			IdleTimeout:    options.IdleTimeout,
+			MaxHeaderBytes: options.MaxHeaderBytes,
+			TLSConfig:      tlsConfig,
+		})
+	}
 
-		// Extract the time-intervals from the request.
-		tsATyped, err := time.Parse(time.RFC3339, tsA)
-		if err != nil {
-			http.Error(w, "Invalid timestamp A", http.StatusBadRequest)
-			return
-		}
-		tsBTyped, err := time.Parse(time.RFC3339, tsB)
+	// Start listening, so that listening errors, e.g., on addresses in use, are returned right away.
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, srv := range servers {
+		listener, err := net.Listen("tcp", srv.Addr)
 		if err != nil {
-			http.Error(w, "Invalid timestamp B", http.StatusBadRequest)
-			return
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return fmt.Errorf("error listening on %s: %w", srv.Addr, err)
 		}
-		tsAMetaV1 := metav1.NewTime(tsATyped)
-		tsBMetaV1 := metav1.NewTime(tsBTyped)
-
-		// Get the resource.
-		var resource *v1alpha1.MetricsAnomalyDetectorResource
-		err = retry.OnError(wait.Backoff{
-			Duration: 100 * time.Millisecond,
-			Factor:   3,
-			Jitter:   1,
-			Steps:    5,
-		}, func(err error) bool {
-			return true
-		}, func() error {
-			resource, err = clientset.MadV1alpha1().MetricsAnomalyDetectorResources(namespace).Get(ctx, name, metav1.GetOptions{})
-			return err
-		})
-		if err != nil {
-			http.Error(w, "Error getting resource", http.StatusInternalServerError)
-			return
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
 		}
+		listeners = append(listeners, listener)
+	}
 
-		// Gather the health buffer for the given time-intervals.
-		healthBuffer := make([]v1alpha1.HealthcheckRecord, 0)
-		for _, healthRecord := range resource.Status.LastBuffer {
-			if healthRecord.Timestamp.After(tsAMetaV1.Time) &&
-				!healthRecord.Timestamp.After(tsBMetaV1.Time) {
-				healthBuffer = append(healthBuffer, healthRecord)
+	// Start serving.
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		logger.Info("Serving", "address", listeners[i].Addr().String(), "tls", tlsConfig != nil)
+		go func(srv *http.Server, listener net.Listener) {
+			if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("error serving on %s: %w", srv.Addr, err)
 			}
+		}(srv, listeners[i])
+	}
+
+	// Shutdown the servers gracefully, once the context is cancelled, or any of them fails. Watch streams are ended
+	// right away, as they would otherwise hold the shutdown up.
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	close(s.stopping)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+			logger.Error(shutdownErr, "Error shutting down server", "address", srv.Addr)
 		}
+	}
 
-		// Detect anomalies in the health buffer.
-		evictedRecords, healthScore := evaluateHealth(healthBuffer)
+	return err
+}
 
-		// Relay the response back to the client.
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte(`{"health_score": ` + fmt.Sprintf("%f", healthScore) + `, "unhealthy_records": ` + fmt.Sprintf("%d", len(evictedRecords)) + `, "healthy_records": ` + fmt.Sprintf("%d", len(healthBuffer)-len(evictedRecords)) + `}`))
-		if err != nil {
-			http.Error(w, "Error writing response", http.StatusInternalServerError)
-			return
-		}
+// internalHandler returns the handler of the internal server, serving the debug handlers, and pprof, to the callers
+// that can get their paths, if authentication is enabled.
+func (s *apiServer) internalHandler(debugHandlers map[string]http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	for path, handler := range debugHandlers {
+		mux.Handle(path, s.authenticated(s.authorizedPath(handler)))
+	}
+
+	// Serve pprof, whose index serves the profiles by name.
+	mux.Handle("/debug/pprof/", s.authenticated(s.authorizedPath(http.HandlerFunc(pprof.Index))))
+	mux.Handle("/debug/pprof/cmdline", s.authenticated(s.authorizedPath(http.HandlerFunc(pprof.Cmdline))))
+	mux.Handle("/debug/pprof/profile", s.authenticated(s.authorizedPath(http.HandlerFunc(pprof.Profile))))
+	mux.Handle("/debug/pprof/symbol", s.authenticated(s.authorizedPath(http.HandlerFunc(pprof.Symbol))))
+	mux.Handle("/debug/pprof/trace", s.authenticated(s.authorizedPath(http.HandlerFunc(pprof.Trace))))
+
+	return mux
+}
+
+// handler returns the handler of the server, serving the API, the Prometheus HTTP API, the OpenAPI document,
+// /compute_health, and the debug handlers. All but the OpenAPI document require authentication, if enabled.
+func (s *apiServer) handler(debugHandlers map[string]http.Handler) http.Handler {
+
+	// Define the server's mux.
+	mux := http.NewServeMux()
+	routes := s.routes()
+	for _, route := range routes {
+		mux.Handle(APIPrefix+route.path, s.addressRateLimited(s.authenticated(s.userRateLimited(route.serve))))
+	}
+	mux.Handle(APIPrefix+"/watch", s.addressRateLimited(s.authenticated(s.userRateLimited(http.HandlerFunc(s.watch)))))
+	for path, handler := range s.prometheusRoutes() {
+		mux.Handle(path, s.addressRateLimited(s.authenticated(s.userRateLimited(handler))))
+	}
+	mux.HandleFunc(APIPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &APIError{Code: ErrorCodeNotFound, Message: fmt.Sprintf("no route for %s", r.URL.Path)})
 	})
+	mux.Handle("/openapi.json", openAPIHandler(routes, s.authorizer != nil))
+	mux.Handle("/compute_health", s.addressRateLimited(s.authenticated(s.userRateLimited(http.HandlerFunc(s.computeHealth)))))
 
-	// Define the server.
-	s := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	// Serve the debug handlers.
+	for path, handler := range debugHandlers {
+		mux.Handle(path, s.authenticated(s.authorizedPath(handler)))
 	}
 
-	// Start listening.
-	go func() {
-		if err := s.ListenAndServe(); err != nil {
-			logger.Error(err, "Error starting server")
-		}
-	}()
+	return mux
+}
 
-	// Shutdown the server gracefully.
-	<-ctx.Done()
-	if err := s.Shutdown(ctx); err != nil {
-		logger.Error(err, "Error shutting down server")
+// computeHealthResponse is the response body of /compute_health, which predates the API.
+type computeHealthResponse struct {
+	HealthScore      float64 `json:"health_score"`
+	UnhealthyRecords int     `json:"unhealthy_records"`
+	HealthyRecords   int     `json:"healthy_records"`
+}
+
+// computeHealth serves /compute_health, which takes the parameters of a HealthRequest, either in the query, or in a
+// form body.
+func (s *apiServer) computeHealth(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info(fmt.Sprintf("Received request from %s", r.RemoteAddr))
+
+	// Parse the form.
+	if err := r.ParseForm(); err != nil {
+		writeError(w, &APIError{Code: ErrorCodeInvalidParameter, Message: "error parsing form"})
+		return
 	}
+
+	// Extract the time-intervals from the request.
+	request := &HealthRequest{}
+	if err := decodeRequest(r.Form, request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Forward the request to the replica owning the resource, if any.
+	if namespace, name := request.resource(); name != "" && s.forward(w, r, namespace, name) {
+		return
+	}
+
+	// Compute the health.
+	response, apiErr := s.health(r.Context(), request)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	// Relay the response back to the client.
+	writeJSON(w, http.StatusOK, computeHealthResponse{
+		HealthScore:      response.HealthScore,
+		UnhealthyRecords: response.UnhealthyRecords,
+		HealthyRecords:   response.HealthyRecords,
+	})
 }
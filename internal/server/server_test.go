@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// freeAddress returns a local address that is free to listen at.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	lister := listers.NewMetricsAnomalyDetectorResourceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	run := func(ctx context.Context, options Options) error {
+		return Run(lister, fakeHistory{}, &fakeWatcher{}, localRouter{}, nil, map[string]http.Handler{
+			"/metrics": http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}),
+		}, options, klog.Background(), ctx)
+	}
+
+	// Listening errors should be returned, instead of only being logged.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err = run(context.Background(), Options{Address: listener.Addr().String()}); err == nil {
+		t.Error("Expected an error listening at an address in use")
+	}
+	if err = run(context.Background(), Options{Address: freeAddress(t), TLSCertFile: "tls.crt"}); err == nil {
+		t.Error("Expected an error serving TLS without a key")
+	}
+
+	// The API, and the internal handlers should be served over TLS, on their own addresses.
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, "mad", certFile, keyFile)
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+	address, internalAddress := freeAddress(t), freeAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- run(ctx, Options{
+			Address:         address,
+			InternalAddress: internalAddress,
+			TLSCertFile:     certFile,
+			TLSKeyFile:      keyFile,
+			ReadTimeout:     time.Second,
+			WriteTimeout:    time.Second,
+			MaxHeaderBytes:  1 << 12,
+		})
+	}()
+	for target, want := range map[string]int{
+		"https://" + address + "/openapi.json":               http.StatusOK,
+		"https://" + address + "/metrics":                    http.StatusNotFound,
+		"https://" + internalAddress + "/metrics":            http.StatusOK,
+		"https://" + internalAddress + "/debug/pprof/":       http.StatusOK,
+		"https://" + internalAddress + APIPrefix + "/health": http.StatusNotFound,
+	} {
+		var response *http.Response
+		for i := 0; i < 50; i++ {
+			if response, err = client.Get(target); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Error getting %s: %v", target, err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != want {
+			t.Errorf("Expected %d for %s, got %d", want, target, response.StatusCode)
+		}
+	}
+
+	// Cancelling the context should shut the servers down gracefully.
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Expected a graceful shutdown, got %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Error("Expected the servers to shut down")
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// certificateReloadInterval is the interval at which the certificate, and key files are checked for changes, e.g., as
+// their Secret is rotated.
+const certificateReloadInterval = 10 * time.Second
+
+// certificateReloader serves the certificate of the server from its files, reloading it once they change, and
+// forwards requests to other replicas over TLS, verifying their certificates against the peer CA file, which is
+// reloaded along with it. Requests are forwarded with the certificate as a client certificate, so other replicas can
+// tell them apart through the peer CA as well. It is safe for concurrent use.
+type certificateReloader struct {
+
+	// certFile, and keyFile are the paths of the PEM-encoded certificate, and key files.
+	certFile, keyFile string
+
+	// peerCAFile is the path of the PEM-encoded CA bundle the certificates of other replicas are verified against, or
+	// empty to verify them against the system roots.
+	peerCAFile string
+
+	// peerServerName is the name the certificates of other replicas are verified for, or empty to verify them for the
+	// IPs they are addressed at.
+	peerServerName string
+
+	// logger is the logger of the reloader.
+	logger klog.Logger
+
+	// mu guards all fields below.
+	mu sync.RWMutex
+
+	// certificate is the certificate last loaded.
+	certificate *tls.Certificate
+
+	// certPEM, keyPEM, and peerCAPEM are the contents of the files the certificate, and the transport were last loaded
+	// from.
+	certPEM, keyPEM, peerCAPEM []byte
+
+	// peerRoots is the pool of the peer CA, or nil if there is none.
+	peerRoots *x509.CertPool
+
+	// transport forwards requests to other replicas, and is rebuilt once the peer CA file changes.
+	transport *http.Transport
+}
+
+// newCertificateReloader creates a new certificateReloader, and loads the certificate, and the peer CA.
+func newCertificateReloader(certFile, keyFile, peerCAFile, peerServerName string, logger klog.Logger) (*certificateReloader, error) {
+	c := &certificateReloader{certFile: certFile, keyFile: keyFile, peerCAFile: peerCAFile, peerServerName: peerServerName, logger: logger}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// reload loads the certificate, and the peer CA, unless their files are unchanged, and returns whether it did so.
+func (c *certificateReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading certificate file: %w", err)
+	}
+	keyPEM, err := os.ReadFile(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error reading key file: %w", err)
+	}
+	var peerCAPEM []byte
+	if c.peerCAFile != "" {
+		if peerCAPEM, err = os.ReadFile(c.peerCAFile); err != nil {
+			return false, fmt.Errorf("error reading peer CA file: %w", err)
+		}
+	}
+	c.mu.RLock()
+	certificateUnchanged := c.certificate != nil && bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM)
+	transportUnchanged := c.transport != nil && bytes.Equal(peerCAPEM, c.peerCAPEM)
+	c.mu.RUnlock()
+	if certificateUnchanged && transportUnchanged {
+		return false, nil
+	}
+
+	// Load the certificate.
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate: %w", err)
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return false, fmt.Errorf("error parsing certificate: %w", err)
+	}
+
+	// Build the transport, verifying the certificates of other replicas against the peer CA only, if any, and for the
+	// fixed name, if any, or the IPs they are addressed at, as usual.
+	var transport *http.Transport
+	if !transportUnchanged {
+		var roots *x509.CertPool
+		if c.peerCAFile != "" {
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(peerCAPEM) {
+				return false, fmt.Errorf("error loading peer CA: no certificates found in %s", c.peerCAFile)
+			}
+		}
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    roots,
+			ServerName: c.peerServerName,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return c.GetCertificate(nil)
+			},
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certificate, c.certPEM, c.keyPEM = &certificate, certPEM, keyPEM
+	if transport != nil {
+		if c.transport != nil {
+			c.transport.CloseIdleConnections()
+		}
+		c.transport, c.peerRoots, c.peerCAPEM = transport, transport.TLSClientConfig.RootCAs, peerCAPEM
+	}
+
+	return true, nil
+}
+
+// run reloads the certificate, and the peer CA as their files change, until the context is cancelled. The ones last
+// loaded are kept in use if the files cannot be loaded, e.g., while only some of them were rotated.
+func (c *certificateReloader) run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(_ context.Context) {
+		reloaded, err := c.reload()
+		if err != nil {
+			c.logger.Error(err, "Error reloading certificate", "certFile", c.certFile, "keyFile", c.keyFile, "peerCAFile", c.peerCAFile)
+			return
+		}
+		if reloaded {
+			c.mu.RLock()
+			c.logger.Info("Reloaded certificate", "certFile", c.certFile, "notAfter", c.certificate.Leaf.NotAfter)
+			c.mu.RUnlock()
+		}
+	}, certificateReloadInterval)
+}
+
+// GetCertificate returns the certificate last loaded, as tls.Config.GetCertificate.
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.certificate, nil
+}
+
+// RoundTrip implements http.RoundTripper, forwarding the request to another replica through the transport last built.
+func (c *certificateReloader) RoundTrip(request *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	transport := c.transport
+	c.mu.RUnlock()
+
+	return transport.RoundTrip(request)
+}
+
+// verifyPeer returns whether the connection is from another replica, i.e., its client certificate is issued by the
+// peer CA, for the peer server name, if any. No connection is, without a peer CA.
+func (c *certificateReloader) verifyPeer(state *tls.ConnectionState) bool {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	c.mu.RLock()
+	roots := c.peerRoots
+	c.mu.RUnlock()
+	if roots == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	// Replicas present their serving certificates, so accept any usage.
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       c.peerServerName,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err == nil
+}
+
+// serverTLSConfig returns the TLS configuration serving the certificate. Given a peer CA, client certificates are
+// requested, though not required, so replicas forwarding requests can be told apart through verifyPeer.
+func (c *certificateReloader) serverTLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+	if c.peerCAFile != "" {
+		config.ClientAuth = tls.RequestClientCert
+	}
+
+	return config
+}
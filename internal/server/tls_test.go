@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// writeCertificate writes a self-signed certificate for the common name, localhost, and 127.0.0.1, and its key to the
+// files, and returns the certificate in DER.
+func writeCertificate(t *testing.T, commonName, certFile, keyFile string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost", commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// newTLSPeer starts a server presenting the certificate in the files, as another replica would.
+func newTLSPeer(t *testing.T, certFile, keyFile string) *httptest.Server {
+	t.Helper()
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	peer.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	peer.StartTLS()
+	t.Cleanup(peer.Close)
+
+	return peer
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, "first", certFile, keyFile)
+	reloader, err := newCertificateReloader(certFile, keyFile, certFile, "", klog.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		certificate, _ := reloader.GetCertificate(nil)
+		return certificate.Leaf.Subject.CommonName
+	}
+	forward := func(r http.RoundTripper, peer *httptest.Server) error {
+		request, err := http.NewRequest(http.MethodGet, peer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := r.RoundTrip(request)
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return err
+	}
+
+	// Unchanged files should not be reloaded.
+	if reloaded, err := reloader.reload(); err != nil || reloaded || served() != "first" {
+		t.Fatalf("Expected the first certificate to be kept, got %s (reloaded: %t, err: %v)", served(), reloaded, err)
+	}
+
+	// Peers should be verified against the peer CA only, for the IPs they are addressed at.
+	if err = forward(reloader, newTLSPeer(t, certFile, keyFile)); err != nil {
+		t.Errorf("Expected a peer with a certificate issued by the peer CA to be verified, got %v", err)
+	}
+	otherCertFile, otherKeyFile := filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key")
+	writeCertificate(t, "other", otherCertFile, otherKeyFile)
+	if err = forward(reloader, newTLSPeer(t, otherCertFile, otherKeyFile)); err == nil {
+		t.Error("Expected a peer with a certificate not issued by the peer CA to be rejected")
+	}
+
+	// Forwarded requests should present the certificate, so they are told apart from those of other clients.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !reloader.verifyPeer(r.TLS) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	server.TLS = reloader.serverTLSConfig()
+	certificate, _ := reloader.GetCertificate(nil)
+	server.TLS.Certificates = []tls.Certificate{*certificate} // Otherwise replaced by httptest's own.
+	server.StartTLS()
+	defer server.Close()
+	clientConfig := reloader.transport.TLSClientConfig.Clone()
+	clientConfig.GetClientCertificate = nil
+	for name, tc := range map[string]struct {
+		transport http.RoundTripper
+		want      int
+	}{
+		"a peer":   {transport: reloader, want: http.StatusOK},
+		"a client": {transport: &http.Transport{TLSClientConfig: clientConfig}, want: http.StatusForbidden},
+	} {
+		request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := tc.transport.RoundTrip(request)
+		if err != nil {
+			t.Fatalf("Error forwarding request as %s: %v", name, err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != tc.want {
+			t.Errorf("Expected %d for %s, got %d", tc.want, name, response.StatusCode)
+		}
+	}
+
+	// Peers should be verified for the fixed name, if any.
+	named, err := newCertificateReloader(certFile, keyFile, certFile, "first", klog.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = forward(named, newTLSPeer(t, certFile, keyFile)); err != nil {
+		t.Errorf("Expected a peer with a certificate for the server name to be verified, got %v", err)
+	}
+	misnamed, err := newCertificateReloader(certFile, keyFile, certFile, "mad.example.com", klog.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = forward(misnamed, newTLSPeer(t, certFile, keyFile)); err == nil {
+		t.Error("Expected a peer with a certificate for another name to be rejected")
+	}
+
+	// Changed files should be reloaded, along with the peer CA.
+	writeCertificate(t, "second", certFile, keyFile)
+	if reloaded, err := reloader.reload(); err != nil || !reloaded || served() != "second" {
+		t.Fatalf("Expected the second certificate to be reloaded, got %s (reloaded: %t, err: %v)", served(), reloaded, err)
+	}
+	if err = forward(reloader, newTLSPeer(t, certFile, keyFile)); err != nil {
+		t.Errorf("Expected a peer with a certificate issued by the reloaded peer CA to be verified, got %v", err)
+	}
+
+	// Invalid files should keep the last certificate serving.
+	if err = os.WriteFile(keyFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloader.reload(); err == nil || served() != "second" {
+		t.Errorf("Expected an error, and the second certificate to be kept, got %s (err: %v)", served(), err)
+	}
+	if _, err = newCertificateReloader(otherCertFile, otherKeyFile, keyFile, "", klog.Background()); err == nil {
+		t.Error("Expected an error loading a peer CA without certificates")
+	}
+}
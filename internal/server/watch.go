@@ -0,0 +1,319 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+)
+
+const (
+
+	// watchHeartbeatInterval is the interval at which comments are sent over idle streams, so proxies keep them open.
+	watchHeartbeatInterval = 15 * time.Second
+
+	// watchWriteTimeout is the duration after which stalled writes end the stream, in place of the write timeout of
+	// the server, which streams outlive.
+	watchWriteTimeout = 10 * time.Second
+)
+
+// WatchEventType is the type of a WatchEvent.
+type WatchEventType string
+
+const (
+
+	// WatchEventRecord denotes a new record of the resource.
+	WatchEventRecord WatchEventType = "record"
+
+	// WatchEventAnomalyOpened denotes an anomaly that was detected in the buffer of the resource.
+	WatchEventAnomalyOpened WatchEventType = "anomalyOpened"
+
+	// WatchEventAnomalyClosed denotes an anomaly that was cleared from the buffer of the resource.
+	WatchEventAnomalyClosed WatchEventType = "anomalyClosed"
+)
+
+// WatchEvent is an event of the watch stream of a resource.
+type WatchEvent struct {
+	Type      WatchEventType              `json:"type" description:"The type of the event." enum:"record,anomalyOpened,anomalyClosed"`
+	Namespace string                      `json:"namespace" description:"The namespace of the resource."`
+	Name      string                      `json:"name" description:"The name of the resource."`
+	Time      time.Time                   `json:"time" description:"The time of the record, or of the anomaly transition."`
+	Record    *v1alpha1.HealthcheckRecord `json:"record,omitempty" description:"The record, for record events."`
+	Message   string                      `json:"message,omitempty" description:"The message of the AnomalyDetected condition, for anomaly events."`
+}
+
+// Watcher watches the events of resources as they happen.
+type Watcher interface {
+
+	// Watch subscribes to the events of the resource, and returns the channel they are sent to, along with the anomaly
+	// events retained for it, oldest first, and a function that unsubscribes. The channel is closed once the watcher
+	// falls behind, or the resource is released, after which watchers are expected to resume from their cursor.
+	Watch(namespace, name string) (<-chan WatchEvent, []WatchEvent, func())
+}
+
+// WatchRequest requests the events of a resource, as a stream of server-sent events.
+type WatchRequest struct {
+	Key      string `query:"key" required:"true" description:"The key of the resource, in the format namespace/name."`
+	Endpoint string `query:"endpoint" description:"The endpoint to stream the records of. Defaults to all endpoints."`
+	Cursor   string `query:"cursor" description:"The id of the last event received, to resume the stream after it. Defaults to the Last-Event-ID header, if any, or else to streaming new events only."`
+}
+
+// resource implements ownedRequest.
+func (r WatchRequest) resource() (string, string) {
+	namespace, name, err := splitKey(r.Key)
+	if err != nil {
+		return "", ""
+	}
+
+	return namespace, name
+}
+
+// watchCursor is the position of an event in the stream of a resource. Events are ordered by their time, and then by
+// their type, and endpoint. Persisted records lose the sub-second precision of their time, so these are ordered first
+// within their second.
+type watchCursor struct {
+	Timestamp time.Time `json:"t"`
+	Position  string    `json:"p"`
+}
+
+// watchCursorOf returns the cursor of the event.
+func watchCursorOf(event WatchEvent) watchCursor {
+	position := string(event.Type)
+	if event.Record != nil {
+		position += "/" + event.Record.Endpoint
+	}
+
+	return watchCursor{Timestamp: event.Time.UTC(), Position: position}
+}
+
+// coarse returns whether the cursor only keeps the second of its time, e.g., as that of a persisted record.
+func (c watchCursor) coarse() bool {
+	return c.Timestamp.Nanosecond() == 0
+}
+
+// before returns whether the cursor is ordered before the other one.
+func (c watchCursor) before(other watchCursor) bool {
+	if comparison := c.Timestamp.Compare(other.Timestamp); comparison != 0 {
+		return comparison < 0
+	}
+
+	return c.Position < other.Position
+}
+
+// encode encodes the cursor into an event id.
+func (c watchCursor) encode() string {
+	encoded, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// sentWatchEvents keeps track of the events sent over a stream, so the ones both replayed, and streamed are only sent
+// once. Events are sent in cursor order, so only the ones in the second of the last sent event are kept track of, as
+// persisted records cannot be told apart from others in their second by their time.
+type sentWatchEvents struct {
+
+	// second is the second of the last sent event.
+	second time.Time
+
+	// cursors holds the cursors of the events sent in the second.
+	cursors map[watchCursor]struct{}
+
+	// positions maps the positions of the events sent in the second to whether any of these was coarse.
+	positions map[string]bool
+}
+
+// seen returns whether the event at the cursor was sent already, and marks it as sent otherwise. Events in seconds
+// before the one of the last sent event are considered sent. Events in the same second are told apart by their
+// position, and by their full-precision time, unless either is coarse.
+func (s *sentWatchEvents) seen(cursor watchCursor) bool {
+	second := cursor.Timestamp.Truncate(time.Second)
+	switch {
+	case second.Before(s.second):
+		return true
+	case second.After(s.second) || s.cursors == nil:
+		s.second = second
+		s.cursors = map[watchCursor]struct{}{}
+		s.positions = map[string]bool{}
+	}
+	if _, ok := s.cursors[cursor]; ok {
+		return true
+	}
+	if coarse, ok := s.positions[cursor.Position]; ok && (coarse || cursor.coarse()) {
+		return true
+	}
+	s.cursors[cursor] = struct{}{}
+	s.positions[cursor.Position] = s.positions[cursor.Position] || cursor.coarse()
+
+	return false
+}
+
+// decodeWatchCursor decodes an event id into a cursor.
+func decodeWatchCursor(id string) (*watchCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &watchCursor{}
+	if err = json.Unmarshal(decoded, cursor); err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// watch serves WatchRequests as a stream of server-sent events. Resuming streams replay the records after the cursor
+// from the history, and the anomaly events after it that are retained in memory, before the new events. Events are
+// sent in cursor order, so ones published late, into a second before that of the last sent event, are dropped.
+func (s *apiServer) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, &APIError{Code: ErrorCodeMethodNotAllowed, Message: fmt.Sprintf("method %s is not allowed", r.Method)})
+		return
+	}
+
+	// Decode the request.
+	request := &WatchRequest{}
+	if err := decodeRequest(r.URL.Query(), request); err != nil {
+		writeError(w, err)
+		return
+	}
+	if request.Cursor == "" {
+		request.Cursor = r.Header.Get("Last-Event-ID")
+	}
+	var cursor *watchCursor
+	if request.Cursor != "" {
+		var err error
+		if cursor, err = decodeWatchCursor(request.Cursor); err != nil {
+			writeError(w, &APIError{Code: ErrorCodeInvalidParameter, Message: "invalid cursor", Parameter: "cursor"})
+			return
+		}
+	}
+	namespace, name, err := splitKey(request.Key)
+	if err != nil {
+		writeError(w, &APIError{Code: ErrorCodeInvalidParameter, Message: err.Error(), Parameter: "key"})
+		return
+	}
+
+	// Lift the read, and write deadlines of the server, as streams outlive them. Stalled writes are timed out on their
+	// own below, while forwarded streams end along with the owner's.
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Error(err, "Error lifting the read deadline of a watch stream")
+	}
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.logger.Error(err, "Error lifting the write deadline of a watch stream")
+	}
+
+	// Forward the request to the replica owning the resource, as only the owner probes its endpoints.
+	if s.forward(w, r, namespace, name) {
+		return
+	}
+	resource, apiErr := s.resource(r.Context(), namespace, name)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, &APIError{Code: ErrorCodeInternal, Message: "streaming is not supported"})
+		return
+	}
+
+	// Subscribe before reading the history, so no event is missed in between.
+	events, backlog, cancel := s.watcher.Watch(namespace, name)
+	defer cancel()
+	var replay []WatchEvent
+	if cursor != nil {
+		records, err := s.history.Records(r.Context(), resource, cursor.Timestamp, time.Time{})
+		if err != nil {
+			writeError(w, &APIError{Code: ErrorCodeInternal, Message: fmt.Sprintf("error getting records: %v", err)})
+			return
+		}
+		for i := range records {
+			replay = append(replay, WatchEvent{Type: WatchEventRecord, Namespace: namespace, Name: name, Time: recordTime(records[i]), Record: &records[i]})
+		}
+		replay = append(replay, backlog...)
+		sort.SliceStable(replay, func(i, j int) bool {
+			return watchCursorOf(replay[i]).before(watchCursorOf(replay[j]))
+		})
+	}
+
+	// Write, and flush the stream, failing writes that stall for longer than watchWriteTimeout.
+	write := func(format string, args ...interface{}) bool {
+		if err := controller.SetWriteDeadline(time.Now().Add(watchWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+
+		return controller.Flush() == nil
+	}
+
+	// Start the stream.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if !write("") {
+		return
+	}
+
+	// Send the events of the endpoint, unless they were sent already, e.g., both replayed, and streamed. The event at
+	// the cursor counts as sent.
+	sent := &sentWatchEvents{}
+	if cursor != nil {
+		sent.seen(*cursor)
+	}
+	send := func(event WatchEvent) bool {
+		if event.Record != nil && request.Endpoint != "" && event.Record.Endpoint != request.Endpoint {
+			return true
+		}
+		eventCursor := watchCursorOf(event)
+		if sent.seen(eventCursor) {
+			return true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			s.logger.Error(err, "Error encoding watch event")
+			return false
+		}
+		return write("id: %s\nevent: %s\ndata: %s\n\n", eventCursor.encode(), event.Type, data)
+	}
+
+	// Replay the events after the cursor, in cursor order.
+	for _, event := range replay {
+		if !cursor.before(watchCursorOf(event)) {
+			continue
+		}
+		if !send(event) {
+			return
+		}
+	}
+
+	// Stream the new events, until the client goes away, the watcher is disconnected, or the server shuts down.
+	heartbeat := time.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-heartbeat.C:
+			if !write(": heartbeat\n\n") {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if !send(event) {
+				return
+			}
+		}
+	}
+}
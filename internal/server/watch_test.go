@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeWatcher streams the events sent to it, to a single watcher, along with a fixed backlog.
+type fakeWatcher struct {
+	events  chan WatchEvent
+	backlog []WatchEvent
+}
+
+// Watch implements Watcher.
+func (w *fakeWatcher) Watch(_, _ string) (<-chan WatchEvent, []WatchEvent, func()) {
+	return w.events, w.backlog, func() {}
+}
+
+// readEvents reads the server-sent events of the stream until it ends, as "<event> <id>" pairs.
+func readEvents(t *testing.T, target string, header http.Header) ([]string, []string) {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header = header
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d (%s)", response.StatusCode, contentType)
+	}
+	var events, ids []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ": ")
+		switch field {
+		case "id":
+			ids = append(ids, value)
+		case "event":
+			events = append(events, value)
+		}
+	}
+
+	return events, ids
+}
+
+func TestWatch(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	s := newTestAPIServer(t, fakeHistory{"default/foo": {
+		newRecord(start.Add(time.Minute), "a", true),
+		newRecord(start.Add(2*time.Minute), "a", false),
+		newRecord(start.Add(2*time.Minute), "b", false),
+	}}, resource)
+	opened := WatchEvent{Type: WatchEventAnomalyOpened, Namespace: "default", Name: "foo", Time: start.Add(2*time.Minute + 500*time.Millisecond)}
+	watcher := &fakeWatcher{events: make(chan WatchEvent, 10), backlog: []WatchEvent{opened}}
+	s.watcher = watcher
+	server := httptest.NewServer(s.handler(nil))
+	defer server.Close()
+
+	// Streams resuming from a cursor should replay the history after it, followed by the new events, skipping the
+	// ones that were already replayed.
+	replayed := newRecord(start.Add(2*time.Minute), "b", false)
+	live := newRecord(start.Add(3*time.Minute), "a", true)
+	watcher.events <- WatchEvent{Type: WatchEventRecord, Namespace: "default", Name: "foo", Time: replayed.Timestamp.Time, Record: &replayed}
+	watcher.events <- WatchEvent{Type: WatchEventRecord, Namespace: "default", Name: "foo", Time: live.Timestamp.Time, Record: &live}
+	close(watcher.events)
+	first := newRecord(start.Add(time.Minute), "a", true)
+	cursor := watchCursorOf(WatchEvent{Type: WatchEventRecord, Time: start.Add(time.Minute), Record: &first}).encode()
+	events, ids := readEvents(t, server.URL+APIPrefix+"/watch?key=default/foo&cursor="+cursor, nil)
+	if strings.Join(events, ",") != "record,record,anomalyOpened,record" {
+		t.Fatalf("Unexpected events %v", events)
+	}
+
+	// Streams should resume from the Last-Event-ID header, and be filtered by endpoint.
+	watcher.events = make(chan WatchEvent)
+	close(watcher.events)
+	events, _ = readEvents(t, server.URL+APIPrefix+"/watch?key=default/foo&endpoint=b", http.Header{"Last-Event-ID": {ids[0]}})
+	if strings.Join(events, ",") != "record,anomalyOpened" {
+		t.Errorf("Expected the record of b, and the anomaly after the cursor, got %v", events)
+	}
+
+	// Records of an endpoint within the same second should be told apart, unlike the same record streamed twice.
+	watcher.events = make(chan WatchEvent, 3)
+	for _, offset := range []time.Duration{100 * time.Millisecond, 600 * time.Millisecond, 100 * time.Millisecond} {
+		record := newRecord(start.Add(3*time.Minute+offset), "a", true)
+		watcher.events <- WatchEvent{Type: WatchEventRecord, Namespace: "default", Name: "foo", Time: record.Timestamp.Time, Record: &record}
+	}
+	close(watcher.events)
+	if events, _ = readEvents(t, server.URL+APIPrefix+"/watch?key=default/foo", nil); strings.Join(events, ",") != "record,record" {
+		t.Errorf("Expected both records within the second, once, got %v", events)
+	}
+
+	// Records streamed after their persisted copy was replayed, and ones published late, into an earlier second than
+	// the last sent event, should be dropped.
+	watcher.events = make(chan WatchEvent, 2)
+	for _, offset := range []time.Duration{2*time.Minute + 300*time.Millisecond, time.Minute + 500*time.Millisecond} {
+		record := newRecord(start.Add(offset), "b", false)
+		watcher.events <- WatchEvent{Type: WatchEventRecord, Namespace: "default", Name: "foo", Time: record.Timestamp.Time, Record: &record}
+	}
+	close(watcher.events)
+	if events, _ = readEvents(t, server.URL+APIPrefix+"/watch?key=default/foo&endpoint=b", http.Header{"Last-Event-ID": {ids[0]}}); strings.Join(events, ",") != "record,anomalyOpened" {
+		t.Errorf("Expected the replayed events only, got %v", events)
+	}
+
+	// Streams should outlive the read, and write timeouts of the server.
+	timed := httptest.NewUnstartedServer(s.handler(nil))
+	timed.Config.ReadTimeout, timed.Config.WriteTimeout = 100*time.Millisecond, 100*time.Millisecond
+	timed.Start()
+	defer timed.Close()
+	watcher.events = make(chan WatchEvent)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		watcher.events <- WatchEvent{Type: WatchEventRecord, Namespace: "default", Name: "foo", Time: live.Timestamp.Time, Record: &live}
+		close(watcher.events)
+	}()
+	if events, _ = readEvents(t, timed.URL+APIPrefix+"/watch?key=default/foo", nil); strings.Join(events, ",") != "record" {
+		t.Errorf("Expected the record past the timeouts, got %v", events)
+	}
+
+	// Invalid cursors, and unknown resources should be rejected.
+	for target, want := range map[string]ErrorCode{
+		APIPrefix + "/watch?key=default/foo&cursor=foo": ErrorCodeInvalidParameter,
+		APIPrefix + "/watch?key=default/bar":            ErrorCodeNotFound,
+	} {
+		var response ErrorResponse
+		if get(t, s.handler(nil), target, &response); response.Error.Code != want {
+			t.Errorf("Expected %s for %s, got %+v", want, target, response.Error)
+		}
+	}
+}
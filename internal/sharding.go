@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+)
+
+const (
+
+	// shardGroupLabel labels the member leases of a shard group with the group's name.
+	shardGroupLabel = "mad.instrumentation.k8s-sigs.io/shard-group"
+
+	// shardAddressAnnotation annotates the member leases with the address of the replica's query server.
+	shardAddressAnnotation = "mad.instrumentation.k8s-sigs.io/address"
+
+	// shardVirtualNodes is the number of points each replica takes on the hash ring, which evens out the shards.
+	shardVirtualNodes = 128
+
+	// shardLeaseGCFactor is the number of lease durations after which expired member leases are deleted.
+	shardLeaseGCFactor = 5
+)
+
+// ShardingOptions configures the sharding of resources across controller replicas.
+type ShardingOptions struct {
+
+	// Enabled spreads the resources across all replicas, instead of electing a leader to handle all of them.
+	Enabled bool
+
+	// Namespace is the namespace of the member leases.
+	Namespace string
+
+	// Name is the name of the shard group, which prefixes the member leases.
+	Name string
+
+	// Address is the address at which the other replicas can reach this replica's query server.
+	Address string
+
+	// LeaseDuration is the duration after which a replica that stopped renewing its lease leaves the group.
+	LeaseDuration time.Duration
+}
+
+// shardRing is an immutable consistent hash ring, which maps resource keys to replicas. Replicas joining or leaving
+// the ring only move the keys they take over, or hand over.
+type shardRing struct {
+
+	// points are the sorted hashes of all virtual nodes.
+	points []uint64
+
+	// owners maps each point to the replica it belongs to.
+	owners map[uint64]string
+}
+
+// newShardRing creates a new shardRing for the given replicas.
+func newShardRing(members []string) *shardRing {
+	r := &shardRing{
+		points: make([]uint64, 0, len(members)*shardVirtualNodes),
+		owners: make(map[uint64]string, len(members)*shardVirtualNodes),
+	}
+	for _, member := range members {
+		for i := 0; i < shardVirtualNodes; i++ {
+			point := hashKey(member + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.owners[point] = member
+		}
+	}
+	slices.Sort(r.points)
+
+	return r
+}
+
+// Owner returns the replica owning the key, or an empty string if the ring is empty.
+func (r *shardRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// hashKey hashes the key onto the ring. FNV alone clusters similar keys, so its hash is mixed further to spread them
+// across the whole ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+
+	return x ^ (x >> 31)
+}
+
+// shardMembership tracks the live replicas of the shard group through their leases, and the resources this replica
+// owns among them.
+type shardMembership struct {
+
+	// options are the sharding options.
+	options ShardingOptions
+
+	// identity is the identity of this replica, and the name of its lease.
+	identity string
+
+	// clientset is the clientset used to manage the member leases.
+	clientset kubernetes.Interface
+
+	// mu guards all fields below.
+	mu sync.RWMutex
+
+	// members are the sorted identities of the live replicas.
+	members []string
+
+	// ring maps resources to the live replicas.
+	ring *shardRing
+
+	// addresses maps each live replica to the address of its query server.
+	addresses map[string]string
+
+	// renewed is the time this replica last renewed its lease.
+	renewed time.Time
+}
+
+// newShardMembership creates a new shardMembership.
+func newShardMembership(clientset kubernetes.Interface, options ShardingOptions) *shardMembership {
+	return &shardMembership{
+		options:   options,
+		identity:  options.Name + "-" + string(uuid.NewUUID()),
+		clientset: clientset,
+		ring:      newShardRing(nil),
+		addresses: map[string]string{},
+	}
+}
+
+// Owns reports whether this replica owns the resource. Nothing is owned before the first sync.
+func (m *shardMembership) Owns(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.ring.Owner(key) == m.identity
+}
+
+// OwnerAddress returns the address of the replica owning the resource, or an empty string if this replica owns it,
+// or no replica does.
+func (m *shardMembership) OwnerAddress(key string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owner := m.ring.Owner(key)
+	if owner == m.identity {
+		return ""
+	}
+
+	return m.addresses[owner]
+}
+
+// Members returns the identities of the live replicas.
+func (m *shardMembership) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.members)
+}
+
+// Sync renews this replica's lease, and refreshes the live replicas from their leases. It reports whether the
+// replicas changed.
+func (m *shardMembership) Sync(ctx context.Context) (bool, error) {
+	leases := m.clientset.CoordinationV1().Leases(m.options.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+
+	// Renew this replica's lease, creating it if needed. Replicas that cannot renew their lease for its whole duration
+	// are dropped by the others, so they drop all their resources as well.
+	if err := m.renew(ctx, now); err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if len(m.members) > 0 && time.Since(m.renewed) > m.options.LeaseDuration {
+			m.members = nil
+			m.ring = newShardRing(nil)
+			return true, err
+		}
+		return false, err
+	}
+
+	// Collect the live replicas, and clean up after the ones that are long gone.
+	list, err := leases.List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{shardGroupLabel: m.options.Name}).String()})
+	if err != nil {
+		return false, fmt.Errorf("error listing leases: %w", err)
+	}
+	members := make([]string, 0, len(list.Items))
+	addresses := make(map[string]string, len(list.Items))
+	for _, lease := range list.Items {
+		if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+		expiry := lease.Spec.RenewTime.Add(duration)
+		if now.After(expiry.Add(shardLeaseGCFactor * duration)) {
+			if err = leases.Delete(ctx, lease.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				klog.FromContext(ctx).Error(err, "failed to delete expired lease", "lease", klog.KObj(&lease))
+			}
+			continue
+		}
+		if now.After(expiry) {
+			continue
+		}
+		members = append(members, lease.GetName())
+		addresses[lease.GetName()] = lease.GetAnnotations()[shardAddressAnnotation]
+	}
+	slices.Sort(members)
+
+	// Rebuild the ring, if the replicas changed.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addresses = addresses
+	if slices.Equal(members, m.members) {
+		return false, nil
+	}
+	m.members = members
+	m.ring = newShardRing(members)
+
+	return true, nil
+}
+
+// renew renews this replica's lease, creating it if needed.
+func (m *shardMembership) renew(ctx context.Context, now metav1.MicroTime) error {
+	leases := m.clientset.CoordinationV1().Leases(m.options.Namespace)
+	lease, err := leases.Get(ctx, m.identity, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        m.identity,
+				Namespace:   m.options.Namespace,
+				Labels:      map[string]string{shardGroupLabel: m.options.Name},
+				Annotations: map[string]string{shardAddressAnnotation: m.options.Address},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To(m.identity),
+				LeaseDurationSeconds: ptr.To(int32(m.options.LeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err = leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("error creating lease: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("error getting lease: %w", err)
+	} else {
+		lease.Spec.RenewTime = &now
+		if _, err = leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("error renewing lease: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.renewed = now.Time
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Leave deletes this replica's lease, so the others take over its resources right away.
+func (m *shardMembership) Leave(ctx context.Context) error {
+	err := m.clientset.CoordinationV1().Leases(m.options.Namespace).Delete(ctx, m.identity, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting lease: %w", err)
+	}
+
+	return nil
+}
+
+// RunSharded runs the controller for the resources this replica owns, rebalancing them whenever replicas join or
+// leave the shard group. The replica leaves the group once the context is cancelled.
+func (c *Controller) RunSharded(ctx context.Context, workers int) error {
+	if c.shards == nil {
+		return fmt.Errorf("sharding is not enabled")
+	}
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "identity", c.shards.identity, "component", "sharding")
+	if c.shards.options.Namespace == "" {
+		return fmt.Errorf("sharding requires a lease namespace")
+	}
+
+	// Join the group before handling any resources, so this replica does not handle all of them on its own.
+	if err := c.WarmUp(ctx); err != nil {
+		return err
+	}
+	if _, err := c.shards.Sync(ctx); err != nil {
+		return err
+	}
+	defer func() {
+
+		// Leave the group, even though the context is cancelled.
+		leaveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.shards.Leave(leaveCtx); err != nil {
+			logger.Error(err, "failed to leave the shard group")
+			return
+		}
+		logger.Info("Left the shard group")
+	}()
+
+	// Renew the lease, and rebalance whenever replicas join or leave.
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		changed, err := c.shards.Sync(ctx)
+		if err != nil {
+			logger.Error(err, "failed to sync the shard group")
+		}
+		if changed {
+			logger.Info("Rebalancing resources", "members", c.shards.Members())
+			c.enqueueAll()
+		}
+	}, c.shards.options.LeaseDuration/3)
+
+	return c.Run(ctx, workers)
+}
+
+// owns reports whether this replica handles the resource.
+func (c *Controller) owns(key string) bool {
+	return c.shards == nil || c.shards.Owns(key)
+}
+
+// OwnerAddress returns the address of the replica owning the resource, or an empty string if this replica owns it.
+// Without sharding, the leader owns all resources, if any was observed.
+func (c *Controller) OwnerAddress(namespace, name string) string {
+	if c.shards == nil {
+		if address := c.leaderAddress.Load(); address != nil {
+			return *address
+		}
+		return ""
+	}
+
+	return c.shards.OwnerAddress(namespace + "/" + name)
+}
+
+// enqueueAll enqueues all resources, so their ownership is re-evaluated.
+func (c *Controller) enqueueAll() {
+	resources, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, resource := range resources {
+		c.enqueueMetricsAnomalyDetectorResource(resource, UpdateEvent)
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestShardRing(t *testing.T) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("default/resource-%d", i)
+	}
+
+	// An empty ring should not own anything.
+	if owner := newShardRing(nil).Owner(keys[0]); owner != "" {
+		t.Errorf("Expected no owner, got %q", owner)
+	}
+
+	// Keys should be spread evenly-ish across the replicas.
+	members := []string{"mad-a", "mad-b", "mad-c"}
+	ring := newShardRing(members)
+	owners := make(map[string]string, len(keys))
+	counts := map[string]int{}
+	for _, key := range keys {
+		owners[key] = ring.Owner(key)
+		counts[owners[key]]++
+	}
+	for _, member := range members {
+		if share := float64(counts[member]) / float64(len(keys)); share < 0.2 || share > 0.47 {
+			t.Errorf("Expected %s to own about a third of the keys, got %.2f", member, share)
+		}
+	}
+
+	// Rings built from the same replicas should agree, regardless of their order.
+	reordered := newShardRing([]string{"mad-c", "mad-a", "mad-b"})
+	for _, key := range keys {
+		if owner := reordered.Owner(key); owner != owners[key] {
+			t.Errorf("Expected %s to be owned by %s, got %s", key, owners[key], owner)
+			break
+		}
+	}
+
+	// Replicas joining should only take over keys, and not move them between the others.
+	joined := newShardRing(append(members, "mad-d"))
+	moved := 0
+	for _, key := range keys {
+		owner := joined.Owner(key)
+		if owner == owners[key] {
+			continue
+		}
+		if owner != "mad-d" {
+			t.Errorf("Expected %s to stay with %s, or move to mad-d, got %s", key, owners[key], owner)
+			break
+		}
+		moved++
+	}
+	if share := float64(moved) / float64(len(keys)); share < 0.15 || share > 0.35 {
+		t.Errorf("Expected about a quarter of the keys to move to mad-d, got %.2f", share)
+	}
+}
+
+func TestControllerRelease(t *testing.T) {
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "1"},
+		Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{BufferSize: 3},
+	}
+	retentions := historyRetentions{raw: time.Hour, tiers: []RollupTier{{Width: time.Minute, Retention: time.Hour}}}
+	history := newRollupHistoryStore(newFileHistoryBackend(t.TempDir(), retentions), retentions)
+	c := &Controller{
+		registry:  newEndpointRegistry(),
+		scheduler: newProbeScheduler(nil, 1),
+		buffers:   newBufferManager(),
+		history:   history,
+		status:    newStatusWriter(nil, nil, nil, newWatchHub(), time.Second),
+		watch:     newWatchHub(),
+	}
+	key := "default/foo"
+	c.buffers.Ensure(resource)
+	if err := history.Append(context.Background(), resource, v1alpha1.HealthcheckRecord{Timestamp: ptr.To(metav1.Now()), Healthy: ptr.To(true)}); err != nil {
+		t.Fatal(err)
+	}
+	c.registry.Sync(key, []string{"https://foo"})
+	c.status.Update(key, func(*v1alpha1.MetricsAnomalyDetectorResource) {})
+	c.status.written[key] = writtenStatus{uid: resource.GetUID()}
+
+	// Releasing a resource handed over to another replica should drop its buffer, open rollup buckets, subscriptions,
+	// and pending, and written statuses, so none of them are written over the new owner's.
+	if endpoints := c.release(key); len(endpoints) != 1 {
+		t.Errorf("Expected the endpoint to be released, got %v", endpoints)
+	}
+	if _, ok := c.buffers.RecordsFor("default", "foo"); ok {
+		t.Error("Expected the buffer to be released")
+	}
+	if len(c.status.pending) != 0 || len(c.status.written) != 0 {
+		t.Errorf("Expected the statuses to be forgotten, got %d pending, and %d written", len(c.status.pending), len(c.status.written))
+	}
+	if len(history.rollups) != 0 {
+		t.Errorf("Expected the open rollup buckets to be released, got %d", len(history.rollups))
+	}
+}
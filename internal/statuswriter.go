@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	clientset "github.com/rexagod/mad/pkg/generated/clientset/versioned"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+)
+
+// statusFieldManager is the field manager the status is applied as.
+const statusFieldManager = "mad-controller"
+
+// statusMutation mutates the status of the resource it is given, which is the latest known state of the resource.
+type statusMutation func(resource *v1alpha1.MetricsAnomalyDetectorResource)
+
+// statusWriter coalesces the status updates of each resource into a single server-side apply patch per flush window.
+// Updates are queued as mutations, which are applied in order to the latest known status once the window closes, so
+// they never conflict with each other, nor with concurrent spec changes. A window opens with the first pending
+// update, and lasts for minInterval, which is also the minimum interval between two writes for a resource. Writes that
+// would not change the status are skipped.
+type statusWriter struct {
+
+	// clientset is the clientset used to apply the status.
+	clientset clientset.Interface
+
+	// lister is the lister used to get the resources from the informer cache.
+	lister listers.MetricsAnomalyDetectorResourceLister
+
+	// recorder is the event recorder used to report the transitions of the written statuses.
+	recorder record.EventRecorder
+
+	// watch is the hub the anomaly transitions of the written statuses are published to.
+	watch *watchHub
+
+	// minInterval is the flush window, and the minimum interval between two writes for a resource.
+	minInterval time.Duration
+
+	// queue holds the keys of the resources with pending updates, until their window closes.
+	queue workqueue.RateLimitingInterface
+
+	// mu guards pending, and written.
+	mu sync.Mutex
+
+	// pending holds the mutations that are yet to be written, by resource key.
+	pending map[string][]statusMutation
+
+	// written holds the last status written for each resource, by resource key.
+	written map[string]writtenStatus
+}
+
+// writtenStatus is the last status written for a resource.
+type writtenStatus struct {
+
+	// uid is the UID of the resource, so the status of a previous resource with the same name is not carried over.
+	uid types.UID
+
+	// status is the status, as returned by the apiserver.
+	status *v1alpha1.MetricsAnomalyDetectorResourceStatus
+
+	// at is the time the status was written.
+	at time.Time
+}
+
+// newStatusWriter creates a new statusWriter.
+func newStatusWriter(clientset clientset.Interface, lister listers.MetricsAnomalyDetectorResourceLister, recorder record.EventRecorder, watch *watchHub, minInterval time.Duration) *statusWriter {
+	return &statusWriter{
+		clientset:   clientset,
+		lister:      lister,
+		recorder:    recorder,
+		watch:       watch,
+		minInterval: minInterval,
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{
+			Name: "status",
+		}),
+		pending: map[string][]statusMutation{},
+		written: map[string]writtenStatus{},
+	}
+}
+
+// Update queues the mutation, opening a flush window for the resource, unless one is open already.
+func (w *statusWriter) Update(key string, mutation statusMutation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[key] = append(w.pending[key], mutation)
+	if len(w.pending[key]) > 1 {
+		return
+	}
+	delay := w.minInterval
+	if written, ok := w.written[key]; ok {
+		delay = max(delay, time.Until(written.at.Add(w.minInterval)))
+	}
+	w.queue.AddAfter(key, delay)
+}
+
+// Forget drops the pending updates, and the last written status of the resource.
+func (w *statusWriter) Forget(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, key)
+	delete(w.written, key)
+}
+
+// Run writes the statuses whose window closed, using the given number of workers, until the context is cancelled.
+// The pending updates are written once more when it is.
+func (w *statusWriter) Run(ctx context.Context, workers int) {
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "component", "status")
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w.processNextKey(ctx) {
+			}
+		}()
+	}
+	<-ctx.Done()
+	w.queue.ShutDown()
+	wg.Wait()
+
+	// Write the pending updates, even though the context is cancelled.
+	flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w.mu.Lock()
+	keys := make([]string, 0, len(w.pending))
+	for key := range w.pending {
+		keys = append(keys, key)
+	}
+	w.mu.Unlock()
+	for _, key := range keys {
+		if err := w.Flush(flushCtx, key); err != nil {
+			statusWriteErrors.Inc()
+			logger.Error(err, "failed to write status", "key", key)
+		}
+	}
+}
+
+// processNextKey writes the status of the next resource whose window closed, and returns false once the queue is shut
+// down.
+func (w *statusWriter) processNextKey(ctx context.Context) bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+	key := item.(string)
+	if err := w.Flush(ctx, key); err != nil {
+		statusWriteErrors.Inc()
+		klog.FromContext(ctx).Error(err, "failed to write status, retrying", "key", key, "component", "status")
+		w.queue.AddRateLimited(key)
+		return true
+	}
+	w.queue.Forget(key)
+
+	return true
+}
+
+// Flush applies the pending updates of the resource to its latest known status, and writes it if it changed. Updates
+// that fail to be written are kept for the next attempt.
+func (w *statusWriter) Flush(ctx context.Context, key string) error {
+	w.mu.Lock()
+	mutations := w.pending[key]
+	delete(w.pending, key)
+	written, ok := w.written[key]
+	w.mu.Unlock()
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	// Drop the updates of resources that are gone, or are being deleted, which are left to the finalizer.
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	cached, err := w.lister.MetricsAnomalyDetectorResources(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		w.requeue(key, mutations)
+		return fmt.Errorf("error getting %s: %w", key, err)
+	}
+	if cached.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	// Apply the updates to the last written status, as the cache may not have caught up with it yet.
+	resource := cached.DeepCopy()
+	if ok && written.uid == resource.GetUID() {
+		resource.Status = *written.status.DeepCopy()
+	}
+	previous := resource.Status.DeepCopy()
+	for _, mutation := range mutations {
+		mutation(resource)
+	}
+	if statusEqual(previous, &resource.Status) {
+		return nil
+	}
+
+	// Write the status.
+	patch, err := json.Marshal(map[string]interface{}{
+		"apiVersion": v1alpha1.SchemeGroupVersion.String(),
+		"kind":       "MetricsAnomalyDetectorResource",
+		"metadata": map[string]interface{}{
+			"name":      resource.GetName(),
+			"namespace": resource.GetNamespace(),
+			"uid":       resource.GetUID(),
+		},
+		"status": resource.Status,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding status of %s: %w", key, err)
+	}
+	applied, err := w.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(namespace).Patch(ctx, name, types.ApplyPatchType, patch, metav1.PatchOptions{
+		FieldManager: statusFieldManager,
+		Force:        ptr.To(true),
+	}, "status")
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		w.requeue(key, mutations)
+		return fmt.Errorf("error applying status of %s: %w", key, err)
+	}
+	w.mu.Lock()
+	w.written[key] = writtenStatus{uid: applied.GetUID(), status: applied.Status.DeepCopy(), at: time.Now()}
+	w.mu.Unlock()
+
+	// Report the transitions, now that they are persisted.
+	recordTransitions(w.recorder, resource, previous)
+	w.watch.PublishTransitions(resource, previous)
+
+	return nil
+}
+
+// requeue puts the mutations back in front of the ones queued since.
+func (w *statusWriter) requeue(key string, mutations []statusMutation) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending[key] = append(mutations, w.pending[key]...)
+}
+
+// statusEqual returns whether the statuses serialize alike. Comparing serialized statuses ignores the precision lost
+// in transit, e.g., of in-memory timestamps, which would otherwise make every write look like a change.
+func statusEqual(a, b *v1alpha1.MetricsAnomalyDetectorResourceStatus) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"github.com/rexagod/mad/pkg/generated/clientset/versioned/fake"
+	listers "github.com/rexagod/mad/pkg/generated/listers/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestStatusWriter(t *testing.T) {
+	ctx := context.Background()
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "1"},
+		Spec:       v1alpha1.MetricsAnomalyDetectorResourceSpec{BufferSize: 3},
+	}
+	clientset := fake.NewSimpleClientset(resource)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(resource); err != nil {
+		t.Fatal(err)
+	}
+	w := newStatusWriter(clientset, listers.NewMetricsAnomalyDetectorResourceLister(indexer), record.NewFakeRecorder(10), newWatchHub(), time.Second)
+	key := "default/foo"
+	setHealthy := func(endpoint string, healthy bool) statusMutation {
+		return func(resource *v1alpha1.MetricsAnomalyDetectorResource) {
+			if resource.Status.HealthcheckEndpointsHealthy == nil {
+				resource.Status.HealthcheckEndpointsHealthy = make(map[string]bool)
+			}
+			resource.Status.HealthcheckEndpointsHealthy[endpoint] = healthy
+		}
+	}
+	assertWrites := func(want int, endpoints ...string) {
+		t.Helper()
+		writes := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "patch" && action.GetSubresource() == "status" {
+				writes++
+			}
+		}
+		if writes != want {
+			t.Errorf("Expected %d status writes, got %d", want, writes)
+		}
+		latest, err := clientset.MadV1alpha1().MetricsAnomalyDetectorResources("default").Get(ctx, "foo", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(latest.Status.HealthcheckEndpointsHealthy) != len(endpoints) {
+			t.Errorf("Expected the health of %v, got %v", endpoints, latest.Status.HealthcheckEndpointsHealthy)
+		}
+		for _, endpoint := range endpoints {
+			if _, ok := latest.Status.HealthcheckEndpointsHealthy[endpoint]; !ok {
+				t.Errorf("Expected the health of %s, got %v", endpoint, latest.Status.HealthcheckEndpointsHealthy)
+			}
+		}
+	}
+
+	// Updates within a window should be coalesced into a single write.
+	for _, endpoint := range []string{"a", "b", "c"} {
+		w.Update(key, setHealthy(endpoint, true))
+	}
+	if err := w.Flush(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	assertWrites(1, "a", "b", "c")
+
+	// Updates should apply to the last written status, even if the cache has not caught up with it yet.
+	w.Update(key, setHealthy("d", false))
+	if err := w.Flush(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	assertWrites(2, "a", "b", "c", "d")
+
+	// Updates that change nothing should not be written.
+	w.Update(key, setHealthy("d", false))
+	if err := w.Flush(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	assertWrites(2, "a", "b", "c", "d")
+
+	// Updates of recreated resources should not carry over the status of their predecessors.
+	recreated := resource.DeepCopy()
+	recreated.UID = types.UID("2")
+	if err := indexer.Update(recreated); err != nil {
+		t.Fatal(err)
+	}
+	w.Update(key, setHealthy("e", true))
+	if err := w.Flush(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	actions := clientset.Actions()
+	var applied v1alpha1.MetricsAnomalyDetectorResource
+	if err := json.Unmarshal(actions[len(actions)-1].(clienttesting.PatchAction).GetPatch(), &applied); err != nil {
+		t.Fatal(err)
+	}
+	if healthy := applied.Status.HealthcheckEndpointsHealthy; len(healthy) != 1 || !healthy["e"] {
+		t.Errorf("Expected only the health of e to be applied, got %v", healthy)
+	}
+
+	// Updates of resources that are being deleted should be left to the finalizer.
+	deleting := resource.DeepCopy()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	if err := indexer.Update(deleting); err != nil {
+		t.Fatal(err)
+	}
+	w.Update(key, setHealthy("f", true))
+	if err := w.Flush(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pending[key]) != 0 {
+		t.Errorf("Expected the updates of a deleting resource to be dropped")
+	}
+}
@@ -12,111 +12,100 @@ import (
 	"k8s.io/utils/ptr"
 )
 
-// endpointTracker is a struct that keeps track of the number of handlers that depend on it.
-type endpointTracker struct {
-
-	// fn starts the querier on the parent endpoint.
-	fn func(endpoint string) bool
-
-	// stopChannel is the channel used to stop the querier on the parent endpoint.
-	stopChannel chan struct{}
-
-	// relayChannel is the channel used to relay the health status of the parent endpoint.
-	relayChannel chan bool
-
-	// associatedHandlerCount is the number of handlers currently depending on this endpointTracker.
-	// An endpoint entry and its associated resources are released when this count reaches 0.
-	associatedHandlerCount int
-}
-
-func newEndpointTracker() *endpointTracker {
-	t := endpointTracker{}
-	t.stopChannel = make(chan struct{})
-	t.relayChannel = make(chan bool)
-	return &t
-}
-
-// trackMAD starts the querier on the parent endpoint and tracks the state throughout the process.
-func (t *endpointTracker) trackMAD(
+// trackMAD subscribes the resource to the endpoint's probe, and tracks the state throughout the process.
+// Tracking an already tracked endpoint updates its subscription in place.
+func (h *madEventHandler) trackMAD(
 	ctx context.Context,
-	h *madEventHandler,
 	resource *v1alpha1.MetricsAnomalyDetectorResource,
 	key string,
 	endpoint string,
 ) {
-	go func(
-		context.Context,
-		*madEventHandler,
-		*v1alpha1.MetricsAnomalyDetectorResource,
-		string,
-		string,
-	) {
-		logger := klog.LoggerWithValues(klog.FromContext(ctx), "name", resource.GetName(), "namespace", resource.GetNamespace(), "endpoint", endpoint, "component", "tracker")
-		for {
-			select {
-
-			// Stop the querier.
-			case <-t.stopChannel:
-				return
-
-			// Stop the querier.
-			case <-ctx.Done():
+	logger := klog.LoggerWithValues(klog.FromContext(ctx), "name", resource.GetName(), "namespace", resource.GetNamespace(), "endpoint", endpoint, "component", "tracker")
+	h.scheduler.Subscribe(
+		key,
+		resource.GetNamespace(),
+		endpoint,
+		endpointConfigFor(resource, endpoint),
+		time.Duration(resource.Spec.QueryInterval)*time.Second,
+		func(result QueryResult) {
+
+			// Drop the results of resources this replica no longer handles, e.g., after a rebalance, as probes may have
+			// been in flight as they were released.
+			if h.owns != nil && !h.owns(key) {
+				logger.V(4).Info("dropping result of resource handled by another replica")
 				return
+			}
 
-			// Query and update on the specified intervals.
-			case <-time.After(time.Duration(resource.Spec.QueryInterval) * time.Second):
-
-				// Get the resource before updating to avoid conflicts.
-				var err error
-				resource, err = h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(h.namespace).Get(ctx, resource.GetName(), metav1.GetOptions{})
-				if err != nil {
-					if errors.IsNotFound(err) {
-						logger.V(4).Info("resource has been deleted")
-						return
-					}
-					logger.Error(err, "failed to get resource")
+			// Get the resource from the informer cache, to pick up spec changes.
+			resource, err := h.lister.MetricsAnomalyDetectorResources(h.namespace).Get(resource.GetName())
+			if err != nil {
+				if errors.IsNotFound(err) {
+					logger.V(4).Info("resource has been deleted")
+					h.release(key)
 					return
 				}
+				logger.Error(err, "failed to get resource")
+				return
+			}
 
-				// Update the endpoint's health status.
-				isHealthy := t.fn(endpoint)
-				if isHealthy {
-					if resource.Status.HealthcheckEndpointsHealthy == nil {
-						resource.Status.HealthcheckEndpointsHealthy = make(map[string]bool)
-					}
-					resource.Status.HealthcheckEndpointsHealthy[endpoint] = true
-				}
-				resource.Status.LastHealthcheckQueryTime = metav1.Now()
+			// Leave resources that are being deleted to the finalizer.
+			if resource.GetDeletionTimestamp() != nil {
+				return
+			}
 
-				// Append the new record to the ring, and flush.
-				h.rings[key] = ringAppend(h.rings[key], v1alpha1.HealthcheckRecord{
-					Timestamp: ptr.To(metav1.Now()),
-					Healthy:   ptr.To(isHealthy),
-				})
-				resource.Status.LastBuffer = flushRing(h.rings[key])
+			// Append the new record to the buffer, and the history.
+			isHealthy := result.Healthy
+			if result.Err != nil {
+				logger.V(4).Info("endpoint is unhealthy", "attempts", result.Attempts, "err", result.Err)
+			}
+			now := metav1.Now()
+			record := v1alpha1.HealthcheckRecord{
+				Timestamp: ptr.To(now),
+				Endpoint:  endpoint,
+				Healthy:   ptr.To(isHealthy),
+				Attempts:  int32(result.Attempts),
+			}
+			if result.Attempts > 0 {
+				record.Latency = &metav1.Duration{Duration: result.Latency}
+			}
+			if _, ok := h.buffers.Append(resource, record); !ok {
+				logger.V(4).Info("dropping result of released resource")
+				return
+			}
+			h.watch.PublishRecord(resource, record)
+			if err = h.history.Append(ctx, resource, record); err != nil {
+				logger.Error(err, "failed to append record to history")
+			}
 
-				// Update the status.
-				_, err = h.clientset.MadV1alpha1().MetricsAnomalyDetectorResources(h.namespace).UpdateStatus(ctx, resource, metav1.UpdateOptions{})
-				if err != nil {
-					if errors.IsConflict(err) {
-						logger.V(4).Info("resource was modified, retrying")
-						continue
-					}
-					logger.Error(err, "failed to update status")
+			// Queue the status update, along with the ones of the other endpoints of the resource. The buffer is read
+			// once the update is written, so the latest records of all endpoints make it in.
+			uid := resource.GetUID()
+			// Updates of resources that were released since are dropped, as their buffers are gone.
+			h.status.Update(key, func(resource *v1alpha1.MetricsAnomalyDetectorResource) {
+				records, ok := h.buffers.Records(uid)
+				if !ok {
 					return
 				}
+				if resource.Status.HealthcheckEndpointsHealthy == nil {
+					resource.Status.HealthcheckEndpointsHealthy = make(map[string]bool)
+				}
+				resource.Status.HealthcheckEndpointsHealthy[endpoint] = isHealthy
+				resource.Status.LastHealthcheckQueryTime = now
+				setStatusBuffer(resource, records)
+				updateConditions(resource, records)
+			})
+			logger.V(4).Info(fmt.Sprintf("queued status update for %s", endpoint))
+		},
+	)
+}
 
-				logger.V(4).Info(fmt.Sprintf("updated status for %s", endpoint))
-			}
+// endpointConfigFor returns the configuration for the given endpoint, or nil if the resource does not configure it.
+func endpointConfigFor(resource *v1alpha1.MetricsAnomalyDetectorResource, endpoint string) *v1alpha1.HealthcheckEndpointConfig {
+	for i := range resource.Spec.HealthcheckEndpointsConfig {
+		if resource.Spec.HealthcheckEndpointsConfig[i].Endpoint == endpoint {
+			return &resource.Spec.HealthcheckEndpointsConfig[i]
 		}
-	}(
-		ctx,
-		h,
-		resource,
-		key,
-		endpoint,
-	)
+	}
 
-	// Record the number of handlers that depend on this endpointTracker.
-	t.associatedHandlerCount++
+	return nil
 }
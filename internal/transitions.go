@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Event reasons.
+const (
+	reasonEndpointUnhealthy = "EndpointUnhealthy"
+	reasonEndpointRecovered = "EndpointRecovered"
+	reasonAnomalyDetected   = "AnomalyDetected"
+	reasonAnomalyCleared    = "AnomalyCleared"
+	reasonSpecInvalid       = "SpecInvalid"
+	reasonSpecValid         = "SpecValid"
+)
+
+// eventCorrelatorOptions rate-limits the events emitted for each resource, per reason, so a flapping endpoint does
+// not crowd out the events for the other transitions. Identical events are deduplicated by the correlator as well.
+var eventCorrelatorOptions = record.CorrelatorOptions{
+	BurstSize: 10,
+	QPS:       1. / 60.,
+	SpamKeyFunc: func(event *corev1.Event) string {
+		return strings.Join([]string{
+			event.Source.Component,
+			event.InvolvedObject.Kind,
+			event.InvolvedObject.Namespace,
+			event.InvolvedObject.Name,
+			string(event.InvolvedObject.UID),
+			event.Reason,
+		}, "/")
+	},
+}
+
+// recordTransitions emits events for the transitions between the previous, and the current status of the resource.
+// Callers should only do so once the current status has been persisted, so transitions are not reported twice.
+func recordTransitions(recorder record.EventRecorder, resource *v1alpha1.MetricsAnomalyDetectorResource, previous *v1alpha1.MetricsAnomalyDetectorResourceStatus) {
+
+	// Report endpoints that turned unhealthy, or recovered. Endpoints are considered healthy until their first probe.
+	endpoints := make([]string, 0, len(resource.Status.HealthcheckEndpointsHealthy))
+	for endpoint := range resource.Status.HealthcheckEndpointsHealthy {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		healthy := resource.Status.HealthcheckEndpointsHealthy[endpoint]
+		wasHealthy, probed := previous.HealthcheckEndpointsHealthy[endpoint]
+		switch {
+		case !healthy && (!probed || wasHealthy):
+			recorder.Eventf(resource, corev1.EventTypeWarning, reasonEndpointUnhealthy, "Endpoint %s turned unhealthy", endpoint)
+		case healthy && probed && !wasHealthy:
+			recorder.Eventf(resource, corev1.EventTypeNormal, reasonEndpointRecovered, "Endpoint %s recovered", endpoint)
+		}
+	}
+
+	// Report anomalies that were detected, or cleared.
+	switch conditionTransition(previous.Conditions, resource.Status.Conditions, v1alpha1.ConditionTypeAnomalyDetected) {
+	case metav1.ConditionTrue:
+		recorder.Event(resource, corev1.EventTypeWarning, reasonAnomalyDetected, conditionMessage(resource, v1alpha1.ConditionTypeAnomalyDetected))
+	case metav1.ConditionFalse:
+		if meta.IsStatusConditionTrue(previous.Conditions, v1alpha1.ConditionTypeAnomalyDetected) {
+			recorder.Event(resource, corev1.EventTypeNormal, reasonAnomalyCleared, conditionMessage(resource, v1alpha1.ConditionTypeAnomalyDetected))
+		}
+	}
+
+	// Report specs that turned invalid, or were fixed.
+	switch conditionTransition(previous.Conditions, resource.Status.Conditions, v1alpha1.ConditionTypeInvalidSpec) {
+	case metav1.ConditionTrue:
+		recorder.Event(resource, corev1.EventTypeWarning, reasonSpecInvalid, conditionMessage(resource, v1alpha1.ConditionTypeInvalidSpec))
+	case metav1.ConditionFalse:
+		if meta.IsStatusConditionTrue(previous.Conditions, v1alpha1.ConditionTypeInvalidSpec) {
+			recorder.Event(resource, corev1.EventTypeNormal, reasonSpecValid, "The spec is valid, resumed probing")
+		}
+	}
+}
+
+// conditionTransition returns the status the condition transitioned to, or an empty status if it did not transition.
+func conditionTransition(previous, current []metav1.Condition, conditionType string) metav1.ConditionStatus {
+	condition := meta.FindStatusCondition(current, conditionType)
+	if condition == nil || meta.IsStatusConditionPresentAndEqual(previous, conditionType, condition.Status) {
+		return ""
+	}
+
+	return condition.Status
+}
+
+// conditionMessage returns the message of the resource's condition.
+func conditionMessage(resource *v1alpha1.MetricsAnomalyDetectorResource, conditionType string) string {
+	condition := meta.FindStatusCondition(resource.Status.Conditions, conditionType)
+	if condition == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+}
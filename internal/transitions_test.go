@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+func TestRecordTransitions(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: v1alpha1.MetricsAnomalyDetectorResourceSpec{
+			BufferSize:           3,
+			QueryInterval:        10,
+			HealthcheckEndpoints: []string{"https://foo", "https://bar"},
+		},
+	}
+	healthy := v1alpha1.HealthcheckRecord{Healthy: ptr.To(true), Timestamp: ptr.To(metav1.Now())}
+	unhealthy := v1alpha1.HealthcheckRecord{Healthy: ptr.To(false), Timestamp: ptr.To(metav1.Now())}
+
+	// transition applies the changes to the resource's status, and returns the events emitted for them.
+	transition := func(endpointsHealthy map[string]bool, records ...v1alpha1.HealthcheckRecord) []string {
+		previous := resource.Status.DeepCopy()
+		resource.Status.HealthcheckEndpointsHealthy = endpointsHealthy
+		updateConditions(resource, records)
+		recordTransitions(recorder, resource, previous)
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		return events
+	}
+	expect := func(got []string, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("Expected events %q, got %q", want, got)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Expected events %q, got %q", want, got)
+				return
+			}
+		}
+	}
+
+	// Healthy first probes should not be reported.
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": true}, healthy))
+
+	// Endpoints turning unhealthy, and anomalies, should be reported once.
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": false}, healthy, unhealthy, unhealthy),
+		"Warning EndpointUnhealthy Endpoint https://bar turned unhealthy",
+		"Warning AnomalyDetected HealthScoreBelowThreshold: The health score of the buffer is 0.33, below 0.50",
+	)
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": false}, healthy, unhealthy, unhealthy))
+
+	// Recoveries, and cleared anomalies, should be reported.
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": true}, healthy, healthy, unhealthy),
+		"Normal EndpointRecovered Endpoint https://bar recovered",
+		"Normal AnomalyCleared HealthScoreWithinThreshold: The health score of the buffer is 0.67",
+	)
+
+	// Invalid specs, and their fixes, should be reported.
+	resource.Spec.HealthcheckEndpoints = append(resource.Spec.HealthcheckEndpoints, "foo")
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": true}, healthy),
+		"Warning SpecInvalid ValidationFailed: spec.healthcheckEndpoints[2]: Invalid value: \"foo\": must be an absolute http(s) URL",
+	)
+	resource.Spec.HealthcheckEndpoints = resource.Spec.HealthcheckEndpoints[:2]
+	expect(transition(map[string]bool{"https://foo": true, "https://bar": true}, healthy),
+		"Normal SpecValid The spec is valid, resumed probing",
+	)
+}
@@ -2,10 +2,17 @@
 package version
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
 	"k8s.io/klog/v2"
 )
 
+// Println logs the version metadata of the binary.
 func Println() {
 	klog.Infoln(version.Print("metrics-anomaly-detector"))
 }
+
+// NewCollector returns a collector exporting the version metadata of the binary, as mad_build_info.
+func NewCollector() prometheus.Collector {
+	return version.NewCollector("mad")
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/rexagod/mad/internal/server"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+
+	// watchBufferSize is the number of events buffered for each watcher. Watchers that fall further behind are
+	// disconnected, and are expected to resume from their cursor, which replays the records from the history.
+	watchBufferSize = 256
+
+	// watchBacklogSize is the number of anomaly events retained for each resource, to be replayed to resuming watchers,
+	// as these are not part of the history.
+	watchBacklogSize = 64
+)
+
+// watchHub fans the events of each resource out to its watchers, and is safe for concurrent use.
+type watchHub struct {
+
+	// mu guards all fields below.
+	mu sync.Mutex
+
+	// watchers holds the channels of the watchers of each resource, by resource key.
+	watchers map[string]map[chan server.WatchEvent]struct{}
+
+	// backlogs holds the latest anomaly events of each resource, oldest first, by resource key.
+	backlogs map[string][]server.WatchEvent
+}
+
+// newWatchHub creates a new watchHub.
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[string]map[chan server.WatchEvent]struct{}),
+		backlogs: make(map[string][]server.WatchEvent),
+	}
+}
+
+// Watch implements server.Watcher.
+func (h *watchHub) Watch(namespace, name string) (<-chan server.WatchEvent, []server.WatchEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := namespace + "/" + name
+	ch := make(chan server.WatchEvent, watchBufferSize)
+	if _, ok := h.watchers[key]; !ok {
+		h.watchers[key] = make(map[chan server.WatchEvent]struct{})
+	}
+	h.watchers[key][ch] = struct{}{}
+	backlog := append([]server.WatchEvent(nil), h.backlogs[key]...)
+
+	return ch, backlog, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.closeLocked(key, ch)
+	}
+}
+
+// Publish sends the event to the watchers of its resource, disconnecting the ones that fell behind.
+func (h *watchHub) Publish(event server.WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := event.Namespace + "/" + event.Name
+	if event.Type != server.WatchEventRecord {
+		backlog := append(h.backlogs[key], event)
+		h.backlogs[key] = backlog[max(0, len(backlog)-watchBacklogSize):]
+	}
+	for ch := range h.watchers[key] {
+		select {
+		case ch <- event:
+		default:
+			h.closeLocked(key, ch)
+		}
+	}
+}
+
+// PublishRecord publishes the record of the resource, which must be timestamped.
+func (h *watchHub) PublishRecord(resource *v1alpha1.MetricsAnomalyDetectorResource, record v1alpha1.HealthcheckRecord) {
+	h.Publish(server.WatchEvent{
+		Type:      server.WatchEventRecord,
+		Namespace: resource.GetNamespace(),
+		Name:      resource.GetName(),
+		Time:      record.Timestamp.Time,
+		Record:    &record,
+	})
+}
+
+// PublishTransitions publishes the anomalies that were detected, or cleared between the previous, and the current
+// status of the resource. Like recordTransitions, this should only be called once the current status is persisted.
+func (h *watchHub) PublishTransitions(resource *v1alpha1.MetricsAnomalyDetectorResource, previous *v1alpha1.MetricsAnomalyDetectorResourceStatus) {
+	var eventType server.WatchEventType
+	switch conditionTransition(previous.Conditions, resource.Status.Conditions, v1alpha1.ConditionTypeAnomalyDetected) {
+	case metav1.ConditionTrue:
+		eventType = server.WatchEventAnomalyOpened
+	case metav1.ConditionFalse:
+		if !meta.IsStatusConditionTrue(previous.Conditions, v1alpha1.ConditionTypeAnomalyDetected) {
+			return
+		}
+		eventType = server.WatchEventAnomalyClosed
+	default:
+		return
+	}
+	condition := meta.FindStatusCondition(resource.Status.Conditions, v1alpha1.ConditionTypeAnomalyDetected)
+	h.Publish(server.WatchEvent{
+		Type:      eventType,
+		Namespace: resource.GetNamespace(),
+		Name:      resource.GetName(),
+		Time:      condition.LastTransitionTime.Time,
+		Message:   conditionMessage(resource, v1alpha1.ConditionTypeAnomalyDetected),
+	})
+}
+
+// Forget disconnects the watchers of the resource, and drops its backlog, once it is released. Watchers are expected
+// to resume from their cursor, e.g., against the replica that took the resource over.
+func (h *watchHub) Forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.watchers[key] {
+		h.closeLocked(key, ch)
+	}
+	delete(h.backlogs, key)
+}
+
+// closeLocked closes the channel of the watcher, unless it is closed already.
+func (h *watchHub) closeLocked(key string, ch chan server.WatchEvent) {
+	if _, ok := h.watchers[key][ch]; !ok {
+		return
+	}
+	delete(h.watchers[key], ch)
+	if len(h.watchers[key]) == 0 {
+		delete(h.watchers, key)
+	}
+	close(ch)
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rexagod/mad/internal/server"
+	"github.com/rexagod/mad/pkg/apis/mad/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestWatchHub(t *testing.T) {
+	hub := newWatchHub()
+	resource := &v1alpha1.MetricsAnomalyDetectorResource{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	events, _, cancel := hub.Watch("default", "foo")
+	defer cancel()
+	other, _, cancelOther := hub.Watch("default", "bar")
+	defer cancelOther()
+
+	// Records should only be sent to the watchers of their resource.
+	hub.PublishRecord(resource, v1alpha1.HealthcheckRecord{Timestamp: ptr.To(metav1.Now()), Endpoint: "a", Healthy: ptr.To(true)})
+	if event := <-events; event.Type != server.WatchEventRecord || event.Record.Endpoint != "a" {
+		t.Errorf("Expected the record of a, got %+v", event)
+	}
+	if len(other) != 0 {
+		t.Errorf("Expected no events for other resources, got %d", len(other))
+	}
+
+	// Anomalies should be published as they are detected, and cleared, and retained for resuming watchers.
+	setAnomaly := func(status metav1.ConditionStatus) *v1alpha1.MetricsAnomalyDetectorResourceStatus {
+		previous := resource.Status.DeepCopy()
+		resource.Status.Conditions = []metav1.Condition{{Type: v1alpha1.ConditionTypeAnomalyDetected, Status: status, LastTransitionTime: metav1.Now()}}
+		return previous
+	}
+	hub.PublishTransitions(resource, setAnomaly(metav1.ConditionFalse))
+	hub.PublishTransitions(resource, setAnomaly(metav1.ConditionTrue))
+	hub.PublishTransitions(resource, setAnomaly(metav1.ConditionTrue))
+	hub.PublishTransitions(resource, setAnomaly(metav1.ConditionFalse))
+	for _, want := range []server.WatchEventType{server.WatchEventAnomalyOpened, server.WatchEventAnomalyClosed} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Errorf("Expected %s, got %s", want, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s", want)
+		}
+	}
+	if _, backlog, cancel := hub.Watch("default", "foo"); len(backlog) != 2 {
+		t.Errorf("Expected 2 anomaly events in the backlog, got %d", len(backlog))
+	} else {
+		cancel()
+	}
+
+	// Watchers that fall behind should be disconnected.
+	for i := 0; i <= watchBufferSize; i++ {
+		hub.PublishRecord(resource, v1alpha1.HealthcheckRecord{Timestamp: ptr.To(metav1.Now()), Healthy: ptr.To(true)})
+	}
+	for range events {
+	}
+
+	// Releasing the resource should disconnect its watchers, and drop its backlog.
+	events, _, cancel = hub.Watch("default", "foo")
+	defer cancel()
+	hub.Forget("default/foo")
+	if _, ok := <-events; ok {
+		t.Errorf("Expected the watcher to be disconnected")
+	}
+	if _, backlog, _ := hub.Watch("default", "foo"); len(backlog) != 0 {
+		t.Errorf("Expected the backlog to be dropped, got %d events", len(backlog))
+	}
+}
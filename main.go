@@ -18,7 +18,9 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/rexagod/mad/internal"
 	"github.com/rexagod/mad/internal/server"
@@ -36,17 +38,51 @@ func main() {
 	// Set up flags.
 	klog.InitFlags(nil)
 	klog.SetOutput(os.Stdout)
-	kubeconfig := *flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig. Only required if out-of-cluster.")
-	masterURL := *flag.String("master", os.Getenv("KUBERNETES_MASTER"), "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
-	workers := *flag.Int("workers", 2, "Number of workers processing the queue. Defaults to 2.")
-	version := *flag.Bool("version", false, "Print version information and quit")
+	kubeconfig := flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "Path to a kubeconfig. Only required if out-of-cluster.")
+	masterURL := flag.String("master", os.Getenv("KUBERNETES_MASTER"), "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	workers := flag.Int("workers", 2, "Number of workers processing the queue. Defaults to 2.")
+	querierCredentials := flag.String("querier-credentials", string(internal.QuerierCredentialsRESTConfig), "Source of the credentials sent to endpoints served by the apiserver that do not configure their own. Other endpoints are never sent them. One of: rest-config (service account in-cluster, kubeconfig otherwise), service-account (requires the mounted service account files), none.")
+	probeConcurrency := flag.Int("probe-concurrency", 10, "Maximum number of endpoints queried at once, across all resources. Defaults to 10.")
+	leaderElect := flag.Bool("leader-elect", true, "Run the controller only while holding a lease, so multiple replicas can be deployed for high availability. Standby replicas keep their caches warm.")
+	leaderElectNamespace := flag.String("leader-elect-namespace", os.Getenv("NAMESPACE"), "Namespace of the leader election lease. Defaults to the NAMESPACE environment variable.")
+	leaderElectName := flag.String("leader-elect-name", "mad-controller", "Name of the leader election lease.")
+	leaderElectLeaseDuration := flag.Duration("leader-elect-lease-duration", 15*time.Second, "Duration that standby replicas wait before forcing to acquire leadership.")
+	leaderElectRenewDeadline := flag.Duration("leader-elect-renew-deadline", 10*time.Second, "Duration that the leader retries refreshing leadership before giving it up.")
+	leaderElectRetryPeriod := flag.Duration("leader-elect-retry-period", 2*time.Second, "Duration replicas wait between attempts to acquire or renew leadership.")
+	sharding := flag.Bool("sharding", false, "Spread the resources across all replicas through consistent hashing, instead of electing a leader to handle all of them. Overrides --leader-elect.")
+	shardNamespace := flag.String("shard-namespace", os.Getenv("NAMESPACE"), "Namespace of the shard member leases. Defaults to the NAMESPACE environment variable.")
+	shardName := flag.String("shard-name", "mad-controller", "Name of the shard group, which prefixes the shard member leases.")
+	shardAddress := flag.String("shard-address", os.Getenv("POD_IP")+":8080", "Address at which the other replicas can reach this replica's query server, to forward requests to it, either as the owner of a shard, or as the leader. Defaults to the POD_IP environment variable, on port 8080.")
+	shardLeaseDuration := flag.Duration("shard-lease-duration", 15*time.Second, "Duration after which a replica that stopped renewing its shard member lease leaves the group.")
+	watchNamespaces := flag.String("watch-namespaces", "", "Namespaces to watch. Either empty to watch all namespaces, a comma-separated list of namespaces, or a namespace label selector prefixed with \"selector:\", e.g., \"selector:mad.instrumentation.k8s-sigs.io/watch=true\". Only the cluster-wide mode requires cluster-wide permissions.")
+	historyStore := flag.String("history-store", string(internal.HistoryStoreStatus), "Store the history of resources is persisted to. One of: status (the last bufferSize records, in the status), configmap (chunked ConfigMaps next to the resources), file (append-only logs in --history-dir, e.g., on a PersistentVolume).")
+	historyRetention := flag.Duration("history-retention", time.Hour, "Duration for which raw records are kept by the configmap, and file history stores. Must be at least the widest rollup bucket.")
+	historyRollups := flag.String("history-rollups", "1m:24h,1h:720h", "Comma-separated <width>:<retention> tiers the configmap, and file history stores downsample raw records to, for long-term history. Each bucket keeps the sample, and failure counts, and the latency min, max, and percentiles. Queries pick the finest tier retaining the whole range. Empty to disable rollups.")
+	historyFlushInterval := flag.Duration("history-flush-interval", time.Minute, "Interval at which records are flushed to the configmap history store, in batches.")
+	historyChunkSize := flag.Int("history-chunk-size", 1000, "Maximum number of records per ConfigMap of the configmap history store.")
+	historyDir := flag.String("history-dir", "/var/lib/mad/history", "Directory the file history store writes to.")
+	statusMinInterval := flag.Duration("status-min-interval", 2*time.Second, "Window over which the status updates of a resource, e.g., of all its endpoints, are coalesced into a single server-side apply patch, and minimum interval between two status writes for a resource.")
+	auth := flag.Bool("auth", true, "Authenticate the callers of the query server by their bearer tokens, through TokenReviews, and authorize them through SubjectAccessReviews, so they can only query the resources in the namespaces they can get them in, and the debug handlers if they can get their paths.")
+	listenAddress := flag.String("listen-address", ":8080", "Address the query server listens at. Update --shard-address along with it.")
+	internalListenAddress := flag.String("internal-listen-address", ":8081", "Address the metrics, debug handlers, and pprof are served at, apart from the query server. Empty to serve the metrics, and debug handlers alongside the query server, without pprof.")
+	tlsCertFile := flag.String("tls-cert-file", "", "Path to the PEM-encoded certificate both addresses are served over TLS with, along with --tls-key-file. Both files are reloaded as they change. Requests forwarded to other replicas are sent over TLS as well, and their certificates are verified against --tls-peer-ca-file. Empty to serve plain HTTP.")
+	tlsKeyFile := flag.String("tls-key-file", "", "Path to the PEM-encoded key of --tls-cert-file.")
+	tlsPeerCAFile := flag.String("tls-peer-ca-file", "", "Path to the PEM-encoded CA bundle the certificates of other replicas are verified against, when forwarding requests to them over TLS, and the client certificates of the replicas forwarding requests to this one are verified against, to exempt them from the rate limits. The file is reloaded as it changes. Empty to use the system roots, and to exempt no requests.")
+	tlsPeerServerName := flag.String("tls-peer-server-name", "", "Name the certificates of other replicas are verified for, when forwarding requests to them over TLS, e.g., the name of their Service. Empty to verify them for the IPs they are addressed at.")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Maximum duration for reading a request to the query server, including its body. Watch streams are exempt. Zero for no timeout.")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "Maximum duration for writing the response of the query server, from the end of the request headers. Watch streams are exempt, and end once a write stalls for 10s instead. Zero for no timeout.")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "Maximum duration for which idle keep-alive connections to the query server are kept open. Zero for no timeout.")
+	queryRate := flag.Float64("query-rate", 10, "Rate of the requests to the query server allowed to each IP, and to each authenticated user, in requests per second. Requests forwarded by other replicas are exempt. Zero for no limit.")
+	queryBurst := flag.Int("query-burst", 50, "Number of requests to the query server each caller can burst to, above --query-rate, e.g., as a dashboard is loaded.")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of the request headers, in bytes, including the request line.")
+	version := flag.Bool("version", false, "Print version information and quit")
 	flag.Parse()
 
 	// Print version information.
 	v.Println()
 
 	// Quit if only version flag is set.
-	if version && flag.NFlag() == 1 {
+	if *version && flag.NFlag() == 1 {
 		os.Exit(0)
 	}
 
@@ -54,8 +90,22 @@ func main() {
 	ctx := signals.SetupSignalHandler()
 	logger := klog.FromContext(ctx)
 
+	// Parse the watched namespaces.
+	watchedNamespaces, err := internal.ParseWatchNamespaces(*watchNamespaces)
+	if err != nil {
+		logger.Error(err, "Error parsing --watch-namespaces")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
+	// Parse the history rollup tiers.
+	rollupTiers, err := internal.ParseRollupTiers(*historyRollups)
+	if err != nil {
+		logger.Error(err, "Error parsing --history-rollups")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
 	// Build client-sets.
-	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
+	cfg, err := clientcmd.BuildConfigFromFlags(*masterURL, *kubeconfig)
 	if err != nil {
 		logger.Error(err, "Error building kubeconfig")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
@@ -71,11 +121,76 @@ func main() {
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
+	// Start the controller.
+	controller, err := internal.NewController(ctx, kubeClientset, madClientset, cfg, internal.ControllerOptions{
+		QuerierCredentials: internal.QuerierCredentials(*querierCredentials),
+		ProbeConcurrency:   *probeConcurrency,
+		Sharding: internal.ShardingOptions{
+			Enabled:       *sharding,
+			Namespace:     *shardNamespace,
+			Name:          *shardName,
+			Address:       *shardAddress,
+			LeaseDuration: *shardLeaseDuration,
+		},
+		WatchNamespaces:   watchedNamespaces,
+		StatusMinInterval: *statusMinInterval,
+		History: internal.HistoryOptions{
+			Store:         internal.HistoryStoreKind(*historyStore),
+			Retention:     *historyRetention,
+			Rollups:       rollupTiers,
+			FlushInterval: *historyFlushInterval,
+			ChunkSize:     *historyChunkSize,
+			Dir:           *historyDir,
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Error building controller")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
 	// Start the endpoint server.
-	go server.Run(madClientset, logger, ctx)
+	var authorizer *server.Authorizer
+	if *auth {
+		authorizer = server.NewAuthorizer(kubeClientset)
+	}
+	go func() {
+		err := server.Run(controller.Lister(), controller, controller, controller, authorizer, map[string]http.Handler{
+			"/debug/registry": controller.RegistryHandler(),
+			"/metrics":        controller.MetricsHandler(),
+		}, server.Options{
+			Address:           *listenAddress,
+			InternalAddress:   *internalListenAddress,
+			TLSCertFile:       *tlsCertFile,
+			TLSKeyFile:        *tlsKeyFile,
+			TLSPeerCAFile:     *tlsPeerCAFile,
+			TLSPeerServerName: *tlsPeerServerName,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+			MaxHeaderBytes:    *maxHeaderBytes,
+			QueryRate:         *queryRate,
+			QueryBurst:        *queryBurst,
+		}, logger, ctx)
+		if err != nil {
+			logger.Error(err, "Error running server")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}()
 
-	// Start the controller.
-	if err = internal.NewController(ctx, kubeClientset, madClientset).Run(ctx, workers); err != nil {
+	if *sharding {
+		err = controller.RunSharded(ctx, *workers)
+	} else {
+		err = controller.RunWithLeaderElection(ctx, *workers, internal.LeaderElectionOptions{
+			Enabled:       *leaderElect,
+			Namespace:     *leaderElectNamespace,
+			Name:          *leaderElectName,
+			LeaseDuration: *leaderElectLeaseDuration,
+			RenewDeadline: *leaderElectRenewDeadline,
+			RetryPeriod:   *leaderElectRetryPeriod,
+			Address:       *shardAddress,
+		})
+	}
+	if err != nil {
 		logger.Error(err, "Error running controller")
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
@@ -0,0 +1,223 @@
+/*
+Copyright 2023 The Kubernetes mad Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewCompactHealthcheckBuffer encodes the records, oldest first, into a compact buffer. Records without a timestamp
+// are skipped, and nil is returned if none are left. The interval is the median gap between records, so the
+// timestamps of evenly probed endpoints encode to small offsets. Timestamps are kept to the millisecond, and latencies
+// to the microsecond.
+func NewCompactHealthcheckBuffer(records []HealthcheckRecord) *CompactHealthcheckBuffer {
+	timestamped := make([]HealthcheckRecord, 0, len(records))
+	for _, record := range records {
+		if record.Timestamp != nil {
+			timestamped = append(timestamped, record)
+		}
+	}
+	if len(timestamped) == 0 {
+		return nil
+	}
+
+	// Pick the median gap as the interval.
+	millis := make([]int64, len(timestamped))
+	for i, record := range timestamped {
+		millis[i] = record.Timestamp.UnixMilli()
+	}
+	var interval int64
+	if len(millis) > 1 {
+		gaps := make([]int64, len(millis)-1)
+		for i := range gaps {
+			gaps[i] = millis[i+1] - millis[i]
+		}
+		sort.Slice(gaps, func(i, j int) bool {
+			return gaps[i] < gaps[j]
+		})
+		interval = max(gaps[len(gaps)/2], 0)
+	}
+
+	// Encode all fields, record by record.
+	start := millis[0] - millis[0]%1000
+	offsets := make([]int64, len(timestamped))
+	attempts := make([]int64, len(timestamped))
+	latencies := make([]int64, len(timestamped))
+	endpointIndexes := make([]int64, len(timestamped))
+	var endpoints []string
+	var health []int32
+	expected, healthy, run, latency := start, true, int32(0), int64(0)
+	for i, record := range timestamped {
+		offsets[i] = millis[i] - expected
+		expected = millis[i] + interval
+		attempts[i] = int64(record.Attempts)
+		var next int64
+		if record.Latency != nil {
+			next = record.Latency.Microseconds() + 1
+		}
+		latencies[i] = next - latency
+		latency = next
+		if record.Endpoint != "" {
+			index := slices.Index(endpoints, record.Endpoint)
+			if index < 0 {
+				index, endpoints = len(endpoints), append(endpoints, record.Endpoint)
+			}
+			endpointIndexes[i] = int64(index) + 1
+		}
+		if isHealthy := record.Healthy != nil && *record.Healthy; isHealthy != healthy {
+			health = append(health, run)
+			healthy, run = isHealthy, 0
+		}
+		run++
+	}
+	health = append(health, run)
+
+	return &CompactHealthcheckBuffer{
+		Start:           metav1.NewTime(time.UnixMilli(start)),
+		Interval:        metav1.Duration{Duration: time.Duration(interval) * time.Millisecond},
+		Count:           int32(len(timestamped)),
+		Health:          health,
+		Offsets:         encodeVarints(offsets),
+		Attempts:        encodeVarints(attempts),
+		Latencies:       encodeVarints(latencies),
+		Endpoints:       endpoints,
+		EndpointIndexes: encodeVarints(endpointIndexes),
+	}
+}
+
+// Records decodes the records of the buffer, oldest first.
+func (b *CompactHealthcheckBuffer) Records() ([]HealthcheckRecord, error) {
+	if b == nil || b.Count <= 0 {
+		return nil, nil
+	}
+	count := int(b.Count)
+
+	// Decode all fields.
+	offsets, err := decodeVarints(b.Offsets, count)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding offsets: %w", err)
+	}
+	attempts, err := decodeVarints(b.Attempts, count)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding attempts: %w", err)
+	}
+	latencies, err := decodeVarints(b.Latencies, count)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding latencies: %w", err)
+	}
+	endpointIndexes, err := decodeVarints(b.EndpointIndexes, count)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding endpoint indexes: %w", err)
+	}
+	for _, index := range endpointIndexes {
+		if index < 0 || index > int64(len(b.Endpoints)) {
+			return nil, fmt.Errorf("error decoding endpoint indexes: %d is out of range", index)
+		}
+	}
+	health := make([]bool, 0, count)
+	healthy := true
+	for _, run := range b.Health {
+		if run < 0 || len(health)+int(run) > count {
+			return nil, fmt.Errorf("error decoding health: runs do not add up to %d records", count)
+		}
+		for i := int32(0); i < run; i++ {
+			health = append(health, healthy)
+		}
+		healthy = !healthy
+	}
+	if len(health) != count {
+		return nil, fmt.Errorf("error decoding health: runs do not add up to %d records", count)
+	}
+
+	// Rebuild the records.
+	records := make([]HealthcheckRecord, count)
+	expected, interval, latency := b.Start.UnixMilli(), b.Interval.Milliseconds(), int64(0)
+	for i := range records {
+		timestamp := expected + offsets[i]
+		expected = timestamp + interval
+		latency += latencies[i]
+		records[i] = HealthcheckRecord{
+			Timestamp: &metav1.Time{Time: time.UnixMilli(timestamp)},
+			Healthy:   &health[i],
+			Attempts:  int32(attempts[i]),
+		}
+		if endpointIndexes[i] > 0 {
+			records[i].Endpoint = b.Endpoints[endpointIndexes[i]-1]
+		}
+		if latency > 0 {
+			records[i].Latency = &metav1.Duration{Duration: time.Duration(latency-1) * time.Microsecond}
+		}
+	}
+
+	return records, nil
+}
+
+// Buffer returns the records of the buffer, oldest first, from either LastBuffer, or CompactBuffer, depending on the
+// encoding in use.
+func (s *MetricsAnomalyDetectorResourceStatus) Buffer() ([]HealthcheckRecord, error) {
+	if s.CompactBuffer != nil {
+		return s.CompactBuffer.Records()
+	}
+
+	return s.LastBuffer, nil
+}
+
+// encodeVarints encodes the values as zigzag-encoded varints, in base64, or as an empty string if they are all zero.
+func encodeVarints(values []int64) string {
+	var buf []byte
+	zero := true
+	for _, value := range values {
+		zero = zero && value == 0
+		buf = binary.AppendVarint(buf, value)
+	}
+	if zero {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// decodeVarints decodes exactly count values encoded by encodeVarints.
+func decodeVarints(encoded string, count int) ([]int64, error) {
+	values := make([]int64, count)
+	if encoded == "" {
+		return values, nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		value, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("expected %d values, got %d", count, i)
+		}
+		values[i], buf = value, buf[n:]
+	}
+	if len(buf) > 0 {
+		return nil, fmt.Errorf("expected %d values, got more", count)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Kubernetes mad Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompactHealthcheckBuffer(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(1234 * time.Millisecond)
+
+	// Records should be probed roughly every minute, with some jitter, gaps, and records without a latency.
+	records := make([]HealthcheckRecord, 1000)
+	timestamp := start
+	for i := range records {
+		healthy := i%7 != 0 && i%11 != 0
+		timestamp = timestamp.Add(time.Minute + time.Duration(i%5-2)*time.Millisecond)
+		if i%100 == 0 {
+			timestamp = timestamp.Add(time.Hour)
+		}
+		records[i] = HealthcheckRecord{
+			Timestamp: &metav1.Time{Time: timestamp},
+			Healthy:   &healthy,
+			Attempts:  int32(i%3 + 1),
+		}
+		if i%17 != 0 {
+			records[i].Endpoint = []string{"https://a/healthz", "https://b/healthz"}[i%2]
+		}
+		if i%13 != 0 {
+			records[i].Latency = &metav1.Duration{Duration: time.Duration(i%50+1) * 1234 * time.Microsecond}
+		}
+	}
+
+	// The buffer should decode back to the same records.
+	buffer := NewCompactHealthcheckBuffer(records)
+	if buffer.Interval.Duration != time.Minute {
+		t.Errorf("Expected an interval of %s, got %s", time.Minute, buffer.Interval.Duration)
+	}
+	status := MetricsAnomalyDetectorResourceStatus{CompactBuffer: buffer}
+	decoded, err := status.Buffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("Expected %d records, got %d", len(records), len(decoded))
+	}
+	for i, record := range decoded {
+		want := records[i]
+		if !record.Timestamp.Equal(want.Timestamp) || record.Endpoint != want.Endpoint || *record.Healthy != *want.Healthy || record.Attempts != want.Attempts ||
+			(record.Latency == nil) != (want.Latency == nil) || (record.Latency != nil && record.Latency.Duration != want.Latency.Duration) {
+			t.Errorf("Expected record %d to be %v, got %v", i, want, record)
+		}
+	}
+
+	// The buffer should be much smaller than the records.
+	full, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := json.Marshal(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact)*5 > len(full) {
+		t.Errorf("Expected the compact buffer (%d bytes) to be at least 5 times smaller than the records (%d bytes)", len(compact), len(full))
+	}
+
+	// Corrupted buffers should fail to decode.
+	for name, corrupt := range map[string]func(b *CompactHealthcheckBuffer){
+		"count":     func(b *CompactHealthcheckBuffer) { b.Count++ },
+		"health":    func(b *CompactHealthcheckBuffer) { b.Health[0]-- },
+		"offsets":   func(b *CompactHealthcheckBuffer) { b.Offsets = b.Offsets[:len(b.Offsets)/2] },
+		"base64":    func(b *CompactHealthcheckBuffer) { b.Latencies = "!" },
+		"endpoints": func(b *CompactHealthcheckBuffer) { b.Endpoints = b.Endpoints[:1] },
+	} {
+		corrupted := buffer.DeepCopy()
+		corrupt(corrupted)
+		if _, err = corrupted.Records(); err == nil {
+			t.Errorf("Expected a buffer with corrupted %s to fail to decode", name)
+		}
+	}
+
+	// Empty buffers should decode to no records.
+	if buffer = NewCompactHealthcheckBuffer(nil); buffer != nil {
+		t.Errorf("Expected no buffer for no records, got %v", buffer)
+	}
+	if decoded, err = buffer.Records(); err != nil || len(decoded) != 0 {
+		t.Errorf("Expected no records, got %d (%v)", len(decoded), err)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -24,6 +25,13 @@ import (
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
 // +kubebuilder:rbac:groups=mad.instrumentation.k8s-sigs.io,resources=metricsanomalydetectorresources;metricsanomalydetectorresources/status,verbs=*
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;create;update;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;create;update;delete
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
 // MetricsAnomalyDetectorResource is a specification for a MetricsAnomalyDetectorResource resource.
 // +kubebuilder:resource:shortName=madresource
@@ -39,20 +47,37 @@ type MetricsAnomalyDetectorResource struct {
 }
 
 // MetricsAnomalyDetectorResourceSpec is the spec for a MetricsAnomalyDetectorResource resource.
+// +kubebuilder:validation:XValidation:rule="self.bufferSize <= 255 || (has(self.bufferEncoding) && self.bufferEncoding == 'Compact')",message="bufferSize beyond 255 requires the Compact bufferEncoding"
 type MetricsAnomalyDetectorResourceSpec struct {
 
 	// BufferSize is the size of the circular buffer at any given time.
 	// If the specified value is less than the current, last excessive entries will be dropped.
+	// Sizes beyond 255 require the Compact BufferEncoding.
 	// +kube:validation:Optional
 	// +kubebuilder:validation:Minimum=1
-	// +kubebuilder:validation:Maximum=255
+	// +kubebuilder:validation:Maximum=10000
 	// +kubebuilder:default=10
 	BufferSize int `json:"bufferSize"`
 
+	// BufferEncoding is the encoding of the buffer in the status. Records lists every record in lastBuffer, while
+	// Compact packs them into compactBuffer, which keeps the status small enough for much larger buffers.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Records;Compact
+	// +kubebuilder:default=Records
+	// +optional
+	BufferEncoding BufferEncoding `json:"bufferEncoding,omitempty"`
+
 	// HealthcheckEndpoints is the list of endpoints to query.
 	// +kube:validation:Required
 	HealthcheckEndpoints []string `json:"healthcheckEndpoints"`
 
+	// HealthcheckEndpointsConfig holds the connection settings for the endpoints listed in HealthcheckEndpoints.
+	// Endpoints that do not have an entry here are queried using the controller's default credentials, as set by its
+	// --querier-credentials flag, if they are served by the apiserver, and without credentials otherwise.
+	// +kubebuilder:validation:Optional
+	// +optional
+	HealthcheckEndpointsConfig []HealthcheckEndpointConfig `json:"healthcheckEndpointsConfig,omitempty"`
+
 	// QueryInterval is the interval at which the endpoints are queried, in seconds.
 	// +kube:validation:Optional
 	// +kubebuilder:validation:Minimum=1
@@ -61,6 +86,141 @@ type MetricsAnomalyDetectorResourceSpec struct {
 	QueryInterval int `json:"queryInterval"`
 }
 
+// BufferEncoding is the encoding of the buffer in the status.
+type BufferEncoding string
+
+const (
+
+	// BufferEncodingRecords lists every record of the buffer in the status, as is.
+	BufferEncodingRecords BufferEncoding = "Records"
+
+	// BufferEncodingCompact packs the records of the buffer into a CompactHealthcheckBuffer.
+	BufferEncodingCompact BufferEncoding = "Compact"
+)
+
+// HealthcheckEndpointConfig holds the connection settings for a single healthcheck endpoint.
+type HealthcheckEndpointConfig struct {
+
+	// Endpoint is the healthcheck endpoint these settings apply to. It must also be listed in HealthcheckEndpoints.
+	// +kube:validation:Required
+	Endpoint string `json:"endpoint"`
+
+	// Auth holds the credentials sent to the endpoint.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Auth *HealthcheckEndpointAuth `json:"auth,omitempty"`
+
+	// TLS holds the TLS settings used to connect to the endpoint.
+	// +kubebuilder:validation:Optional
+	// +optional
+	TLS *HealthcheckEndpointTLSConfig `json:"tls,omitempty"`
+
+	// Timeout is the total time allowed for querying the endpoint in a single tick, including all retries.
+	// Defaults to, and is capped at, the query interval.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// ConnectTimeout is the time allowed for establishing a connection to the endpoint, per attempt.
+	// Defaults to 5s.
+	// +kubebuilder:validation:Optional
+	// +optional
+	ConnectTimeout *metav1.Duration `json:"connectTimeout,omitempty"`
+
+	// Retries is the number of times a failed query is retried within a single tick. Only connection errors, timeouts,
+	// 429, and 5xx responses are retried, other failures are considered hard failures.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+
+	// RetryBackoff is the time waited before the first retry, doubling for every subsequent one.
+	// Defaults to 1s.
+	// +kubebuilder:validation:Optional
+	// +optional
+	RetryBackoff *metav1.Duration `json:"retryBackoff,omitempty"`
+}
+
+// HealthcheckEndpointAuthType is the authentication scheme used to query a healthcheck endpoint.
+type HealthcheckEndpointAuthType string
+
+const (
+
+	// HealthcheckEndpointAuthTypeServiceAccount sends the controller's default credentials, which is only allowed for
+	// endpoints served by the apiserver.
+	HealthcheckEndpointAuthTypeServiceAccount HealthcheckEndpointAuthType = "ServiceAccount"
+
+	// HealthcheckEndpointAuthTypeNone sends no credentials.
+	HealthcheckEndpointAuthTypeNone HealthcheckEndpointAuthType = "None"
+
+	// HealthcheckEndpointAuthTypeBearerToken sends the bearer token referenced by HealthcheckEndpointAuth.BearerToken.
+	HealthcheckEndpointAuthTypeBearerToken HealthcheckEndpointAuthType = "BearerToken"
+
+	// HealthcheckEndpointAuthTypeBasicAuth sends the credentials referenced by HealthcheckEndpointAuth.BasicAuth.
+	HealthcheckEndpointAuthTypeBasicAuth HealthcheckEndpointAuthType = "BasicAuth"
+)
+
+// HealthcheckEndpointAuth holds the credentials sent to a healthcheck endpoint.
+// All referenced Secrets must live in the same namespace as the MetricsAnomalyDetectorResource.
+type HealthcheckEndpointAuth struct {
+
+	// Type is the authentication scheme used to query the endpoint.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=ServiceAccount;None;BearerToken;BasicAuth
+	// +kubebuilder:default=ServiceAccount
+	// +optional
+	Type HealthcheckEndpointAuthType `json:"type,omitempty"`
+
+	// BearerToken references the Secret key holding the bearer token. Required if Type is BearerToken.
+	// +kubebuilder:validation:Optional
+	// +optional
+	BearerToken *corev1.SecretKeySelector `json:"bearerToken,omitempty"`
+
+	// BasicAuth references the Secret keys holding the basic authentication credentials. Required if Type is BasicAuth.
+	// +kubebuilder:validation:Optional
+	// +optional
+	BasicAuth *BasicAuth `json:"basicAuth,omitempty"`
+}
+
+// BasicAuth references the Secret keys holding basic authentication credentials.
+type BasicAuth struct {
+
+	// Username references the Secret key holding the username.
+	// +kube:validation:Required
+	Username corev1.SecretKeySelector `json:"username"`
+
+	// Password references the Secret key holding the password.
+	// +kube:validation:Required
+	Password corev1.SecretKeySelector `json:"password"`
+}
+
+// HealthcheckEndpointTLSConfig holds the TLS settings used to connect to a healthcheck endpoint.
+// All referenced Secrets must live in the same namespace as the MetricsAnomalyDetectorResource.
+type HealthcheckEndpointTLSConfig struct {
+
+	// CA references the Secret key holding the PEM-encoded CA bundle used to verify the endpoint.
+	// Defaults to the controller's service account CA.
+	// +kubebuilder:validation:Optional
+	// +optional
+	CA *corev1.SecretKeySelector `json:"ca,omitempty"`
+
+	// Cert references the Secret key holding the PEM-encoded client certificate, for mTLS. Requires Key.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Cert *corev1.SecretKeySelector `json:"cert,omitempty"`
+
+	// Key references the Secret key holding the PEM-encoded client key, for mTLS. Requires Cert.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Key *corev1.SecretKeySelector `json:"key,omitempty"`
+
+	// InsecureSkipVerify disables the verification of the endpoint's certificate chain and host name.
+	// +kubebuilder:validation:Optional
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
 // HealthcheckRecord is a record of a healthcheck event.
 type HealthcheckRecord struct {
 
@@ -70,10 +230,124 @@ type HealthcheckRecord struct {
 	// +optional
 	Timestamp *metav1.Time `json:"timestamp"`
 
+	// Endpoint is the healthcheck endpoint that was queried. Empty for records that predate it.
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+
 	// Healthy is the health status of the component.
 	// +kubebuilder:validation:Optional
 	// +optional
 	Healthy *bool `json:"healthy"`
+
+	// Attempts is the number of queries made in the tick, including retries. A healthy record with more than one
+	// attempt denotes a transient failure that recovered within the tick, as opposed to an unhealthy record, which
+	// denotes a failure that persisted through all retries, or one that is not retried.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Latency is the duration of the last query made in the tick.
+	// +kubebuilder:validation:Optional
+	// +optional
+	Latency *metav1.Duration `json:"latency,omitempty"`
+}
+
+// HealthcheckBucket is a rollup of the healthcheck records within a time window, as kept for long-term history.
+type HealthcheckBucket struct {
+
+	// Timestamp is the start of the window.
+	Timestamp *metav1.Time `json:"timestamp"`
+
+	// Width is the width of the window. Buckets holding a single raw record have no width.
+	Width metav1.Duration `json:"width"`
+
+	// Samples is the number of records within the window.
+	Samples int32 `json:"samples"`
+
+	// Failures is the number of unhealthy records within the window.
+	Failures int32 `json:"failures"`
+
+	// LatencyMin is the lowest latency within the window.
+	// +optional
+	LatencyMin *metav1.Duration `json:"latencyMin,omitempty"`
+
+	// LatencyMax is the highest latency within the window.
+	// +optional
+	LatencyMax *metav1.Duration `json:"latencyMax,omitempty"`
+
+	// LatencyP50 is the median latency within the window.
+	// +optional
+	LatencyP50 *metav1.Duration `json:"latencyP50,omitempty"`
+
+	// LatencyP90 is the 90th percentile latency within the window.
+	// +optional
+	LatencyP90 *metav1.Duration `json:"latencyP90,omitempty"`
+
+	// LatencyP99 is the 99th percentile latency within the window.
+	// +optional
+	LatencyP99 *metav1.Duration `json:"latencyP99,omitempty"`
+}
+
+// Bucket returns the record as a bucket of its own.
+func (r HealthcheckRecord) Bucket() HealthcheckBucket {
+	bucket := HealthcheckBucket{
+		Timestamp:  r.Timestamp,
+		Samples:    1,
+		LatencyMin: r.Latency,
+		LatencyMax: r.Latency,
+		LatencyP50: r.Latency,
+		LatencyP90: r.Latency,
+		LatencyP99: r.Latency,
+	}
+	if r.Healthy == nil || !*r.Healthy {
+		bucket.Failures = 1
+	}
+
+	return bucket
+}
+
+// CompactHealthcheckBuffer is a compact encoding of the healthcheck records of a buffer, oldest first. Timestamps are
+// encoded as their offsets from the expected ones, i.e., the previous timestamp plus the interval, health as runs of
+// alternating states, latencies as deltas from the previous ones, and endpoints as indexes into the distinct ones.
+// Variable-length fields are sequences of zigzag-encoded varints, in base64. Empty ones denote all zeroes.
+type CompactHealthcheckBuffer struct {
+
+	// Start is the expected timestamp of the first record.
+	Start metav1.Time `json:"start"`
+
+	// Interval is the expected interval between records.
+	Interval metav1.Duration `json:"interval"`
+
+	// Count is the number of records.
+	// +kubebuilder:validation:Minimum=0
+	Count int32 `json:"count"`
+
+	// Health is the run-length encoded health of the records, alternating between healthy, and unhealthy runs,
+	// starting with a (possibly empty) healthy one.
+	// +optional
+	Health []int32 `json:"health,omitempty"`
+
+	// Offsets are the offsets of the timestamps from the expected ones, in milliseconds.
+	// +optional
+	Offsets string `json:"offsets,omitempty"`
+
+	// Attempts are the attempts of the records.
+	// +optional
+	Attempts string `json:"attempts,omitempty"`
+
+	// Latencies are the deltas between the latencies of consecutive records, in microseconds, offset by one, so
+	// records without a latency are encoded as zero.
+	// +optional
+	Latencies string `json:"latencies,omitempty"`
+
+	// Endpoints are the distinct endpoints of the records, in order of appearance.
+	// +optional
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// EndpointIndexes are the indexes of the endpoints of the records in Endpoints, offset by one, so records without
+	// an endpoint are encoded as zero.
+	// +optional
+	EndpointIndexes string `json:"endpointIndexes,omitempty"`
 }
 
 // MetricsAnomalyDetectorResourceStatus is the status for a MetricsAnomalyDetectorResource resource.
@@ -89,12 +363,17 @@ type MetricsAnomalyDetectorResourceStatus struct {
 	// +optional
 	LastBufferModificationTime metav1.Time `json:"lastBufferModificationTime"`
 
-	// LastBuffer is the last buffer of events.
+	// LastBuffer is the last buffer of events. Empty if the Compact BufferEncoding is used.
 	// +kubebuilder:validation:Optional
 	// +optional
 	LastBuffer []HealthcheckRecord `json:"lastBuffer"`
 
-	// HealthcheckEndpointsHealthy is the list of healthy endpoints.
+	// CompactBuffer is the last buffer of events, if the Compact BufferEncoding is used. Use Buffer to decode it.
+	// +kubebuilder:validation:Optional
+	// +optional
+	CompactBuffer *CompactHealthcheckBuffer `json:"compactBuffer,omitempty"`
+
+	// HealthcheckEndpointsHealthy maps each endpoint to whether it was healthy in its last probe.
 	// +kubebuilder:validation:Optional
 	// +optional
 	HealthcheckEndpointsHealthy map[string]bool `json:"healthcheckEndpointsHealthy"`
@@ -103,8 +382,39 @@ type MetricsAnomalyDetectorResourceStatus struct {
 	// +kubebuilder:validation:Optional
 	// +optional
 	LastHealthcheckQueryTime metav1.Time `json:"lastHealthcheckQueryTime"`
+
+	// Conditions describe the current state of the resource. Known condition types are Ready, Probing, Degraded,
+	// AnomalyDetected, and InvalidSpec.
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	// +kubebuilder:validation:Optional
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 }
 
+const (
+
+	// ConditionTypeReady is True when the spec is valid, and all endpoints were found healthy in their last probe.
+	ConditionTypeReady = "Ready"
+
+	// ConditionTypeProbing is True when the endpoints are being probed.
+	ConditionTypeProbing = "Probing"
+
+	// ConditionTypeDegraded is True when at least one endpoint was found unhealthy in its last probe.
+	ConditionTypeDegraded = "Degraded"
+
+	// ConditionTypeAnomalyDetected is True when the health of the buffer is anomalous.
+	ConditionTypeAnomalyDetected = "AnomalyDetected"
+
+	// ConditionTypeInvalidSpec is True when the spec cannot be acted upon. Its message describes the problems.
+	ConditionTypeInvalidSpec = "InvalidSpec"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:object:root=true
 
@@ -22,9 +22,201 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BasicAuth) DeepCopyInto(out *BasicAuth) {
+	*out = *in
+	in.Username.DeepCopyInto(&out.Username)
+	in.Password.DeepCopyInto(&out.Password)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BasicAuth.
+func (in *BasicAuth) DeepCopy() *BasicAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(BasicAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CompactHealthcheckBuffer) DeepCopyInto(out *CompactHealthcheckBuffer) {
+	*out = *in
+	in.Start.DeepCopyInto(&out.Start)
+	out.Interval = in.Interval
+	if in.Health != nil {
+		in, out := &in.Health, &out.Health
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.Endpoints != nil {
+		in, out := &in.Endpoints, &out.Endpoints
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CompactHealthcheckBuffer.
+func (in *CompactHealthcheckBuffer) DeepCopy() *CompactHealthcheckBuffer {
+	if in == nil {
+		return nil
+	}
+	out := new(CompactHealthcheckBuffer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HealthcheckBucket) DeepCopyInto(out *HealthcheckBucket) {
+	*out = *in
+	if in.Timestamp != nil {
+		in, out := &in.Timestamp, &out.Timestamp
+		*out = (*in).DeepCopy()
+	}
+	out.Width = in.Width
+	if in.LatencyMin != nil {
+		in, out := &in.LatencyMin, &out.LatencyMin
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LatencyMax != nil {
+		in, out := &in.LatencyMax, &out.LatencyMax
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LatencyP50 != nil {
+		in, out := &in.LatencyP50, &out.LatencyP50
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LatencyP90 != nil {
+		in, out := &in.LatencyP90, &out.LatencyP90
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.LatencyP99 != nil {
+		in, out := &in.LatencyP99, &out.LatencyP99
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HealthcheckBucket.
+func (in *HealthcheckBucket) DeepCopy() *HealthcheckBucket {
+	if in == nil {
+		return nil
+	}
+	out := new(HealthcheckBucket)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HealthcheckEndpointAuth) DeepCopyInto(out *HealthcheckEndpointAuth) {
+	*out = *in
+	if in.BearerToken != nil {
+		in, out := &in.BearerToken, &out.BearerToken
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BasicAuth != nil {
+		in, out := &in.BasicAuth, &out.BasicAuth
+		*out = new(BasicAuth)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HealthcheckEndpointAuth.
+func (in *HealthcheckEndpointAuth) DeepCopy() *HealthcheckEndpointAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(HealthcheckEndpointAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HealthcheckEndpointConfig) DeepCopyInto(out *HealthcheckEndpointConfig) {
+	*out = *in
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(HealthcheckEndpointAuth)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(HealthcheckEndpointTLSConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ConnectTimeout != nil {
+		in, out := &in.ConnectTimeout, &out.ConnectTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RetryBackoff != nil {
+		in, out := &in.RetryBackoff, &out.RetryBackoff
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HealthcheckEndpointConfig.
+func (in *HealthcheckEndpointConfig) DeepCopy() *HealthcheckEndpointConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(HealthcheckEndpointConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HealthcheckEndpointTLSConfig) DeepCopyInto(out *HealthcheckEndpointTLSConfig) {
+	*out = *in
+	if in.CA != nil {
+		in, out := &in.CA, &out.CA
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cert != nil {
+		in, out := &in.Cert, &out.Cert
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Key != nil {
+		in, out := &in.Key, &out.Key
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HealthcheckEndpointTLSConfig.
+func (in *HealthcheckEndpointTLSConfig) DeepCopy() *HealthcheckEndpointTLSConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(HealthcheckEndpointTLSConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *HealthcheckRecord) DeepCopyInto(out *HealthcheckRecord) {
 	*out = *in
@@ -37,6 +229,11 @@ func (in *HealthcheckRecord) DeepCopyInto(out *HealthcheckRecord) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.Latency != nil {
+		in, out := &in.Latency, &out.Latency
+		*out = new(v1.Duration)
+		**out = **in
+	}
 	return
 }
 
@@ -119,6 +316,13 @@ func (in *MetricsAnomalyDetectorResourceSpec) DeepCopyInto(out *MetricsAnomalyDe
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.HealthcheckEndpointsConfig != nil {
+		in, out := &in.HealthcheckEndpointsConfig, &out.HealthcheckEndpointsConfig
+		*out = make([]HealthcheckEndpointConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -143,6 +347,11 @@ func (in *MetricsAnomalyDetectorResourceStatus) DeepCopyInto(out *MetricsAnomaly
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.CompactBuffer != nil {
+		in, out := &in.CompactBuffer, &out.CompactBuffer
+		*out = new(CompactHealthcheckBuffer)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.HealthcheckEndpointsHealthy != nil {
 		in, out := &in.HealthcheckEndpointsHealthy, &out.HealthcheckEndpointsHealthy
 		*out = make(map[string]bool, len(*in))
@@ -151,6 +360,13 @@ func (in *MetricsAnomalyDetectorResourceStatus) DeepCopyInto(out *MetricsAnomaly
 		}
 	}
 	in.LastHealthcheckQueryTime.DeepCopyInto(&out.LastHealthcheckQueryTime)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 